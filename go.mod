@@ -3,7 +3,11 @@ module github.com/otoolep/hraftd
 go 1.13
 
 require (
-	github.com/hashicorp/raft v1.1.1
-	github.com/hashicorp/raft-boltdb v0.0.0-20191021154308-4207f1bf0617
+	github.com/armon/go-metrics v0.0.0-20190430140413-ec5e00d3c878
+	github.com/hashicorp/go-msgpack v0.5.5
+	github.com/hashicorp/raft v1.3.11
+	github.com/hashicorp/raft-boltdb/v2 v2.2.2
 	github.com/prometheus/client_golang v0.9.2
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
 )
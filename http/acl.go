@@ -0,0 +1,467 @@
+package httpd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otoolep/hraftd/store"
+)
+
+// aclKeyPrefix is the prefix of the keys under which ACL rules are stored, so
+// that they are replicated like any other key. The rule for a token is stored
+// under the SHA-256 hash of the token, so that listing keys does not reveal
+// tokens.
+const aclKeyPrefix = "_acl/"
+
+const aclRuleKey contextKey = iota + 2
+
+// errForbidden is returned by an aclStore for keys its token may not access.
+var errForbidden = errors.New("token may not access key")
+
+// aclRule is what a token, other than AuthToken, may do. Such tokens may only
+// use the key endpoints, and only for keys starting with one of Prefixes, or
+// any key if there are none.
+type aclRule struct {
+	Read     bool     `json:"read"`
+	Write    bool     `json:"write"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// aclKey returns the key under which the rule for token is stored.
+func aclKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return aclKeyPrefix + hex.EncodeToString(h[:])
+}
+
+// withACL returns r with the ACL rule for its bearer token in its context,
+// and true, if there is such a rule.
+func (s *Service) withACL(r *http.Request) (*http.Request, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return r, false
+	}
+	v, err := s.store.Get(aclKey(token))
+	if err != nil {
+		return r, false
+	}
+	var rule aclRule
+	if err := json.Unmarshal([]byte(v), &rule); err != nil {
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), aclRuleKey, &rule)), true
+}
+
+// authorized returns whether r is allowed by the ACL rule of its token, if it
+// has one. Otherwise a 403 response is written. Keys outside the rule's
+// prefixes are refused by the store returned by storeFor.
+func (s *Service) authorized(w http.ResponseWriter, r *http.Request) bool {
+	rule, _ := r.Context().Value(aclRuleKey).(*aclRule)
+	if rule == nil {
+		return true
+	}
+	p := r.URL.Path
+	if !strings.HasPrefix(p, "/key") && p != "/txn" && p != "/watch" && p != "/ws/watch" {
+		writeError(w, http.StatusForbidden, "token may only access keys")
+		return false
+	}
+	if isKeyWrite(r) && !rule.Write {
+		writeError(w, http.StatusForbidden, "token may not write keys")
+		return false
+	}
+	if !isKeyWrite(r) && !rule.Read {
+		writeError(w, http.StatusForbidden, "token may not read keys")
+		return false
+	}
+	return true
+}
+
+// permitted returns whether the token of r may access every one of keys, so
+// that a request changing several keys, one at a time, can be refused before
+// changing any. Otherwise a 403 response is written.
+func (s *Service) permitted(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	rule, _ := r.Context().Value(aclRuleKey).(*aclRule)
+	if rule == nil {
+		return true
+	}
+	a := aclStore{prefixes: rule.Prefixes}
+	for _, k := range keys {
+		if !a.allowed(namespacedKey(r, k)) {
+			writeError(w, http.StatusForbidden, errForbidden.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// handleACL sets or removes the ACL rule for a token. Only AuthToken may
+// manage rules, which only apply when it is set.
+func (s *Service) handleACL(w http.ResponseWriter, r *http.Request) {
+	if s.AuthToken == "" {
+		writeError(w, http.StatusBadRequest, "ACLs require an auth token to be set")
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+		aclRule
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil || req.Token == "" {
+		writeError(w, http.StatusBadRequest, "request body must contain token")
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "PUT":
+		b, _ := json.Marshal(req.aclRule)
+		err = s.storeWrite(func() error {
+			return s.store.SetCtx(r.Context(), aclKey(req.Token), string(b))
+		})
+	case "DELETE":
+		err = s.storeWrite(func() error {
+			return s.store.DeleteCtx(r.Context(), aclKey(req.Token))
+		})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err == store.ErrNotLeader {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+}
+
+// aclStore is a Store confining a token to the keys its ACL rule allows.
+// ACL rules themselves are never accessible through it.
+type aclStore struct {
+	Store
+	prefixes []string
+}
+
+// covers returns whether every key starting with prefix is within the
+// allowed prefixes.
+func (a aclStore) covers(prefix string) bool {
+	if len(a.prefixes) == 0 {
+		return true
+	}
+	for _, p := range a.prefixes {
+		if strings.HasPrefix(prefix, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps returns whether some key may start with both prefix and reserved.
+func overlaps(prefix, reserved string) bool {
+	return strings.HasPrefix(reserved, prefix) || strings.HasPrefix(prefix, reserved)
+}
+
+// allowed returns whether key may be accessed. Neither ACL rules nor schemas
+// may be, whatever the prefixes.
+func (a aclStore) allowed(key string) bool {
+	return a.covers(key) && !strings.HasPrefix(key, aclKeyPrefix) && !strings.HasPrefix(key, schemaKeyPrefix)
+}
+
+// check returns errForbidden unless every one of keys may be accessed.
+func (a aclStore) check(keys ...string) error {
+	for _, k := range keys {
+		if !a.allowed(k) {
+			return errForbidden
+		}
+	}
+	return nil
+}
+
+func (a aclStore) Get(key string) (string, error) {
+	if err := a.check(key); err != nil {
+		return "", err
+	}
+	return a.Store.Get(key)
+}
+
+func (a aclStore) Exists(key string) (bool, error) {
+	if err := a.check(key); err != nil {
+		return false, err
+	}
+	return a.Store.Exists(key)
+}
+
+func (a aclStore) GetWithLevel(key string, level store.ConsistencyLevel) (string, error) {
+	if err := a.check(key); err != nil {
+		return "", err
+	}
+	return a.Store.GetWithLevel(key, level)
+}
+
+func (a aclStore) GetCtx(ctx context.Context, key string, level store.ConsistencyLevel) (string, error) {
+	if err := a.check(key); err != nil {
+		return "", err
+	}
+	return a.Store.GetCtx(ctx, key, level)
+}
+
+func (a aclStore) GetAt(key string, index uint64) (string, error) {
+	if err := a.check(key); err != nil {
+		return "", err
+	}
+	return a.Store.GetAt(key, index)
+}
+
+func (a aclStore) GetWithVersion(ctx context.Context, key string, level store.ConsistencyLevel) (string, uint64, error) {
+	if err := a.check(key); err != nil {
+		return "", 0, err
+	}
+	return a.Store.GetWithVersion(ctx, key, level)
+}
+
+func (a aclStore) Scan(prefix string) (map[string]string, error) {
+	if !a.covers(prefix) {
+		return nil, errForbidden
+	}
+	m, err := a.Store.Scan(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for k := range m {
+		if !a.allowed(k) {
+			delete(m, k)
+		}
+	}
+	return m, nil
+}
+
+func (a aclStore) ScanMeta(prefix string) ([]store.KeyMeta, error) {
+	if !a.covers(prefix) {
+		return nil, errForbidden
+	}
+	meta, err := a.Store.ScanMeta(prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := meta[:0]
+	for _, m := range meta {
+		if a.allowed(m.Key) {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+func (a aclStore) GetMulti(keys []string) (map[string]*string, error) {
+	if err := a.check(keys...); err != nil {
+		return nil, err
+	}
+	return a.Store.GetMulti(keys)
+}
+
+func (a aclStore) ScanPage(prefix, after string, limit int) ([]string, string, error) {
+	if !a.covers(prefix) {
+		return nil, "", errForbidden
+	}
+	keys, next, err := a.Store.ScanPage(prefix, after, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	out := keys[:0]
+	for _, k := range keys {
+		if a.allowed(k) {
+			out = append(out, k)
+		}
+	}
+	return out, next, nil
+}
+
+func (a aclStore) Set(key, value string) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.Set(key, value)
+}
+
+func (a aclStore) SetCtx(ctx context.Context, key, value string) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.SetCtx(ctx, key, value)
+}
+
+func (a aclStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.SetWithTTL(key, value, ttl)
+}
+
+func (a aclStore) SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.SetWithTTLCtx(ctx, key, value, ttl)
+}
+
+func (a aclStore) SetIfVersion(ctx context.Context, key, value string, version uint64) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.SetIfVersion(ctx, key, value, version)
+}
+
+func (a aclStore) DeleteIfVersion(ctx context.Context, key string, version uint64) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.DeleteIfVersion(ctx, key, version)
+}
+
+func (a aclStore) SetMulti(kv map[string]string) error {
+	return a.SetMultiCtx(context.Background(), kv)
+}
+
+func (a aclStore) SetMultiCtx(ctx context.Context, kv map[string]string) error {
+	for k := range kv {
+		if err := a.check(k); err != nil {
+			return err
+		}
+	}
+	return a.Store.SetMultiCtx(ctx, kv)
+}
+
+func (a aclStore) Txn(ctx context.Context, txn store.Txn) (bool, error) {
+	if err := a.check(txn.Keys()...); err != nil {
+		return false, err
+	}
+	return a.Store.Txn(ctx, txn)
+}
+
+func (a aclStore) CompareAndSwap(key, old, new string) (bool, error) {
+	if err := a.check(key); err != nil {
+		return false, err
+	}
+	return a.Store.CompareAndSwap(key, old, new)
+}
+
+func (a aclStore) CompareAndSwapCtx(ctx context.Context, key, old, new string) (bool, error) {
+	if err := a.check(key); err != nil {
+		return false, err
+	}
+	return a.Store.CompareAndSwapCtx(ctx, key, old, new)
+}
+
+func (a aclStore) Increment(key string, delta int64) (int64, error) {
+	if err := a.check(key); err != nil {
+		return 0, err
+	}
+	return a.Store.Increment(key, delta)
+}
+
+func (a aclStore) IncrementCtx(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := a.check(key); err != nil {
+		return 0, err
+	}
+	return a.Store.IncrementCtx(ctx, key, delta)
+}
+
+func (a aclStore) Append(key, chunk string) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.Append(key, chunk)
+}
+
+func (a aclStore) AppendCtx(ctx context.Context, key, chunk string) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.AppendCtx(ctx, key, chunk)
+}
+
+func (a aclStore) Delete(key string) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.Delete(key)
+}
+
+func (a aclStore) DeleteMulti(keys []string) (int, error) {
+	if err := a.check(keys...); err != nil {
+		return 0, err
+	}
+	return a.Store.DeleteMulti(keys)
+}
+
+func (a aclStore) DeleteMultiCtx(ctx context.Context, keys []string) (int, error) {
+	if err := a.check(keys...); err != nil {
+		return 0, err
+	}
+	return a.Store.DeleteMultiCtx(ctx, keys)
+}
+
+// DeletePrefix refuses prefixes which would delete ACL rules or schemas, as
+// well as those outside the allowed prefixes.
+func (a aclStore) DeletePrefix(prefix string) (int, error) {
+	return a.DeletePrefixCtx(context.Background(), prefix)
+}
+
+func (a aclStore) DeletePrefixCtx(ctx context.Context, prefix string) (int, error) {
+	if !a.covers(prefix) || overlaps(prefix, aclKeyPrefix) || overlaps(prefix, schemaKeyPrefix) {
+		return 0, errForbidden
+	}
+	return a.Store.DeletePrefixCtx(ctx, prefix)
+}
+
+func (a aclStore) DeleteCtx(ctx context.Context, key string) error {
+	if err := a.check(key); err != nil {
+		return err
+	}
+	return a.Store.DeleteCtx(ctx, key)
+}
+
+// Watch relays changes to allowed keys, until the returned function is
+// called. Since watching cannot fail, changes to other keys are dropped,
+// rather than the watch refused.
+func (a aclStore) Watch(prefix string) (<-chan store.Event, func()) {
+	events, cancel := a.Store.Watch(prefix)
+	out := make(chan store.Event)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case e := <-events:
+				if e.Key != "" && !a.allowed(e.Key) {
+					continue
+				}
+				select {
+				case out <- e:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+}
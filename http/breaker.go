@@ -0,0 +1,120 @@
+package httpd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/otoolep/hraftd/store"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errBreakerOpen is returned, without calling the store, while the circuit
+// breaker is open.
+var errBreakerOpen = errors.New("store unavailable, circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker. It opens after threshold consecutive
+// failures, failing calls fast for cooldown. It then half-opens, letting a
+// single call through to probe whether to close again or stay open.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	gauge     prometheus.Gauge
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow returns whether a call may be made now. If it may, its result must
+// be passed to record.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record records the result of a call allowed by allow. A call abandoned by
+// its client says nothing of the store's health, so is not counted, and
+// writes refused because the key changed, the value is too large or not an
+// integer to increment, the cluster is in maintenance mode or the token may
+// not write the key are successes, however the error is wrapped.
+func (b *breaker) record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.state == breakerHalfOpen
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+	case err == nil, errors.Is(err, store.ErrVersionMismatch), errors.Is(err, store.ErrValueTooLarge),
+		errors.Is(err, store.ErrMaintenance), errors.Is(err, errForbidden), errors.Is(err, store.ErrNotInteger):
+		b.failures = 0
+		b.setState(breakerClosed)
+	case probe:
+		b.openedAt = now
+		b.setState(breakerOpen)
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openedAt = now
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// setState moves the breaker to state. b.mu must be held.
+func (b *breaker) setState(state breakerState) {
+	b.state = state
+	b.gauge.Set(float64(state))
+}
+
+// storeWrite calls fn, which writes to the store, through the circuit
+// breaker, if it is enabled.
+func (s *Service) storeWrite(fn func() error) error {
+	s.breakerOnce.Do(func() {
+		if s.BreakerThreshold > 0 {
+			s.breaker = &breaker{
+				threshold: s.BreakerThreshold,
+				cooldown:  s.BreakerCooldown,
+				gauge:     s.httpMetrics().Breaker,
+			}
+			s.breaker.setState(breakerClosed)
+		}
+	})
+	if s.breaker == nil {
+		return fn()
+	}
+
+	if !s.breaker.allow(time.Now()) {
+		return errBreakerOpen
+	}
+	err := fn()
+	s.breaker.record(err, time.Now())
+	return err
+}
@@ -0,0 +1,74 @@
+package httpd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/otoolep/hraftd/store"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_BreakerHalfOpen(t *testing.T) {
+	b := &breaker{
+		threshold: 2,
+		cooldown:  time.Second,
+		gauge:     prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_breaker"}),
+	}
+	now := time.Now()
+	fail := fmt.Errorf("failed")
+
+	// Abandoned calls are not failures.
+	b.allow(now)
+	b.record(context.Canceled, now)
+	b.allow(now)
+	b.record(fail, now)
+	if b.state != breakerClosed {
+		t.Fatalf("breaker opened before threshold")
+	}
+	b.allow(now)
+	b.record(fail, now)
+	if b.allow(now) {
+		t.Fatalf("call allowed while breaker open")
+	}
+
+	// Only one probe is let through, and its failure reopens the breaker.
+	now = now.Add(time.Second)
+	if !b.allow(now) {
+		t.Fatalf("probe not allowed after cooldown")
+	}
+	if b.allow(now) {
+		t.Fatalf("second probe allowed while half-open")
+	}
+	b.record(fail, now)
+	if b.state != breakerOpen || b.allow(now) {
+		t.Fatalf("breaker not reopened by failed probe")
+	}
+}
+
+func Test_BreakerWrappedClientErrors(t *testing.T) {
+	b := &breaker{
+		threshold: 1,
+		cooldown:  time.Second,
+		gauge:     prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_breaker"}),
+	}
+	now := time.Now()
+
+	// Writes refused for the request's own sake are not failures, even when
+	// the error is wrapped.
+	for _, err := range []error{
+		fmt.Errorf("set: %w", store.ErrVersionMismatch),
+		fmt.Errorf("set: %w", store.ErrValueTooLarge),
+		fmt.Errorf("set: %w", store.ErrMaintenance),
+		fmt.Errorf("set: %w", store.ErrNotInteger),
+		fmt.Errorf("set: %w", errForbidden),
+		fmt.Errorf("set: %w", context.Canceled),
+	} {
+		b.allow(now)
+		b.record(err, now)
+		if b.state != breakerClosed {
+			t.Fatalf("breaker opened by %v", err)
+		}
+	}
+}
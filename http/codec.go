@@ -0,0 +1,90 @@
+package httpd
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	msgpack "github.com/hashicorp/go-msgpack/codec"
+)
+
+// A codec encodes and decodes key-value payloads in one media type.
+type codec interface {
+	// ContentType returns the media type of encoded payloads.
+	ContentType() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error { return json.Unmarshal(b, v) }
+
+// msgpackHandle encodes strings as the msgpack str type, rather than the raw
+// type of the older spec, so that current msgpack libraries decode them as
+// strings.
+var msgpackHandle = &msgpack.MsgpackHandle{WriteExt: true, RawToString: true}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var b []byte
+	err := msgpack.NewEncoderBytes(&b, msgpackHandle).Encode(v)
+	return b, err
+}
+
+func (msgpackCodec) Unmarshal(b []byte, v interface{}) error {
+	return msgpack.NewDecoderBytes(b, msgpackHandle).Decode(v)
+}
+
+// codecs are the supported codecs, by media type.
+var codecs = map[string]codec{
+	"application/json":      jsonCodec{},
+	"application/msgpack":   msgpackCodec{},
+	"application/x-msgpack": msgpackCodec{},
+}
+
+// requestCodec returns the codec of r's body, as given by its Content-Type.
+// JSON is assumed if the type is missing or unknown.
+func requestCodec(r *http.Request) codec {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if c, ok := codecs[t]; ok && err == nil {
+		return c
+	}
+	return jsonCodec{}
+}
+
+// responseCodec returns the codec the client making r would like responses
+// in, which is the first supported type in its Accept header. Quality values
+// are ignored. JSON is used if no supported type is listed.
+func responseCodec(r *http.Request) codec {
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if c, ok := codecs[t]; ok && err == nil {
+			return c
+		}
+	}
+	return jsonCodec{}
+}
+
+// writeEncoded writes v as the response, encoded by c.
+func writeEncoded(w http.ResponseWriter, status int, c codec, v interface{}) error {
+	b, err := c.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return err
+	}
+
+	w.Header().Set("Content-Type", c.ContentType())
+	w.WriteHeader(status)
+	w.Write(b)
+	return nil
+}
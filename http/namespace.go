@@ -0,0 +1,295 @@
+package httpd
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otoolep/hraftd/store"
+)
+
+const namespaceKey contextKey = iota + 1
+
+// withNamespace returns r with the namespace it addresses, if any, in its
+// context. A namespace is given either by the X-Namespace header, or by a
+// path of the form /ns/{name}/key..., /ns/{name}/keys...,
+// /ns/{name}/schema/... or /ns/{name}/txn, which is rewritten to the path it
+// stands for. The header is set in either case, so that it is passed on if r
+// is forwarded to the leader. An error response is written, and false
+// returned, if the namespace is invalid.
+func withNamespace(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	ns := r.Header.Get("X-Namespace")
+	if strings.HasPrefix(r.URL.Path, "/ns/") {
+		rest := strings.TrimPrefix(r.URL.Path, "/ns/")
+		i := strings.Index(rest, "/")
+		if i < 0 || !(strings.HasPrefix(rest[i:], "/key") || strings.HasPrefix(rest[i:], "/schema/") || rest[i:] == "/txn") {
+			writeError(w, http.StatusNotFound, "only keys, schemas and transactions may be namespaced")
+			return r, false
+		}
+		ns = rest[:i]
+		if ns == "" {
+			writeError(w, http.StatusBadRequest, "missing namespace")
+			return r, false
+		}
+		u := *r.URL
+		u.Path = rest[i:]
+		u.RawPath = ""
+		r.URL = &u
+		r.Header.Set("X-Namespace", ns)
+	}
+	if ns == "" {
+		return r, true
+	}
+	if strings.Contains(ns, "/") {
+		writeError(w, http.StatusBadRequest, "namespace must not contain '/'")
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), namespaceKey, ns)), true
+}
+
+// Namespace returns the namespace addressed by the request ctx belongs to, or
+// the empty string if there is none.
+func Namespace(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceKey).(string)
+	return ns
+}
+
+// storeFor returns the store keys named in request r are read and written
+// through, which confines them to r's namespace if it has one, and to the
+// keys its token's ACL rule allows.
+func (s *Service) storeFor(r *http.Request) Store {
+	st := s.store
+	if rule, _ := r.Context().Value(aclRuleKey).(*aclRule); rule != nil {
+		st = aclStore{Store: st, prefixes: rule.Prefixes}
+	}
+	if ns := Namespace(r.Context()); ns != "" {
+		return namespacedStore{Store: st, prefix: ns + "/"}
+	}
+	return st
+}
+
+// namespacedStore is a Store whose keys are those of the underlying store
+// starting with prefix, with prefix removed.
+type namespacedStore struct {
+	Store
+	prefix string
+}
+
+func (n namespacedStore) Get(key string) (string, error) {
+	return n.Store.Get(n.prefix + key)
+}
+
+func (n namespacedStore) Exists(key string) (bool, error) {
+	return n.Store.Exists(n.prefix + key)
+}
+
+func (n namespacedStore) GetWithLevel(key string, level store.ConsistencyLevel) (string, error) {
+	return n.Store.GetWithLevel(n.prefix+key, level)
+}
+
+func (n namespacedStore) GetCtx(ctx context.Context, key string, level store.ConsistencyLevel) (string, error) {
+	return n.Store.GetCtx(ctx, n.prefix+key, level)
+}
+
+func (n namespacedStore) GetAt(key string, index uint64) (string, error) {
+	return n.Store.GetAt(n.prefix+key, index)
+}
+
+func (n namespacedStore) GetWithVersion(ctx context.Context, key string, level store.ConsistencyLevel) (string, uint64, error) {
+	return n.Store.GetWithVersion(ctx, n.prefix+key, level)
+}
+
+func (n namespacedStore) Scan(prefix string) (map[string]string, error) {
+	m, err := n.Store.Scan(n.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[strings.TrimPrefix(k, n.prefix)] = v
+	}
+	return out, nil
+}
+
+func (n namespacedStore) ScanMeta(prefix string) ([]store.KeyMeta, error) {
+	meta, err := n.Store.ScanMeta(n.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range meta {
+		meta[i].Key = strings.TrimPrefix(meta[i].Key, n.prefix)
+	}
+	return meta, nil
+}
+
+func (n namespacedStore) GetMulti(keys []string) (map[string]*string, error) {
+	prefixed := make([]string, len(keys))
+	for i, k := range keys {
+		prefixed[i] = n.prefix + k
+	}
+	m, err := n.Store.GetMulti(prefixed)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*string, len(m))
+	for k, v := range m {
+		out[strings.TrimPrefix(k, n.prefix)] = v
+	}
+	return out, nil
+}
+
+func (n namespacedStore) ScanPage(prefix, after string, limit int) ([]string, string, error) {
+	if after != "" {
+		after = n.prefix + after
+	}
+	keys, next, err := n.Store.ScanPage(n.prefix+prefix, after, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, n.prefix)
+	}
+	return keys, strings.TrimPrefix(next, n.prefix), nil
+}
+
+func (n namespacedStore) Set(key, value string) error {
+	return n.Store.Set(n.prefix+key, value)
+}
+
+func (n namespacedStore) SetCtx(ctx context.Context, key, value string) error {
+	return n.Store.SetCtx(ctx, n.prefix+key, value)
+}
+
+func (n namespacedStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	return n.Store.SetWithTTL(n.prefix+key, value, ttl)
+}
+
+func (n namespacedStore) SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error {
+	return n.Store.SetWithTTLCtx(ctx, n.prefix+key, value, ttl)
+}
+
+func (n namespacedStore) SetIfVersion(ctx context.Context, key, value string, version uint64) error {
+	return n.Store.SetIfVersion(ctx, n.prefix+key, value, version)
+}
+
+func (n namespacedStore) DeleteIfVersion(ctx context.Context, key string, version uint64) error {
+	return n.Store.DeleteIfVersion(ctx, n.prefix+key, version)
+}
+
+func (n namespacedStore) SetMulti(kv map[string]string) error {
+	return n.SetMultiCtx(context.Background(), kv)
+}
+
+func (n namespacedStore) SetMultiCtx(ctx context.Context, kv map[string]string) error {
+	prefixed := make(map[string]string, len(kv))
+	for k, v := range kv {
+		prefixed[n.prefix+k] = v
+	}
+	return n.Store.SetMultiCtx(ctx, prefixed)
+}
+
+func (n namespacedStore) Txn(ctx context.Context, txn store.Txn) (bool, error) {
+	prefixed := store.Txn{
+		Compares: make([]store.Compare, len(txn.Compares)),
+		Success:  make([]store.TxnOp, len(txn.Success)),
+		Failure:  make([]store.TxnOp, len(txn.Failure)),
+	}
+	for i, c := range txn.Compares {
+		c.Key = n.prefix + c.Key
+		prefixed.Compares[i] = c
+	}
+	for i, op := range txn.Success {
+		op.Key = n.prefix + op.Key
+		prefixed.Success[i] = op
+	}
+	for i, op := range txn.Failure {
+		op.Key = n.prefix + op.Key
+		prefixed.Failure[i] = op
+	}
+	return n.Store.Txn(ctx, prefixed)
+}
+
+func (n namespacedStore) CompareAndSwap(key, old, new string) (bool, error) {
+	return n.Store.CompareAndSwap(n.prefix+key, old, new)
+}
+
+func (n namespacedStore) CompareAndSwapCtx(ctx context.Context, key, old, new string) (bool, error) {
+	return n.Store.CompareAndSwapCtx(ctx, n.prefix+key, old, new)
+}
+
+func (n namespacedStore) Increment(key string, delta int64) (int64, error) {
+	return n.Store.Increment(n.prefix+key, delta)
+}
+
+func (n namespacedStore) IncrementCtx(ctx context.Context, key string, delta int64) (int64, error) {
+	return n.Store.IncrementCtx(ctx, n.prefix+key, delta)
+}
+
+func (n namespacedStore) Append(key, chunk string) error {
+	return n.Store.Append(n.prefix+key, chunk)
+}
+
+func (n namespacedStore) AppendCtx(ctx context.Context, key, chunk string) error {
+	return n.Store.AppendCtx(ctx, n.prefix+key, chunk)
+}
+
+func (n namespacedStore) Delete(key string) error {
+	return n.Store.Delete(n.prefix + key)
+}
+
+func (n namespacedStore) DeleteMulti(keys []string) (int, error) {
+	return n.DeleteMultiCtx(context.Background(), keys)
+}
+
+func (n namespacedStore) DeleteMultiCtx(ctx context.Context, keys []string) (int, error) {
+	prefixed := make([]string, len(keys))
+	for i, k := range keys {
+		prefixed[i] = n.prefix + k
+	}
+	return n.Store.DeleteMultiCtx(ctx, prefixed)
+}
+
+func (n namespacedStore) DeletePrefix(prefix string) (int, error) {
+	return n.Store.DeletePrefix(n.prefix + prefix)
+}
+
+func (n namespacedStore) DeletePrefixCtx(ctx context.Context, prefix string) (int, error) {
+	return n.Store.DeletePrefixCtx(ctx, n.prefix+prefix)
+}
+
+func (n namespacedStore) DeleteCtx(ctx context.Context, key string) error {
+	return n.Store.DeleteCtx(ctx, n.prefix+key)
+}
+
+// Watch relays changes to keys in the namespace, with prefix removed from
+// their keys, until the returned function is called.
+func (n namespacedStore) Watch(prefix string) (<-chan store.Event, func()) {
+	events, cancel := n.Store.Watch(n.prefix + prefix)
+	out := make(chan store.Event)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case e := <-events:
+				e.Key = strings.TrimPrefix(e.Key, n.prefix)
+				select {
+				case out <- e:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+}
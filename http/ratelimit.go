@@ -0,0 +1,126 @@
+package httpd
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often buckets of idle clients are discarded.
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter is a token bucket per client. Each client may make burst
+// requests at once, after which its bucket refills at rate requests a second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from client's bucket, if there is one. If not, it
+// returns how long until there will be.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep discards the buckets of clients which would have refilled, as they
+// are no different to new ones. l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for c, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, c)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimiters returns the limiters of reads and writes, either of which is
+// nil if unlimited. They are created on first use, so that limits may be set
+// after New.
+func (s *Service) rateLimiters() (reads, writes *rateLimiter) {
+	s.limitersOnce.Do(func() {
+		if s.ReadRateLimit > 0 {
+			s.readLimiter = newRateLimiter(s.ReadRateLimit, s.ReadBurst)
+		}
+		if s.WriteRateLimit > 0 {
+			s.writeLimiter = newRateLimiter(s.WriteRateLimit, s.WriteBurst)
+		}
+	})
+	return s.readLimiter, s.writeLimiter
+}
+
+// rateLimited returns whether r's client has exceeded its rate limit, in
+// which case a 429 has been written.
+func (s *Service) rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	reads, writes := s.rateLimiters()
+	l := writes
+	if r.Method == "GET" || r.Method == "HEAD" {
+		l = reads
+	}
+	if l == nil {
+		return false
+	}
+
+	ok, wait := l.allow(s.clientID(r), time.Now())
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+	return true
+}
+
+// clientID returns the identity of r's client for rate limiting, which is
+// the RateLimitHeader, if configured and present, or the client's IP.
+func (s *Service) clientID(r *http.Request) string {
+	if s.RateLimitHeader != "" {
+		if id := r.Header.Get(s.RateLimitHeader); id != "" {
+			return id
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,30 @@
+package httpd
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_RateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(2, 2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("c1", now); !ok {
+			t.Fatalf("request %d within burst refused", i)
+		}
+	}
+	ok, wait := l.allow("c1", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("wrong result for request over burst: %t, %s", ok, wait)
+	}
+
+	if ok, _ := l.allow("c1", now.Add(500*time.Millisecond)); !ok {
+		t.Fatalf("request refused after refill")
+	}
+
+	// Idle clients are forgotten.
+	l.allow("c1", now.Add(rateLimitSweepInterval+time.Second))
+	if len(l.buckets) != 1 {
+		t.Fatalf("wrong number of buckets after sweep: %d", len(l.buckets))
+	}
+}
@@ -0,0 +1,323 @@
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/otoolep/hraftd/store"
+)
+
+// schemaKeyPrefix is the prefix of the keys under which schemas are stored,
+// so that they are replicated like any other key. A schema for keys starting
+// with p is stored as schemaKeyPrefix + p.
+const schemaKeyPrefix = "_schemas/"
+
+// schema is a JSON Schema. Only the commonly used validation keywords are
+// supported; others, such as $schema and title, are ignored.
+type schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// parseSchema parses and checks the JSON Schema b.
+func parseSchema(b []byte) (*schema, error) {
+	var sc schema
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	if err := sc.compile(); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	return &sc, nil
+}
+
+// compile checks sc and its subschemas, and compiles their patterns.
+func (sc *schema) compile() error {
+	switch sc.Type {
+	case "", "object", "array", "string", "number", "integer", "boolean", "null":
+	default:
+		return fmt.Errorf("unknown type %q", sc.Type)
+	}
+	if sc.Pattern != "" {
+		re, err := regexp.Compile(sc.Pattern)
+		if err != nil {
+			return err
+		}
+		sc.pattern = re
+	}
+	for _, p := range sc.Properties {
+		if p == nil {
+			continue
+		}
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	if sc.Items != nil {
+		return sc.Items.compile()
+	}
+	return nil
+}
+
+// validate returns the ways in which v, decoded from JSON, does not match sc.
+// Each is described relative to path, the location of v in the document.
+func (sc *schema) validate(v interface{}, path string) []string {
+	if sc == nil {
+		return nil
+	}
+	var errs []string
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, a...))
+	}
+
+	if sc.Type != "" && !hasType(v, sc.Type) {
+		fail("must be of type %s", sc.Type)
+		return errs
+	}
+	if len(sc.Enum) > 0 {
+		found := false
+		for _, e := range sc.Enum {
+			if reflect.DeepEqual(v, e) {
+				found = true
+			}
+		}
+		if !found {
+			fail("must be one of the enumerated values")
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range sc.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, ok := sc.Properties[name]
+			if !ok && sc.AdditionalProperties != nil && !*sc.AdditionalProperties {
+				fail("unexpected property %q", name)
+				continue
+			}
+			errs = append(errs, p.validate(v[name], path+"."+name)...)
+		}
+	case []interface{}:
+		if sc.MinItems != nil && len(v) < *sc.MinItems {
+			fail("must have at least %d items", *sc.MinItems)
+		}
+		if sc.MaxItems != nil && len(v) > *sc.MaxItems {
+			fail("must have at most %d items", *sc.MaxItems)
+		}
+		for i, item := range v {
+			errs = append(errs, sc.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case string:
+		n := len([]rune(v))
+		if sc.MinLength != nil && n < *sc.MinLength {
+			fail("must be at least %d characters long", *sc.MinLength)
+		}
+		if sc.MaxLength != nil && n > *sc.MaxLength {
+			fail("must be at most %d characters long", *sc.MaxLength)
+		}
+		if sc.pattern != nil && !sc.pattern.MatchString(v) {
+			fail("must match pattern %q", sc.Pattern)
+		}
+	case float64:
+		if sc.Minimum != nil && v < *sc.Minimum {
+			fail("must be at least %v", *sc.Minimum)
+		}
+		if sc.Maximum != nil && v > *sc.Maximum {
+			fail("must be at most %v", *sc.Maximum)
+		}
+	}
+	return errs
+}
+
+// hasType returns whether v, decoded from JSON, is of the JSON Schema type t.
+func hasType(v interface{}, t string) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return t == "object"
+	case []interface{}:
+		return t == "array"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || (t == "integer" && v == math.Trunc(v))
+	case bool:
+		return t == "boolean"
+	case nil:
+		return t == "null"
+	}
+	return false
+}
+
+// namespacedKey returns the key of the underlying store which key, named in
+// request r, stands for.
+func namespacedKey(r *http.Request, key string) string {
+	if ns := Namespace(r.Context()); ns != "" {
+		return ns + "/" + key
+	}
+	return key
+}
+
+// schemaFor returns the schema registered for the longest prefix of key, a
+// key of the underlying store, or nil if there is none.
+func (s *Service) schemaFor(key string) (*schema, error) {
+	schemas, err := s.store.Scan(schemaKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	best := ""
+	for k := range schemas {
+		p := strings.TrimPrefix(k, schemaKeyPrefix)
+		if strings.HasPrefix(key, p) && len(k) > len(best) {
+			best = k
+		}
+	}
+	if best == "" {
+		return nil, nil
+	}
+	return parseSchema([]byte(schemas[best]))
+}
+
+// checkSchemas checks the values kv, to be set in request r, against the
+// schemas registered for their keys. If any does not match, a 422 response
+// listing the reasons is written, and false returned.
+func (s *Service) checkSchemas(w http.ResponseWriter, r *http.Request, kv map[string]string) bool {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	errs := []string{}
+	for _, k := range keys {
+		sc, err := s.schemaFor(namespacedKey(r, k))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return false
+		}
+		if sc == nil {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(kv[k]), &v); err != nil {
+			errs = append(errs, k+": value is not valid JSON")
+			continue
+		}
+		for _, e := range sc.validate(v, "$") {
+			errs = append(errs, k+": "+e)
+		}
+	}
+	if len(errs) == 0 {
+		return true
+	}
+
+	writeJSON(w, http.StatusUnprocessableEntity, struct {
+		Error  string   `json:"error"`
+		Code   int      `json:"code"`
+		Errors []string `json:"errors"`
+	}{"value does not match schema", http.StatusUnprocessableEntity, errs})
+	return false
+}
+
+// handleSchema registers, returns or removes the JSON Schema which values of
+// keys starting with the prefix named in the path must match.
+func (s *Service) handleSchema(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/schema/")
+	if prefix == "" {
+		writeError(w, http.StatusBadRequest, "missing prefix")
+		return
+	}
+	key := schemaKeyPrefix + namespacedKey(r, prefix)
+
+	switch r.Method {
+	case "GET":
+		v, err := s.store.Get(key)
+		if err == store.ErrKeyNotFound {
+			writeError(w, http.StatusNotFound, "schema not found")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write([]byte(v))
+
+	case "PUT":
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxBodySize))
+		if bodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if _, err := parseSchema(b); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if dryRun(r) {
+			writeJSON(w, http.StatusOK, dryRunSummary{Set: []string{schemaKeyPrefix + prefix}, Delete: []string{}})
+			return
+		}
+		if err := s.storeWrite(func() error {
+			return s.store.SetCtx(r.Context(), key, string(b))
+		}); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		s.setIndexHeader(w)
+
+	case "DELETE":
+		if dryRun(r) {
+			ok, err := s.store.Exists(key)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			summary := dryRunSummary{Set: []string{}, Delete: []string{}}
+			if ok {
+				summary.Delete = append(summary.Delete, schemaKeyPrefix+prefix)
+			}
+			writeJSON(w, http.StatusOK, summary)
+			return
+		}
+		if err := s.storeWrite(func() error {
+			return s.store.DeleteCtx(r.Context(), key)
+		}); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		s.setIndexHeader(w)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -3,233 +3,3236 @@
 package httpd
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/otoolep/hraftd/logging"
 	"github.com/otoolep/hraftd/metrics"
+	"github.com/otoolep/hraftd/store"
+	"github.com/otoolep/hraftd/version"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/websocket"
 )
 
+// defaultMetrics are used by services without Metrics of their own. They are
+// only registered once first used, so that a caller may register metrics with
+// other objectives under the same names instead.
 var (
-	httpRequestsSummary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
-		Name:       "http_requests",
-		Help:       "HTTP requests to the hraftd service",
-		Objectives: metrics.Quantiles,
-	}, []string{"endpoint", "method"})
-	httpErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "http_request_errors",
-		Help: "Failed HTTP requests to the hraftd service",
-	}, []string{"endpoint", "method", "status"})
+	defaultMetrics     *metrics.HTTP
+	defaultMetricsOnce sync.Once
 )
 
-func init() {
-	prometheus.MustRegister(httpRequestsSummary)
-	prometheus.MustRegister(httpErrorsCounter)
-}
+// errNilStore is returned when starting a service created without a store.
+var errNilStore = errors.New("service has no store")
 
 // Store is the interface Raft-backed key-value stores must implement.
 type Store interface {
-	// Get returns the value for the given key.
+	// Get returns the value for the given key, or store.ErrKeyNotFound if
+	// the key is not present.
 	Get(key string) (string, error)
 
+	// Exists returns whether the given key is present.
+	Exists(key string) (bool, error)
+
+	// GetWithLevel returns the value for the given key, read at the given
+	// consistency level. store.ErrNotLeader is returned if the level
+	// requires the leader, and this node is not the leader.
+	GetWithLevel(key string, level store.ConsistencyLevel) (string, error)
+
+	// GetWithVersion is like GetCtx, but also returns the version of the
+	// key, which changes with every write to it.
+	GetWithVersion(ctx context.Context, key string, level store.ConsistencyLevel) (string, uint64, error)
+
+	// GetAt returns the value the given key had once the log entry at index
+	// was applied. store.ErrKeyNotFound is returned if the key was not
+	// present then, and store.ErrHistoryPruned if that is no longer known.
+	GetAt(key string, index uint64) (string, error)
+
+	// GetCtx is like GetWithLevel, but gives up once ctx is done, returning
+	// ctx.Err().
+	GetCtx(ctx context.Context, key string, level store.ConsistencyLevel) (string, error)
+
+	// Scan returns all key-value pairs whose key starts with prefix. Results
+	// are only linearizable if read from the leader.
+	Scan(prefix string) (map[string]string, error)
+
+	// ScanMeta returns, sorted by key, a description of every key which
+	// starts with prefix, without its value.
+	ScanMeta(prefix string) ([]store.KeyMeta, error)
+
+	// GetMulti returns the values of keys, read together, with a nil value
+	// for each key which is not present.
+	GetMulti(keys []string) (map[string]*string, error)
+
+	// ScanPage returns, in sorted order, up to limit keys which start with
+	// prefix and sort after the cursor after, and the cursor for the next
+	// page, which is empty if there are no more keys.
+	ScanPage(prefix, after string, limit int) (keys []string, next string, err error)
+
 	// Set sets the value for the given key, via distributed consensus.
 	Set(key, value string) error
 
+	// SetCtx is like Set, but stops waiting for consensus once ctx is done,
+	// returning ctx.Err().
+	SetCtx(ctx context.Context, key, value string) error
+
+	// SetWithTTL sets the value for the given key, via distributed consensus,
+	// and schedules the key for deletion once ttl has elapsed.
+	SetWithTTL(key, value string, ttl time.Duration) error
+
+	// SetWithTTLCtx is like SetWithTTL, but stops waiting for consensus once
+	// ctx is done, returning ctx.Err().
+	SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error
+
+	// SetIfVersion sets the value for the given key, via distributed
+	// consensus, if the key is at the given version, with 0 requiring it to
+	// be absent. store.ErrVersionMismatch is returned otherwise.
+	SetIfVersion(ctx context.Context, key, value string, version uint64) error
+
+	// DeleteIfVersion removes the given key, via distributed consensus, if
+	// it is at the given version. store.ErrVersionMismatch is returned
+	// otherwise.
+	DeleteIfVersion(ctx context.Context, key string, version uint64) error
+
+	// SetMulti sets all the given key-value pairs atomically, via a single
+	// distributed consensus operation.
+	SetMulti(kv map[string]string) error
+
+	// SetMultiCtx is like SetMulti, but stops waiting for consensus once ctx
+	// is done, returning ctx.Err().
+	SetMultiCtx(ctx context.Context, kv map[string]string) error
+
+	// CompareAndSwap sets key to new only if its current value equals old,
+	// via distributed consensus. It returns whether the swap took place.
+	CompareAndSwap(key, old, new string) (bool, error)
+
+	// CompareAndSwapCtx is like CompareAndSwap, but stops waiting for
+	// consensus once ctx is done, returning ctx.Err().
+	CompareAndSwapCtx(ctx context.Context, key, old, new string) (bool, error)
+
+	// Increment atomically adds delta to the integer value at key, via
+	// distributed consensus, and returns the new value. store.ErrNotInteger
+	// is returned if the existing value is not an integer.
+	Increment(key string, delta int64) (int64, error)
+
+	// IncrementCtx is like Increment, but stops waiting for consensus once
+	// ctx is done, returning ctx.Err().
+	IncrementCtx(ctx context.Context, key string, delta int64) (int64, error)
+
+	// Txn applies txn atomically, via a single distributed consensus
+	// operation, returning whether its comparisons held. store.ErrInvalidTxn
+	// is returned if txn contains an unknown op.
+	Txn(ctx context.Context, txn store.Txn) (bool, error)
+
+	// Append adds chunk to the end of the value at key, via distributed
+	// consensus. store.ErrValueTooLarge is returned if the value would grow
+	// past the store's limit.
+	Append(key, chunk string) error
+
+	// AppendCtx is like Append, but stops waiting for consensus once ctx is
+	// done, returning ctx.Err().
+	AppendCtx(ctx context.Context, key, chunk string) error
+
 	// Delete removes the given key, via distributed consensus.
 	Delete(key string) error
 
+	// DeleteMulti removes all the given keys, via a single distributed
+	// consensus operation, and returns how many were present.
+	DeleteMulti(keys []string) (int, error)
+
+	// DeleteMultiCtx is like DeleteMulti, but stops waiting for consensus
+	// once ctx is done, returning ctx.Err().
+	DeleteMultiCtx(ctx context.Context, keys []string) (int, error)
+
+	// DeletePrefix removes every key starting with prefix, via a single
+	// distributed consensus operation, and returns how many were removed.
+	DeletePrefix(prefix string) (int, error)
+
+	// DeletePrefixCtx is like DeletePrefix, but stops waiting for consensus
+	// once ctx is done, returning ctx.Err().
+	DeletePrefixCtx(ctx context.Context, prefix string) (int, error)
+
+	// Flush removes every key, via a single distributed consensus operation,
+	// and returns how many were removed.
+	Flush() (int, error)
+
+	// DeleteCtx is like Delete, but stops waiting for consensus once ctx is
+	// done, returning ctx.Err().
+	DeleteCtx(ctx context.Context, key string) error
+
 	// Join joins the node, identitifed by nodeID and reachable at addr, to the cluster.
-	Join(nodeID string, addr string) error
+	// httpAddr, if set, is recorded as the node's HTTP API address. Unless
+	// voter is set, the node joins as a non-voter, which does not count
+	// towards quorum.
+	Join(nodeID string, addr string, httpAddr string, voter bool) error
 
 	// Status returns the store raft status.
 	Status() string
+
+	// Snapshot snapshots this node's store, so that less of the Raft log
+	// must be replayed on restart.
+	Snapshot() error
+
+	// Watch returns a channel receiving changes to keys starting with
+	// prefix, and a function to call once no longer watching.
+	Watch(prefix string) (<-chan store.Event, func())
+
+	// Backup writes every key in the store to w, as newline-delimited JSON.
+	Backup(w io.Writer) error
+
+	// Restore sets every key read from r, as written by Backup, via
+	// distributed consensus. store.ErrNotEmpty is returned if the store has
+	// keys, unless force is set.
+	Restore(r io.Reader, force bool) error
+
+	// Remove removes the node identified by nodeID from the cluster.
+	// store.ErrNodeNotFound is returned if the node is not a member.
+	Remove(nodeID string) error
+
+	// Promote makes the node identified by nodeID, a non-voter, a voter.
+	// store.ErrNotNonvoter is returned if it is not a non-voter, and
+	// store.ErrNotLeader if this node is not the leader.
+	Promote(nodeID string) error
+
+	// NodeHTTPAddr returns the HTTP API address of the node identified by
+	// nodeID, or the empty string if it is not known.
+	NodeHTTPAddr(nodeID string) string
+
+	// TransferLeadership hands leadership to the node identified by target,
+	// or, if target is empty, to any other node. store.ErrNotLeader is
+	// returned if this node is not the leader, and store.ErrNodeNotFound if
+	// target is not a member.
+	TransferLeadership(target string) error
+
+	// Barrier waits, for at most timeout, until every change committed
+	// before it was called has been applied to this node's store.
+	// store.ErrNotLeader is returned if this node is not the leader, and
+	// store.ErrApplyTimeout if the barrier is not complete in time.
+	Barrier(timeout time.Duration) error
+
+	// SetMaintenance turns maintenance mode, in which keys may be read but
+	// not changed, on or off across the cluster. store.ErrNotLeader is
+	// returned if this node is not the leader.
+	SetMaintenance(enabled bool) error
+
+	// Maintenance returns whether the cluster is in maintenance mode.
+	Maintenance() bool
+
+	// Bootstrap makes this node a single-node cluster. store.ErrBootstrapped
+	// is returned if it already has Raft state.
+	Bootstrap() error
+
+	// Replication returns how far each follower is behind the leader.
+	// store.ErrNotLeader is returned if this node is not the leader.
+	Replication() ([]store.FollowerReplication, error)
+
+	// Servers returns the members of the cluster.
+	Servers() ([]store.ServerInfo, error)
+
+	// IsLeader returns whether this node is the leader.
+	IsLeader() bool
+
+	// LeaderHTTPAddr returns the HTTP API address of the current leader, or
+	// the empty string if it is not known.
+	LeaderHTTPAddr() (string, error)
+
+	// LeaderAddr returns the Raft address of the current leader, or the empty
+	// string if there is no known leader.
+	LeaderAddr() (string, error)
+
+	// AppliedIndex returns the index of the last Raft log entry applied to
+	// this node's store.
+	AppliedIndex() uint64
+
+	// RaftConfig returns the Raft tuning in effect on this node.
+	RaftConfig() store.RaftConfigView
+
+	// ReloadRaftConfig changes the Raft tuning of this node, without
+	// restarting it. store.ErrInvalidRaftConfig is returned if any value is
+	// out of range.
+	ReloadRaftConfig(cfg store.RaftReloadable) error
+
+	// Ready returns whether the store has caught up with the cluster, and so
+	// is fit to serve reads.
+	Ready() bool
 }
 
+const (
+	// DefaultBarrierTimeout is the default time a barrier may take to
+	// complete.
+	DefaultBarrierTimeout = 10 * time.Second
+
+	// DefaultDrainTimeout is the default time Close waits for in-flight requests.
+	DefaultDrainTimeout = 10 * time.Second
+
+	// DefaultReadHeaderTimeout is the default time allowed to read request headers.
+	DefaultReadHeaderTimeout = 5 * time.Second
+
+	// DefaultReadTimeout is the default time allowed to read a whole request.
+	DefaultReadTimeout = 10 * time.Second
+
+	// DefaultWriteTimeout is the default time allowed to serve a request once
+	// its headers are read. It exceeds the time allowed to forward a request
+	// to the leader, so that forwarded requests can complete.
+	DefaultWriteTimeout = 20 * time.Second
+
+	// DefaultIdleTimeout is the default time an idle keep-alive connection is
+	// kept open.
+	DefaultIdleTimeout = 60 * time.Second
+
+	// DefaultIndexWaitTimeout is the default time a read waits for the store
+	// to apply the log index the client asked for.
+	DefaultIndexWaitTimeout = 5 * time.Second
+
+	// DefaultLongPollTimeout is the default time a long-polling read waits
+	// for the key to change.
+	DefaultLongPollTimeout = 15 * time.Second
+
+	// DefaultMaxBodySize is the default limit, in bytes, on request bodies.
+	DefaultMaxBodySize = 1 << 20
+
+	// DefaultPageSize is the number of keys listed per page, if paging
+	// through keys without giving a limit.
+	DefaultPageSize = 1000
+
+	// DefaultPromoteMaxLag is the default number of log entries a non-voter
+	// may be behind the leader and still be promoted.
+	DefaultPromoteMaxLag = 1000
+
+	// DefaultBreakerThreshold is the default number of consecutive failed
+	// writes which open the circuit breaker.
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerCooldown is the default time the circuit breaker stays
+	// open before probing the store.
+	DefaultBreakerCooldown = 5 * time.Second
+
+	// DefaultMaxConcurrentWrites is the default limit on the number of
+	// writes applied at once.
+	DefaultMaxConcurrentWrites = 256
+
+	// DefaultMaxGetKeys is the default limit on the number of keys read by
+	// one multi-key read.
+	DefaultMaxGetKeys = 1000
+
+	// DefaultMaxDeleteKeys is the default limit on the number of keys
+	// deleted by one multi-key delete.
+	DefaultMaxDeleteKeys = 1000
+
+	// DefaultMaxKeyLength is the default limit, in bytes, on key names.
+	DefaultMaxKeyLength = 256
+
+	forwardTimeout = 15 * time.Second
+	unixPrefix     = "unix://"
+
+	indexPollInterval = 10 * time.Millisecond
+)
+
 // Service provides HTTP service.
 type Service struct {
-	addr string
-	ln   net.Listener
+	addr    string
+	ln      net.Listener
+	plainLn net.Listener
+	server  *http.Server
+	mux     *http.ServeMux
+
+	store   Store
+	logger  logging.Logger
+	client  *http.Client  // Used to forward writes to the leader.
+	closing chan struct{} // Closed by Close, to end long-lived requests.
+	errs    chan error    // Errors which stopped a listener from serving.
+
+	closeOnce sync.Once
+	closeErr  error
+
+	signals chan os.Signal // Receives the signals handled if HandleSignals.
+	done    chan struct{}  // Closed once shut down on a signal.
+
+	readLimiter  *rateLimiter
+	writeLimiter *rateLimiter
+	limitersOnce sync.Once
+
+	breaker     *breaker
+	breakerOnce sync.Once
+
+	writes     *writeSemaphore
+	writesOnce sync.Once
+
+	ownMetrics     *metrics.HTTP // Registered with Registerer.
+	ownMetricsOnce sync.Once
+
+	// DrainTimeout is how long Close waits for in-flight requests to
+	// complete before forcibly closing their connections.
+	DrainTimeout time.Duration
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout are set
+	// on the underlying http.Server, so that slow clients cannot hold
+	// connections open indefinitely. Zero means no timeout.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// LongPollTimeout is how long a read with wait=true waits for the key to
+	// change, before answering with a 304. Clients may ask to wait less. It
+	// should be less than WriteTimeout, so that the 304 can be written.
+	LongPollTimeout time.Duration
+
+	// IndexWaitTimeout is how long a read carrying an X-Min-Raft-Index header
+	// waits for the store to apply that index, before failing with a 503.
+	IndexWaitTimeout time.Duration
+
+	// MaxBodySize is the largest request body, in bytes, accepted by writes
+	// and joins. Larger requests are rejected with a 413.
+	MaxBodySize int64
+
+	// PromoteMaxLag is how many log entries a non-voter may be behind the
+	// leader and still be promoted. Promoting a node which is further behind
+	// is refused with a 503, since the node would count towards quorum
+	// before it could usefully vote.
+	PromoteMaxLag uint64
+
+	// MaxGetKeys is the largest number of keys a multi-key read may ask for.
+	// Larger requests are rejected with a 400.
+	MaxGetKeys int
+
+	// MaxDeleteKeys is the largest number of keys a multi-key delete may
+	// list. Larger requests are rejected with a 400.
+	MaxDeleteKeys int
+
+	// MaxKeyLength, if positive, is the longest key name, in bytes, which
+	// may be read or written. KeyPattern, if set, must match every key. Keys
+	// breaking either rule, or containing control characters, are rejected
+	// with a 400.
+	MaxKeyLength int
+	KeyPattern   *regexp.Regexp
+
+	// RedirectWrites makes a follower answer writes with a redirect to the
+	// leader, rather than forwarding them to the leader itself.
+	RedirectWrites bool
+
+	// TLSConfig, if set, makes the service serve HTTPS. CertFile and KeyFile
+	// may be set instead, or as well, to load the certificate from disk.
+	TLSConfig *tls.Config
+	CertFile  string
+	KeyFile   string
+
+	// ClientCAs, if set, makes the HTTPS listener require client certificates
+	// signed by one of these CAs, and restricts changes to cluster membership
+	// to clients which presented such a certificate.
+	ClientCAs *x509.CertPool
+
+	// PlainAddr, if set, is an additional plain HTTP address to listen on, for
+	// clients without a certificate. Cluster membership cannot be changed via
+	// this listener when ClientCAs is set.
+	PlainAddr string
+
+	// EnableH2C makes plain HTTP listeners also serve HTTP/2 without TLS, to
+	// clients which ask for it. HTTPS listeners negotiate HTTP/2 regardless.
+	EnableH2C bool
+
+	// Metrics, if set, records the requests served, and must be registered by
+	// the caller. Otherwise metrics with the default quantile objectives,
+	// registered with Registerer, are used.
+	Metrics *metrics.HTTP
+
+	// Registerer, if set, is the registry with which metrics of the
+	// service's own are registered, when Metrics is not set, so that several
+	// services in one process, or an application embedding one, need not
+	// share the default Prometheus registry. If it is also a Gatherer, such
+	// as a *prometheus.Registry, it is what MountMetrics serves. Otherwise
+	// metrics registered with the default registry, shared by every such
+	// service, are used.
+	Registerer prometheus.Registerer
+
+	// AccessLog makes the service log a line, in logfmt, for every request
+	// served, giving its method, path, status, response size, duration and
+	// client address.
+	AccessLog bool
+
+	// AllowedOrigins, if set, are the origins from which browsers may make
+	// cross-origin requests to the key endpoints. "*" allows any origin.
+	AllowedOrigins []string
 
-	store Store
+	// BreakerThreshold, if positive, is how many consecutive writes to the
+	// store may fail before further writes fail fast, with a 503, for
+	// BreakerCooldown. A single write is then let through to probe whether
+	// the store has recovered.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// MaxConcurrentWrites, if positive, is how many writes this node may be
+	// applying at once. Further writes wait up to WriteQueueTimeout for one
+	// to complete, or fail at once if it is zero, with a 503. Reads, and
+	// writes forwarded to the leader, are not limited.
+	MaxConcurrentWrites int
+	WriteQueueTimeout   time.Duration
+
+	// ReadRateLimit and WriteRateLimit, if positive, are how many reads and
+	// writes a second each client may make, after a burst of up to ReadBurst
+	// and WriteBurst requests. Requests over the limit are rejected with a
+	// 429. Health checks are not limited.
+	ReadRateLimit  float64
+	ReadBurst      int
+	WriteRateLimit float64
+	WriteBurst     int
+
+	// RateLimitHeader, if set, names a request header, such as X-Client-ID,
+	// identifying clients for rate limiting. Otherwise clients are told apart
+	// by IP address, so writes forwarded by a follower count against the
+	// follower on the leader.
+	RateLimitHeader string
+
+	// EnablePprof mounts the net/http/pprof profiling handlers under
+	// /debug/pprof/. Like other endpoints, they require AuthToken if it is
+	// set.
+	EnablePprof bool
+
+	// MountMetrics serves metrics, in Prometheus format, under /metrics, so
+	// that they can be scraped on the same port as the API instead of on an
+	// address of their own.
+	MountMetrics bool
+
+	// AuthToken, if set, must be presented by every request, other than
+	// health checks, as an "Authorization: Bearer <token>" header.
+	AuthToken string
+
+	// BasePath, if set, such as "/hraftd", is a prefix every request path
+	// must have, and which is removed before routing, so that the service
+	// can sit behind a proxy which routes by path. Other paths are not
+	// found. Every node is assumed to have the same base path, which is
+	// added to requests sent to other nodes.
+	BasePath string
+
+	// HandleSignals makes Start install handlers for SIGINT and SIGTERM,
+	// which shut the service down gracefully: leadership is handed to
+	// another node, if this node is the leader, and then the service is
+	// closed. Done is closed once it has shut down. It is off by default,
+	// for hosts which handle signals themselves.
+	HandleSignals bool
 }
 
-// New returns an uninitialized HTTP service.
-func New(addr string, store Store) *Service {
-	return &Service{
-		addr:  addr,
-		store: store,
+// New returns an uninitialized HTTP service. addr is either a TCP address, or
+// a Unix domain socket given as, for example, "unix:///var/run/hraftd.sock".
+// If logger is nil, messages at LevelInfo and above are logged to stderr.
+// store must not be nil, and Start fails if it is.
+func New(addr string, store Store, logger logging.Logger) *Service {
+	if logger == nil {
+		logger = logging.New(os.Stderr, "[http] ")
 	}
+	s := &Service{
+		addr:                addr,
+		store:               store,
+		logger:              logger,
+		client:              &http.Client{Timeout: forwardTimeout},
+		closing:             make(chan struct{}),
+		errs:                make(chan error, 2),
+		signals:             make(chan os.Signal, 1),
+		done:                make(chan struct{}),
+		mux:                 http.NewServeMux(),
+		DrainTimeout:        DefaultDrainTimeout,
+		ReadHeaderTimeout:   DefaultReadHeaderTimeout,
+		ReadTimeout:         DefaultReadTimeout,
+		WriteTimeout:        DefaultWriteTimeout,
+		IdleTimeout:         DefaultIdleTimeout,
+		IndexWaitTimeout:    DefaultIndexWaitTimeout,
+		LongPollTimeout:     DefaultLongPollTimeout,
+		MaxBodySize:         DefaultMaxBodySize,
+		MaxGetKeys:          DefaultMaxGetKeys,
+		MaxDeleteKeys:       DefaultMaxDeleteKeys,
+		MaxKeyLength:        DefaultMaxKeyLength,
+		PromoteMaxLag:       DefaultPromoteMaxLag,
+		BreakerThreshold:    DefaultBreakerThreshold,
+		BreakerCooldown:     DefaultBreakerCooldown,
+		MaxConcurrentWrites: DefaultMaxConcurrentWrites,
+	}
+
+	// Each Service has its own mux, so that several may run in one process.
+	s.mux.HandleFunc("/key", s.handleKeyRequest)
+	s.mux.HandleFunc("/key/", s.handleKeyPath)
+	s.mux.HandleFunc("/keys", s.handleKeys)
+	s.mux.HandleFunc("/keys/batch", s.handleBatch)
+	s.mux.HandleFunc("/keys/get", s.handleGetMulti)
+	s.mux.HandleFunc("/keys/delete", s.handleDeleteMulti)
+	s.mux.HandleFunc("/keys/meta", s.handleKeysMeta)
+	s.mux.HandleFunc("/txn", s.handleTxn)
+	s.mux.HandleFunc("/join", s.handleJoin)
+	s.mux.HandleFunc("/leave", s.handleLeave)
+	s.mux.HandleFunc("/promote", s.handlePromote)
+	s.mux.HandleFunc("/leadership/transfer", s.handleTransferLeadership)
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/cluster", s.handleCluster)
+	s.mux.HandleFunc("/leader", s.handleLeader)
+	s.mux.HandleFunc("/replication", s.handleReplication)
+	s.mux.HandleFunc("/health", s.handleHealth)
+	s.mux.HandleFunc("/ready", s.handleReady)
+	s.mux.HandleFunc("/snapshot", s.handleSnapshot)
+	s.mux.HandleFunc("/bootstrap", s.handleBootstrap)
+	s.mux.HandleFunc("/barrier", s.handleBarrier)
+	s.mux.HandleFunc("/maintenance", s.handleMaintenance)
+	s.mux.HandleFunc("/admin/flush", s.handleFlush)
+	s.mux.HandleFunc("/acl", s.handleACL)
+	s.mux.HandleFunc("/schema/", s.handleSchema)
+	s.mux.HandleFunc("/backup", s.handleBackup)
+	s.mux.HandleFunc("/version", s.handleVersion)
+	s.mux.HandleFunc("/config/raft", s.handleRaftConfig)
+	s.mux.HandleFunc("/loglevel", s.handleLogLevel)
+	s.mux.HandleFunc("/watch", s.handleWatch)
+	s.mux.Handle("/ws/watch", websocket.Server{Handler: s.serveWebSocketWatch})
+	s.mux.HandleFunc("/restore", s.handleRestore)
+	s.mux.HandleFunc("/debug/pprof/", s.handlePprof)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	return s
 }
 
-// Start starts the service.
+// Start starts the service. An error is returned if it has no store.
 func (s *Service) Start() error {
-	server := http.Server{
-		Handler: s,
+	if s.store == nil {
+		return errNilStore
+	}
+
+	tlsConfig := s.TLSConfig
+	if s.ClientCAs != nil {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		tlsConfig.ClientCAs = s.ClientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.server = &http.Server{
+		Handler:           s,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+	}
+	if s.EnableH2C {
+		s.server.Handler = h2c.NewHandler(s, &http2.Server{})
 	}
 
-	ln, err := net.Listen("tcp", s.addr)
+	ln, err := listen(s.addr)
 	if err != nil {
 		return err
 	}
 	s.ln = ln
 
-	http.Handle("/", s)
+	if s.PlainAddr != "" {
+		plainLn, err := listen(s.PlainAddr)
+		if err != nil {
+			s.ln.Close()
+			return err
+		}
+		s.plainLn = plainLn
+
+		go func() {
+			s.serveErr(s.server.Serve(s.plainLn))
+		}()
+	}
+
+	if s.HandleSignals {
+		signal.Notify(s.signals, os.Interrupt, syscall.SIGTERM)
+		go s.awaitSignal()
+	}
 
 	go func() {
-		err := server.Serve(s.ln)
-		if err != nil {
-			log.Fatalf("HTTP serve: %s", err)
+		var err error
+		if s.tlsEnabled() {
+			err = s.server.ServeTLS(s.ln, s.CertFile, s.KeyFile)
+		} else {
+			err = s.server.Serve(s.ln)
 		}
+		s.serveErr(err)
 	}()
 
 	return nil
 }
 
-// Close closes the service.
-func (s *Service) Close() {
-	s.ln.Close()
-	return
+// Err returns a channel receiving any error which stops the service serving,
+// other than it being closed. The service does not exit the process itself,
+// so that the caller decides how to handle the failure.
+func (s *Service) Err() <-chan error {
+	return s.errs
 }
 
-// ServeHTTP allows Service to serve HTTP requests.
-func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.HasPrefix(r.URL.Path, "/key") {
-		s.handleKeyRequest(w, r)
-	} else if r.URL.Path == "/join" {
-		s.handleJoin(w, r)
-	} else if r.URL.Path == "/status" {
-		s.handleStatus(w, r)
-	} else {
-		w.WriteHeader(http.StatusNotFound)
+// serveErr reports err, returned by serving a listener, via Err.
+func (s *Service) serveErr(err error) {
+	if err == nil || err == http.ErrServerClosed {
+		return
 	}
+	s.logger.Error("HTTP serve: %s", err)
+	s.errs <- err
 }
 
-func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, s.store.Status())
+// listen listens on addr, which is either a TCP address or, if prefixed with
+// "unix://", the path of a Unix domain socket. A socket file left behind by an
+// earlier process is removed first. Go removes the file again once the
+// listener is closed.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
 }
 
-func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
-	m := map[string]string{}
-	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+// Close closes the service. The listener is closed immediately, while
+// in-flight requests are given up to DrainTimeout to complete. Closing the
+// service again has no effect.
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+		defer cancel()
+		if err := s.server.Shutdown(ctx); err != nil {
+			s.server.Close()
+			s.closeErr = err
+		}
+	})
+	return s.closeErr
+}
+
+// Done returns a channel which is closed once the service has shut down on
+// a signal, if HandleSignals is set.
+func (s *Service) Done() <-chan struct{} {
+	return s.done
+}
+
+// awaitSignal shuts the service down once a signal is received, unless the
+// service is closed first.
+func (s *Service) awaitSignal() {
+	select {
+	case sig := <-s.signals:
+		signal.Stop(s.signals)
+		s.logger.Info("received %s, shutting down", sig)
+		s.shutdown()
+	case <-s.closing:
+		signal.Stop(s.signals)
 	}
+}
 
-	if len(m) != 2 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+// shutdown hands leadership to another node, if this node is the leader, so
+// that the cluster need not wait out an election timeout, and then closes
+// the service.
+func (s *Service) shutdown() {
+	if s.store.IsLeader() {
+		if err := s.store.TransferLeadership(""); err != nil {
+			s.logger.Error("failed to transfer leadership: %s", err)
+		}
 	}
+	if err := s.Close(); err != nil {
+		s.logger.Error("failed to close service: %s", err)
+	}
+	close(s.done)
+}
 
-	remoteAddr, ok := m["addr"]
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+// tlsEnabled returns whether the service serves HTTPS.
+func (s *Service) tlsEnabled() bool {
+	return s.TLSConfig != nil || s.CertFile != ""
+}
+
+// scheme returns the URL scheme of the service, which is assumed to be the
+// same for every node in the cluster.
+func (s *Service) scheme() string {
+	if s.tlsEnabled() {
+		return "https"
 	}
+	return "http"
+}
 
-	nodeID, ok := m["id"]
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
+// ServeHTTP allows Service to serve HTTP requests. Every request is timed, and
+// those which fail are counted, labelled with the route they were dispatched to.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = withRequestID(w, r)
+	routed := s.stripBasePath(r)
+	endpoint := "unknown"
+	if routed {
+		endpoint = s.endpoint(r)
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	m := s.httpMetrics()
+	inFlight := m.InFlight.WithLabelValues(endpoint)
+	inFlight.Inc()
+	defer inFlight.Dec()
+	defer func() {
+		d := time.Since(start)
+		if s.AccessLog {
+			s.logAccess(r, rec, d)
+		} else {
+			s.requestLogger(r).Debug("%s %s from %s: %d in %s", r.Method, r.URL.Path, r.RemoteAddr, rec.status, d)
+		}
+		m.Requests.WithLabelValues(endpoint, r.Method).Observe(float64(d.Nanoseconds()))
+		m.Duration.WithLabelValues(endpoint, r.Method).Observe(d.Seconds())
+		if rec.status >= http.StatusBadRequest {
+			m.Errors.WithLabelValues(endpoint, r.Method, strconv.Itoa(rec.status)).Inc()
+		}
+	}()
+	defer s.recoverPanic(rec, r, m)
+	s.setLeaderHeader(rec)
+	if !routed {
+		writeError(rec, http.StatusNotFound, "not found")
 		return
 	}
+	s.dispatch(rec, r)
+}
 
-	if err := s.store.Join(nodeID, remoteAddr); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+// basePath returns BasePath without any trailing slash.
+func (s *Service) basePath() string {
+	return strings.TrimSuffix(s.BasePath, "/")
+}
+
+// stripBasePath removes BasePath from the path of r, returning false if the
+// path is not under it.
+func (s *Service) stripBasePath(r *http.Request) bool {
+	base := s.basePath()
+	if base == "" {
+		return true
+	}
+	if r.URL.Path != base && !strings.HasPrefix(r.URL.Path, base+"/") {
+		return false
 	}
+	u := *r.URL
+	u.Path = strings.TrimPrefix(r.URL.Path, base)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = ""
+	r.URL = &u
+	return true
 }
 
-func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
-	start := time.Now().UnixNano()
-	labels := map[string]string{
-		"endpoint": "/key",
-		"method":   r.Method,
+// recoverPanic turns a panic while serving r into a 500 response, if nothing
+// has been written yet, so that a bug, such as a nil store, fails the request
+// rather than the connection. It must be deferred.
+func (s *Service) recoverPanic(rec *statusRecorder, r *http.Request, m *metrics.HTTP) {
+	v := recover()
+	if v == nil {
+		return
 	}
-	summary := httpRequestsSummary.With(labels)
-	defer func() {
-		summary.Observe(float64(time.Now().UnixNano() - start))
-	}()
-	getKey := func() string {
-		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) != 3 {
-			return ""
-		}
-		return parts[2]
+	if v == http.ErrAbortHandler {
+		// Raised deliberately to abort the response, which the server
+		// handles without logging.
+		panic(v)
 	}
-	switch r.Method {
-	case "GET":
-		k := getKey()
-		if k == "" {
-			labels["status"] = fmt.Sprint(http.StatusBadRequest)
-			httpErrorsCounter.With(labels).Inc()
-			w.WriteHeader(http.StatusBadRequest)
+	m.Panics.Inc()
+	s.requestLogger(r).Error("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+	if !rec.wrote {
+		writeError(rec, http.StatusInternalServerError, "internal server error")
+	} else {
+		rec.status = http.StatusInternalServerError
+	}
+}
+
+// setLeaderHeader tells the client the HTTP API address of the leader, as
+// X-Raft-Leader, so that it can find the leader without asking /cluster. The
+// header is empty if the leader is not known.
+func (s *Service) setLeaderHeader(w http.ResponseWriter) {
+	leader, _ := s.store.LeaderHTTPAddr()
+	w.Header().Set("X-Raft-Leader", leader)
+}
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// withRequestID returns r with its correlation ID, given by the client as
+// X-Request-ID or otherwise generated, in its context. The ID is echoed in
+// the response, and kept in r's headers so that it is passed on if r is
+// forwarded to the leader.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		r.Header.Set("X-Request-ID", id)
+	}
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+// RequestID returns the correlation ID of the request ctx belongs to, or the
+// empty string if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger returns the service's logger, tagging messages with the ID of
+// request r.
+func (s *Service) requestLogger(r *http.Request) logging.Logger {
+	return logging.With(s.logger, fmt.Sprintf("[request_id=%s] ", RequestID(r.Context())))
+}
+
+// logAccess logs a line, in logfmt, describing request r, whose response was
+// written through rec and took d to serve.
+func (s *Service) logAccess(r *http.Request, rec *statusRecorder, d time.Duration) {
+	var b strings.Builder
+	for _, f := range []struct{ k, v string }{
+		{"method", r.Method},
+		{"path", r.URL.Path},
+		{"status", strconv.Itoa(rec.status)},
+		{"bytes", strconv.FormatInt(rec.bytes, 10)},
+		{"duration", d.String()},
+		{"remote", r.RemoteAddr},
+		{"request_id", RequestID(r.Context())},
+	} {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
 		}
-		v, err := s.store.Get(k)
-		if err != nil {
-			labels["status"] = fmt.Sprint(http.StatusInternalServerError)
-			httpErrorsCounter.With(labels).Inc()
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		b.WriteString(f.k)
+		b.WriteByte('=')
+		if f.v == "" || strings.ContainsAny(f.v, " =\"") {
+			b.WriteString(strconv.Quote(f.v))
+		} else {
+			b.WriteString(f.v)
 		}
+	}
+	s.logger.Info("%s", b.String())
+}
 
-		b, err := json.Marshal(map[string]string{k: v})
-		if err != nil {
-			labels["status"] = fmt.Sprint(http.StatusInternalServerError)
-			httpErrorsCounter.With(labels).Inc()
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+// httpMetrics returns the metrics requests to s are recorded in.
+func (s *Service) httpMetrics() *metrics.HTTP {
+	if s.Metrics != nil {
+		return s.Metrics
+	}
+	if s.Registerer != nil {
+		s.ownMetricsOnce.Do(func() {
+			s.ownMetrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+			if err := s.ownMetrics.Register(s.Registerer); err != nil {
+				panic(err)
+			}
+		})
+		return s.ownMetrics
+	}
+	defaultMetricsOnce.Do(func() {
+		defaultMetrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+		if err := defaultMetrics.Register(prometheus.DefaultRegisterer); err != nil {
+			panic(err)
 		}
+	})
+	return defaultMetrics
+}
 
-		io.WriteString(w, string(b))
+// dispatch authenticates r, and then routes it to the leader if it must be
+// served there, or to its handler otherwise.
+func (s *Service) dispatch(w http.ResponseWriter, r *http.Request) {
+	// Preflight requests carry no credentials, so are answered before
+	// authentication.
+	if s.handleCORS(w, r) {
+		return
+	}
 
-	case "POST":
-		// Read the value from the POST body.
-		m := map[string]string{}
-		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-			labels["status"] = fmt.Sprint(http.StatusBadRequest)
-			httpErrorsCounter.With(labels).Inc()
-			w.WriteHeader(http.StatusBadRequest)
+	// Tokens other than AuthToken are accepted if they have an ACL rule,
+	// which limits what they may do.
+	if !s.authenticated(r) {
+		var ok bool
+		if r, ok = s.withACL(r); !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
 			return
 		}
-		for k, v := range m {
-			if err := s.store.Set(k, v); err != nil {
-				labels["status"] = fmt.Sprint(http.StatusInternalServerError)
-				httpErrorsCounter.With(labels).Inc()
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+	}
+
+	if r.URL.Path != "/health" && r.URL.Path != "/ready" && s.rateLimited(w, r) {
+		return
+	}
+
+	r, ok := withNamespace(w, r)
+	if !ok || !s.authorized(w, r) {
+		return
+	}
+
+	// A body declared too large is refused before any of it is read, so a
+	// client sending "Expect: 100-continue" is spared sending it at all.
+	if r.ContentLength > s.MaxBodySize && r.URL.Path != "/restore" {
+		writeError(w, http.StatusRequestEntityTooLarge, "http: request body too large")
+		return
+	}
+
+	// Maintenance mode is replicated, so any node can refuse writes without
+	// troubling the leader.
+	if isMaintenanceWrite(r) && s.store.Maintenance() {
+		writeError(w, http.StatusServiceUnavailable, store.ErrMaintenance.Error())
+		return
+	}
+
+	if isKeyWrite(r) && !s.store.IsLeader() {
+		if s.RedirectWrites {
+			s.redirectToLeader(w, r)
+		} else {
+			s.forwardToLeader(w, r)
 		}
+		return
+	}
 
-	case "DELETE":
-		k := getKey()
-		if k == "" {
-			labels["status"] = fmt.Sprint(http.StatusBadRequest)
-			httpErrorsCounter.With(labels).Inc()
-			w.WriteHeader(http.StatusBadRequest)
+	if isKeyWrite(r) {
+		release, ok := s.acquireWrite(w, r)
+		if !ok {
 			return
 		}
-		if err := s.store.Delete(k); err != nil {
-			labels["status"] = fmt.Sprint(http.StatusInternalServerError)
-			httpErrorsCounter.With(labels).Inc()
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		defer release()
+	}
+
+	// Writes carrying an idempotency key are applied at most once.
+	if k := r.Header.Get("Idempotency-Key"); k != "" && isKeyWrite(r) {
+		r = r.WithContext(store.WithIdempotencyKey(r.Context(), k))
+	}
+
+	// Compression is handled here, rather than ahead of forwarding, so that
+	// forwarded requests and responses are passed through untouched.
+	if err := decompressBody(r); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid gzip request body")
+		return
+	}
+	if r.Method == "GET" && acceptsGzip(r) && r.Header.Get("Upgrade") == "" {
+		gw := newGzipResponseWriter(w)
+		defer gw.Close()
+		w = gw
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// decompressBody replaces the body of r, if it is gzip-encoded, with its
+// decompressed content. An empty body is left empty.
+func decompressBody(r *http.Request) error {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return nil
+	}
+
+	zr, err := gzip.NewReader(r.Body)
+	if err == io.EOF {
+		r.Body = http.NoBody
+	} else if err != nil {
+		return err
+	} else {
+		r.Body = ioutil.NopCloser(zr)
+	}
+	r.Header.Del("Content-Encoding")
+	r.ContentLength = -1
+	return nil
+}
+
+// acceptsGzip returns whether the client making r accepts gzip-encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
 		}
-		s.store.Delete(k)
+		return len(parts) == 1 || strings.Replace(parts[1], " ", "", -1) != "q=0"
+	}
+	return false
+}
 
-	default:
-		labels["status"] = fmt.Sprint(http.StatusMethodNotAllowed)
-		httpErrorsCounter.With(labels).Inc()
-		w.WriteHeader(http.StatusMethodNotAllowed)
+// gzipResponseWriter gzip-encodes the body written through it. Close must be
+// called once the response is complete.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+
+	// noBody is whether the status written forbids a body, so that not even
+	// an empty gzip stream may be written.
+	noBody bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &gzipResponseWriter{ResponseWriter: w, gz: gzip.NewWriter(w)}
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	// The length set by the handler, if any, is of the uncompressed body.
+	g.Header().Del("Content-Length")
+	if code == http.StatusNotModified || code == http.StatusNoContent {
+		g.Header().Del("Content-Encoding")
+		g.noBody = true
 	}
-	return
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	return g.gz.Write(b)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	g.gz.Flush()
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Close() error {
+	if g.noBody {
+		return nil
+	}
+	return g.gz.Close()
+}
+
+// endpoint returns the route r is dispatched to, for use as a metric label.
+// Requests for individual keys are all labelled "/key", other than those
+// performing a known action on the key. Namespaced requests are labelled
+// with the route they are rewritten to.
+func (s *Service) endpoint(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/ns/") {
+		rest := strings.TrimPrefix(r.URL.Path, "/ns/")
+		if i := strings.Index(rest, "/"); i >= 0 {
+			u := *r.URL
+			u.Path = rest[i:]
+			r = &http.Request{Method: r.Method, URL: &u, Host: r.Host}
+		}
+	}
+	switch _, pattern := s.mux.Handler(r); pattern {
+	case "":
+		return "unknown"
+	case "/key/":
+		if parts := strings.Split(r.URL.Path, "/"); len(parts) == 4 && (parts[3] == "cas" || parts[3] == "incr" || parts[3] == "append") {
+			return "/key/" + parts[3]
+		}
+		return "/key"
+	default:
+		return pattern
+	}
+}
+
+// statusRecorder records the status code, and the number of body bytes,
+// written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wrote {
+		s.status, s.wrote = code, true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wrote = true
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	return h.Hijack()
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// corsAllowedHeaders are the request headers browsers may send cross-origin.
+const corsAllowedHeaders = "Authorization, Content-Type, Content-Encoding, X-TTL-Seconds, X-Request-ID, X-Min-Raft-Index"
+
+// handleCORS allows browsers at AllowedOrigins to make requests of the key
+// endpoints, and returns whether r was a preflight request, which it has
+// answered. Requests from other origins are left for the browser to block.
+func (s *Service) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(s.AllowedOrigins) == 0 || origin == "" || !strings.HasPrefix(r.URL.Path, "/key") {
+		return false
+	}
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	allowed := false
+	for _, o := range s.AllowedOrigins {
+		if o == "*" || o == origin {
+			allowed = true
+			break
+		}
+	}
+	w.Header().Add("Vary", "Origin")
+	if !allowed {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if !preflight {
+		w.Header().Set("Access-Control-Expose-Headers", "X-Raft-Index, X-Request-ID")
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// authenticated returns whether r carries the configured bearer token. Load
+// balancer probes of /health and /ready don't need to.
+func (s *Service) authenticated(r *http.Request) bool {
+	if s.AuthToken == "" || r.URL.Path == "/health" || r.URL.Path == "/ready" {
+		return true
+	}
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(h, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.AuthToken)) == 1
+}
+
+// isKeyWrite returns whether r changes keys, including those holding schemas,
+// and so must be served by the leader. Multi-key reads are POSTed, but are
+// not writes. Nor do OPTIONS and TRACE requests, which are answered by the
+// node receiving them.
+func isKeyWrite(r *http.Request) bool {
+	return (strings.HasPrefix(r.URL.Path, "/key") || strings.HasPrefix(r.URL.Path, "/schema/") || r.URL.Path == "/txn") &&
+		r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" && r.Method != "TRACE" &&
+		r.URL.Path != "/keys/get"
+}
+
+// isMaintenanceWrite returns whether r changes keys, and so is refused in
+// maintenance mode. Besides key writes, these are flushes, restores and
+// changes to ACL rules, which are stored as keys.
+func isMaintenanceWrite(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/admin/flush", "/restore":
+		return r.Method == "POST"
+	case "/acl":
+		return r.Method == "PUT" || r.Method == "DELETE"
+	}
+	return isKeyWrite(r)
+}
+
+// forwardToLeader sends r to the leader, and relays the leader's response. A
+// request is forwarded at most once, so a forwarded request which arrives at a
+// node which is not the leader fails rather than risking a forwarding loop.
+func (s *Service) forwardToLeader(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Forwarded-By") != "" {
+		writeError(w, http.StatusServiceUnavailable, "not leader, and request already forwarded")
+		return
+	}
+
+	leader, ok := s.leaderHTTPAddr(w)
+	if !ok {
+		return
+	}
+
+	u := url.URL{Scheme: s.scheme(), Host: leader, Path: s.basePath() + r.URL.Path, RawQuery: r.URL.RawQuery}
+	req, err := http.NewRequest(r.Method, u.String(), r.Body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set("X-Forwarded-By", s.addr)
+	req.ContentLength = r.ContentLength
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// redirectToLeader redirects the client to make request r to the leader.
+func (s *Service) redirectToLeader(w http.ResponseWriter, r *http.Request) {
+	leader, ok := s.leaderHTTPAddr(w)
+	if !ok {
+		return
+	}
+
+	// The namespace is kept in the path, as clients need not resend headers
+	// when following redirects.
+	path := r.URL.Path
+	if ns := Namespace(r.Context()); ns != "" {
+		path = "/ns/" + ns + path
+	}
+	path = s.basePath() + path
+	u := url.URL{Scheme: s.scheme(), Host: leader, Path: path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+}
+
+// leaderHTTPAddr returns the HTTP address of the leader. If it is not known
+// an error response is written, asking the client to retry once an election
+// has had time to complete, and false is returned.
+func (s *Service) leaderHTTPAddr(w http.ResponseWriter) (string, bool) {
+	leader, err := s.store.LeaderHTTPAddr()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return "", false
+	}
+	if leader == "" {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, "no known leader")
+		return "", false
+	}
+	return leader, true
+}
+
+// handleKeyPath dispatches requests under /key/, which either address a key
+// directly or perform an action on it.
+func (s *Service) handleKeyPath(w http.ResponseWriter, r *http.Request) {
+	if parts := strings.Split(r.URL.Path, "/"); len(parts) == 4 {
+		s.handleKeyAction(w, r, parts[2], parts[3])
+	} else {
+		s.handleKeyRequest(w, r)
+	}
+}
+
+func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
+	// The Raft status is a bare string, not a JSON document. The applied
+	// index is also reported, so the leader can tell how far behind this
+	// node is.
+	s.setIndexHeader(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, s.store.Status())
+}
+
+func (s *Service) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	servers, err := s.store.Servers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]store.ServerInfo{"servers": servers})
+}
+
+// handleLeader reports whether this node is the leader, and the URL of the
+// leader's HTTP API, or an empty string if it is not known. It is answered
+// from local state, so is cheap enough to poll.
+func (s *Service) handleLeader(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	addr, err := s.store.LeaderHTTPAddr()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var leader string
+	if addr != "" {
+		leader = s.scheme() + "://" + addr + s.basePath()
+	}
+	writeJSON(w, http.StatusOK, struct {
+		IsLeader bool   `json:"isLeader"`
+		Leader   string `json:"leader"`
+	}{s.store.IsLeader(), leader})
+}
+
+// handleReplication reports, from the leader, how far each follower is
+// behind it, so that a stuck follower can be spotted.
+func (s *Service) handleReplication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	followers, err := s.store.Replication()
+	if err == store.ErrNotLeader {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]store.FollowerReplication{"followers": followers})
+}
+
+// handleHealth reports whether the node is part of a cluster with a leader,
+// and therefore able to serve requests.
+func (s *Service) handleHealth(w http.ResponseWriter, r *http.Request) {
+	leader, err := s.store.LeaderAddr()
+	if err != nil || leader == "" {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "no leader"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleWatch streams changes to keys under the requested prefix, as
+// Server-Sent Events, until the client goes away or the service is closed.
+// Streams are also ended by WriteTimeout, after which clients are expected to
+// reconnect, as SSE clients do by default.
+func (s *Service) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	events, cancel := s.storeFor(r).Watch(r.URL.Query().Get("prefix"))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// wsMessage is sent by WebSocket watch clients to change what they watch.
+// "subscribe" replaces the watched prefix, and "unsubscribe" stops watching.
+type wsMessage struct {
+	Op     string `json:"op"`
+	Prefix string `json:"prefix"`
+}
+
+// wsEvent is sent to WebSocket watch clients for each change, and to report
+// invalid messages.
+type wsEvent struct {
+	Type  string `json:"type"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// serveWebSocketWatch sends changes to keys to a WebSocket client, which
+// chooses what to watch by sending a wsMessage, first, and whenever it wants
+// to change what it watches.
+func (s *Service) serveWebSocketWatch(ws *websocket.Conn) {
+	// The connection outlives the request, so must not inherit its timeouts.
+	ws.SetDeadline(time.Time{})
+
+	// Messages are read in the background, until the client goes away, or
+	// this function returns.
+	msgs := make(chan wsMessage)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var m wsMessage
+			if err := websocket.JSON.Receive(ws, &m); err != nil {
+				return
+			}
+			select {
+			case msgs <- m:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var events <-chan store.Event
+	cancel := func() {}
+	defer func() {
+		close(quit)
+		cancel()
+		ws.Close()
+	}()
+	for {
+		var ev wsEvent
+		select {
+		case m := <-msgs:
+			switch m.Op {
+			case "subscribe":
+				cancel()
+				events, cancel = s.storeFor(ws.Request()).Watch(m.Prefix)
+			case "unsubscribe":
+				cancel()
+				events, cancel = nil, func() {}
+			default:
+				if err := websocket.JSON.Send(ws, wsEvent{Type: "error", Error: "unknown op"}); err != nil {
+					return
+				}
+			}
+			continue
+		case e := <-events:
+			ev = wsEvent{Type: e.Type, Key: e.Key, Value: e.Value}
+		case <-done:
+			return
+		case <-s.closing:
+			return
+		}
+		if err := websocket.JSON.Send(ws, ev); err != nil {
+			return
+		}
+	}
+}
+
+// handlePprof serves the net/http/pprof handlers, if enabled. The handlers
+// are mounted on the service's own mux, rather than the default one, so that
+// they are only served where asked for.
+func (s *Service) handlePprof(w http.ResponseWriter, r *http.Request) {
+	if !s.EnablePprof {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
+
+// handleMetrics serves metrics, if mounted. Serving them here only gathers
+// what is already registered, so does not register anything a second time.
+func (s *Service) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !s.MountMetrics {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	// Responses are already compressed by dispatch, if the client accepts
+	// it, so the handler must not compress them again.
+	r = r.WithContext(r.Context())
+	r.Header = r.Header.Clone()
+	r.Header.Del("Accept-Encoding")
+	if g, ok := s.Registerer.(prometheus.Gatherer); ok {
+		promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		return
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+// handleVersion reports the build of hraftd serving the request, so that the
+// progress of a rolling upgrade can be followed.
+func (s *Service) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Version      string `json:"version"`
+		Commit       string `json:"commit"`
+		RaftProtocol int    `json:"raftProtocol"`
+	}{version.Version, version.Commit, version.RaftProtocol})
+}
+
+// handleRaftConfig reports the Raft tuning in effect on the node, which
+// otherwise could only be learnt from its startup flags. A PATCH changes the
+// snapshot interval, snapshot threshold or trailing logs of the node, and
+// reports the tuning which results.
+func (s *Service) handleRaftConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		if !s.reloadRaftConfig(w, r) {
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.store.RaftConfig())
+}
+
+// reloadRaftConfig applies the Raft tuning in the body of r, named as in
+// store.RaftConfigView. Otherwise an error response is written, and false
+// returned.
+func (s *Service) reloadRaftConfig(w http.ResponseWriter, r *http.Request) bool {
+	var req struct {
+		SnapshotInterval  *string
+		SnapshotThreshold *uint64
+		TrailingLogs      *uint64
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.MaxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return false
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "request body may only contain SnapshotInterval, SnapshotThreshold and TrailingLogs")
+		return false
+	}
+
+	cfg := store.RaftReloadable{
+		SnapshotThreshold: req.SnapshotThreshold,
+		TrailingLogs:      req.TrailingLogs,
+	}
+	if req.SnapshotInterval != nil {
+		d, err := time.ParseDuration(*req.SnapshotInterval)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid SnapshotInterval")
+			return false
+		}
+		cfg.SnapshotInterval = &d
+	}
+	if err := s.store.ReloadRaftConfig(cfg); errors.Is(err, store.ErrInvalidRaftConfig) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	} else if err != nil {
+		writeStoreError(w, err)
+		return false
+	}
+	return true
+}
+
+// handleLogLevel changes the verbosity of the service's logger, so that
+// debugging can be turned on without a restart.
+func (s *Service) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	l, ok := s.logger.(interface{ SetLevel(logging.Level) })
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "logger level cannot be changed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if bodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	level, err := logging.ParseLevel(req.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	l.SetLevel(level)
+}
+
+// handleSnapshot snapshots the node's store. Snapshots are local, so any node
+// may be asked to, such as before it is taken offline.
+func (s *Service) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if err := s.store.Snapshot(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+}
+
+// handleBarrier waits until every change committed so far has been applied on
+// the leader, so that reads made afterwards reflect them. The wait is bounded
+// by the timeout query parameter, a duration such as "2s", if given.
+func (s *Service) handleBarrier(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	timeout := DefaultBarrierTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid timeout")
+			return
+		}
+		timeout = d
+	}
+
+	if err := s.store.Barrier(timeout); err == store.ErrNotLeader || err == store.ErrApplyTimeout {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+}
+
+// handleBootstrap makes an uninitialized node a single-node cluster, for when
+// whether to do so is only decided once the node is running.
+func (s *Service) handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if err := s.store.Bootstrap(); err == store.ErrBootstrapped {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+}
+
+// handleBackup streams every key in the store to the client. Once streaming
+// has begun, failures can only be logged.
+func (s *Service) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := s.store.Backup(w); err != nil {
+		s.requestLogger(r).Error("failed to back up store: %s", err)
+	}
+}
+
+// handleRestore loads a backup, streamed as the request body, into the store.
+// The body is deliberately not limited to MaxBodySize.
+func (s *Service) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+	if err := s.store.Restore(r.Body, force); err == store.ErrNotLeader {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err == store.ErrNotEmpty {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+}
+
+// handleMaintenance reports, or via the leader changes, whether the cluster
+// is in maintenance mode, in which keys may be read but not changed.
+func (s *Service) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]bool{"enabled": s.store.Maintenance()})
+
+	case "PUT":
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&req); bodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		} else if err != nil || req.Enabled == nil {
+			writeError(w, http.StatusBadRequest, "request body must contain enabled")
+			return
+		}
+
+		if err := s.store.SetMaintenance(*req.Enabled); err == store.ErrNotLeader {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		} else if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		s.setIndexHeader(w)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleFlush deletes every key in the cluster, in every namespace, for
+// resetting test and staging clusters. As a guard against wiping the store by
+// mistake, it must be confirmed with confirm=true.
+func (s *Service) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.URL.Query().Get("confirm") != "true" {
+		writeError(w, http.StatusBadRequest, "flush must be confirmed with confirm=true")
+		return
+	}
+
+	n, err := s.store.Flush()
+	if err == store.ErrNotLeader {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": n})
+}
+
+// handleReady reports whether the node has caught up with the cluster, so
+// that traffic is not routed to a node which would serve stale reads.
+func (s *Service) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.store.Ready() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// authorizedNode returns whether r may change cluster membership. When client
+// certificates are required, only a client which presented a certificate
+// signed by a trusted CA is authorized. If it is not, a 403 is written.
+func (s *Service) authorizedNode(w http.ResponseWriter, r *http.Request) bool {
+	if s.ClientCAs == nil {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		writeError(w, http.StatusForbidden, "a trusted client certificate is required")
+		return false
+	}
+	return true
+}
+
+func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizedNode(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	m := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&m); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// The node's HTTP address is optional, so that older nodes can still
+	// join, as is whether it votes, which it does by default.
+	var nodeID, remoteAddr, httpAddr string
+	voter := true
+	for k, v := range m {
+		var err error
+		switch k {
+		case "id":
+			err = json.Unmarshal(v, &nodeID)
+		case "addr":
+			err = json.Unmarshal(v, &remoteAddr)
+		case "httpAddr":
+			err = json.Unmarshal(v, &httpAddr)
+		case "voter":
+			if err := json.Unmarshal(v, &voter); err != nil {
+				writeError(w, http.StatusBadRequest, "voter must be a boolean")
+				return
+			}
+		default:
+			writeError(w, http.StatusBadRequest, "unexpected fields in request body")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s must be a string", k))
+			return
+		}
+	}
+
+	if _, ok := m["addr"]; !ok {
+		writeError(w, http.StatusBadRequest, "missing addr")
+		return
+	}
+	if _, ok := m["id"]; !ok {
+		writeError(w, http.StatusBadRequest, "missing id")
+		return
+	}
+
+	if err := s.store.Join(nodeID, remoteAddr, httpAddr, voter); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+}
+
+func (s *Service) handleLeave(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizedNode(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	nodeID, ok := m["id"]
+	if !ok || len(m) != 1 {
+		writeError(w, http.StatusBadRequest, "request body must contain only id")
+		return
+	}
+
+	if err := s.store.Remove(nodeID); err == store.ErrNodeNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+}
+
+// handlePromote makes a non-voter, given as {"id": "node3"}, a voter, once it
+// has caught up with the leader.
+func (s *Service) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizedNode(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil || req.ID == "" {
+		writeError(w, http.StatusBadRequest, "request body must contain id")
+		return
+	}
+
+	servers, err := s.store.Servers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	found := false
+	for _, srv := range servers {
+		if srv.ID == req.ID && srv.Suffrage == "nonvoter" {
+			found = true
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, store.ErrNotNonvoter.Error())
+		return
+	}
+
+	index, err := s.nodeAppliedIndex(req.ID)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("failed to check progress of node: %s", err))
+		return
+	}
+	if leader := s.store.AppliedIndex(); index+s.PromoteMaxLag < leader {
+		writeError(w, http.StatusServiceUnavailable,
+			fmt.Sprintf("node is too far behind: applied index %d, leader's %d", index, leader))
+		return
+	}
+
+	switch err := s.store.Promote(req.ID); err {
+	case nil:
+	case store.ErrNotLeader:
+		writeError(w, http.StatusConflict, err.Error())
+	case store.ErrNotNonvoter:
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeStoreError(w, err)
+	}
+}
+
+// nodeAppliedIndex asks the node identified by nodeID, via its HTTP API, for
+// the index of the last log entry it has applied.
+func (s *Service) nodeAppliedIndex(nodeID string) (uint64, error) {
+	addr := s.store.NodeHTTPAddr(nodeID)
+	if addr == "" {
+		return 0, fmt.Errorf("HTTP address of node %s not known", nodeID)
+	}
+
+	u := url.URL{Scheme: s.scheme(), Host: addr, Path: s.basePath() + "/status"}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if s.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.AuthToken)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return strconv.ParseUint(resp.Header.Get("X-Raft-Index"), 10, 64)
+}
+
+// handleTransferLeadership makes the leader step down in favour of another
+// node, given by an optional {"id": "node2"} body, before it is restarted.
+func (s *Service) handleTransferLeadership(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizedNode(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if bodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	switch err := s.store.TransferLeadership(req.ID); err {
+	case nil:
+	case store.ErrNotLeader:
+		writeError(w, http.StatusConflict, err.Error())
+	case store.ErrNodeNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	}
+}
+
+// handleGetAt responds with the value key had as of the log index given by
+// the atIndex query parameter, as retained by this node.
+func (s *Service) handleGetAt(w http.ResponseWriter, r *http.Request, key string) {
+	index, err := strconv.ParseUint(r.URL.Query().Get("atIndex"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid atIndex")
+		return
+	}
+	if index > s.store.AppliedIndex() {
+		writeError(w, http.StatusBadRequest, "index not yet applied")
+		return
+	}
+
+	v, err := s.storeFor(r).GetAt(key, index)
+	if err == store.ErrKeyNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err == store.ErrHistoryPruned {
+		writeError(w, http.StatusGone, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeEncoded(w, http.StatusOK, responseCodec(r), map[string]string{key: v})
+}
+
+// handleWaitKey long-polls key: it responds with the key's value once its
+// version exceeds the index query parameter, or with a 304 carrying the
+// current version as its ETag if that does not happen within the timeout. A
+// key deleted while waiting is reported with a 404.
+func (s *Service) handleWaitKey(w http.ResponseWriter, r *http.Request, key string) {
+	q := r.URL.Query()
+	index, err := strconv.ParseUint(q.Get("index"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid index")
+		return
+	}
+	timeout := s.LongPollTimeout
+	if t := q.Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid timeout")
+			return
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+
+	// Watch before reading, so that no change is missed in between.
+	st := s.storeFor(r)
+	events, cancel := st.Watch(key)
+	defer cancel()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		v, version, err := st.GetWithVersion(r.Context(), key, store.Stale)
+		if err == nil && version > index {
+			w.Header().Set("ETag", etag(version))
+			writeEncoded(w, http.StatusOK, responseCodec(r), map[string]string{key: v})
+			return
+		} else if err != nil && err != store.ErrKeyNotFound {
+			writeStoreError(w, err)
+			return
+		}
+
+		// Only changes to key itself, or the loss of changes which may
+		// have included it, are worth reading the key again for.
+		for changed := false; !changed; {
+			select {
+			case e := <-events:
+				if e.Type == store.EventDelete && e.Key == key {
+					writeError(w, http.StatusNotFound, store.ErrKeyNotFound.Error())
+					return
+				}
+				changed = e.Key == key || e.Type == store.EventReset
+			case <-timer.C:
+				if err == nil {
+					w.Header().Set("ETag", etag(version))
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			case <-r.Context().Done():
+				writeError(w, storeErrorCode(r.Context().Err()), r.Context().Err().Error())
+				return
+			case <-s.closing:
+				writeError(w, http.StatusServiceUnavailable, "service closing")
+				return
+			}
+		}
+	}
+}
+
+// keyMethods are the methods the key endpoints support, as listed in the
+// Allow header of responses to OPTIONS requests and unsupported methods.
+const keyMethods = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+
+func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
+	getKey := func() string {
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 3 {
+			return ""
+		}
+		return parts[2]
+	}
+	switch r.Method {
+	case "GET":
+		k := getKey()
+		if k == "" {
+			writeError(w, http.StatusBadRequest, "missing key")
+			return
+		}
+		if !s.checkKeys(w, r, k) {
+			return
+		}
+		if r.URL.Query().Get("atIndex") != "" {
+			s.handleGetAt(w, r, k)
+			return
+		}
+		if r.URL.Query().Get("wait") == "true" {
+			s.handleWaitKey(w, r, k)
+			return
+		}
+		level, ok := consistencyLevel(r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid consistency level")
+			return
+		}
+		if !s.waitForIndex(w, r) {
+			return
+		}
+		v, version, err := s.storeFor(r).GetWithVersion(r.Context(), k, level)
+		if err == store.ErrNotLeader {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		} else if err == store.ErrKeyNotFound {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		w.Header().Set("ETag", etag(version))
+		if noneMatch(r, version) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeEncoded(w, http.StatusOK, responseCodec(r), map[string]string{k: v})
+
+	case "HEAD":
+		// Responses to HEAD requests have no body, so errors are reported
+		// by status code alone.
+		k := getKey()
+		if k == "" || s.validateKey(k) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, err := s.storeFor(r).Get(k); err == store.ErrKeyNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			w.WriteHeader(storeErrorCode(err))
+			return
+		}
+
+	case "POST":
+		// An optional TTL applies to every key in the request.
+		ttl, ok := ttlHeader(r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid X-TTL-Seconds header")
+			return
+		}
+
+		// Read the value from the POST body, in whichever encoding the
+		// client sent.
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxBodySize))
+		if bodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		m := map[string]string{}
+		if err != nil || requestCodec(r).Unmarshal(b, &m) != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		if !s.checkKeys(w, r, keys...) || !s.permitted(w, r, keys...) || !s.checkSchemas(w, r, m) {
+			return
+		}
+		if dryRun(r) {
+			s.writeDryRun(w, r, keys, nil)
+			return
+		}
+		for k, v := range m {
+			err := s.storeWrite(func() error {
+				if ttl > 0 {
+					return s.storeFor(r).SetWithTTLCtx(r.Context(), k, v, ttl)
+				}
+				return s.storeFor(r).SetCtx(r.Context(), k, v)
+			})
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+		}
+		s.setIndexHeader(w)
+
+	case "PUT":
+		// The whole body is the value of the single key named in the path.
+		k := getKey()
+		if k == "" {
+			writeError(w, http.StatusBadRequest, "missing key")
+			return
+		}
+		if !s.checkKeys(w, r, k) {
+			return
+		}
+		ttl, ok := ttlHeader(r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid X-TTL-Seconds header")
+			return
+		}
+		match, ok := ifMatch(r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid If-Match header")
+			return
+		}
+		if match != "" && ttl > 0 {
+			writeError(w, http.StatusBadRequest, "X-TTL-Seconds may not be combined with If-Match")
+			return
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxBodySize))
+		if bodyTooLarge(err) {
+			writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if !s.checkSchemas(w, r, map[string]string{k: string(b)}) {
+			return
+		}
+		if dryRun(r) {
+			s.writeDryRun(w, r, []string{k}, nil)
+			return
+		}
+		err = s.storeWrite(func() error {
+			if match != "" {
+				version, err := s.matchVersion(r, k, match)
+				if err != nil {
+					return err
+				}
+				return s.storeFor(r).SetIfVersion(r.Context(), k, string(b), version)
+			}
+			if ttl > 0 {
+				return s.storeFor(r).SetWithTTLCtx(r.Context(), k, string(b), ttl)
+			}
+			return s.storeFor(r).SetCtx(r.Context(), k, string(b))
+		})
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		s.setIndexHeader(w)
+
+	case "DELETE":
+		k := getKey()
+		if k == "" {
+			writeError(w, http.StatusBadRequest, "missing key")
+			return
+		}
+		if !s.checkKeys(w, r, k) {
+			return
+		}
+		match, ok := ifMatch(r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid If-Match header")
+			return
+		}
+		if dryRun(r) {
+			s.writeDryRun(w, r, nil, []string{k})
+			return
+		}
+		err := s.storeWrite(func() error {
+			if match != "" {
+				version, err := s.matchVersion(r, k, match)
+				if err != nil {
+					return err
+				}
+				return s.storeFor(r).DeleteIfVersion(r.Context(), k, version)
+			}
+			return s.storeFor(r).DeleteCtx(r.Context(), k)
+		})
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		s.setIndexHeader(w)
+
+	case "OPTIONS":
+		w.Header().Set("Allow", keyMethods)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "TRACE":
+		// TRACE would echo the request, credentials and all, back to the
+		// client, so it is refused explicitly rather than by omission.
+		w.Header().Set("Allow", keyMethods)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+
+	default:
+		w.Header().Set("Allow", keyMethods)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	return
+}
+
+// etag returns the ETag of a key at version.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// ifMatch returns the ETag in r's If-Match header, which is "*" if any
+// version will do, or the empty string if there is no header. false is
+// returned if the header does not hold a single ETag.
+func ifMatch(r *http.Request) (string, bool) {
+	h := strings.TrimPrefix(r.Header.Get("If-Match"), "W/")
+	if h == "" || h == "*" {
+		return h, true
+	}
+	v, err := strconv.Unquote(h)
+	if err != nil || !strings.HasPrefix(h, `"`) {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+		return "", false
+	}
+	return v, true
+}
+
+// noneMatch returns whether r's If-None-Match header lists the ETag of a key
+// at version, or is "*", so that the client's copy of the key is current.
+// ETags are compared weakly, as RFC 7232 requires for If-None-Match.
+func noneMatch(r *http.Request, version uint64) bool {
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchVersion returns the version of key a write must find, given the ETag
+// match from ifMatch. "*" matches whichever version key is at, so long as it
+// is present.
+func (s *Service) matchVersion(r *http.Request, key, match string) (uint64, error) {
+	if match != "*" {
+		return strconv.ParseUint(match, 10, 64)
+	}
+	_, version, err := s.storeFor(r).GetWithVersion(r.Context(), key, store.Stale)
+	if err == store.ErrKeyNotFound {
+		return 0, store.ErrVersionMismatch
+	}
+	return version, err
+}
+
+// dryRunSummary lists the keys a write would have set and deleted, had it not
+// been a dry run.
+type dryRunSummary struct {
+	Set    []string `json:"set"`
+	Delete []string `json:"delete"`
+}
+
+// dryRun returns whether r asks for its write to be validated, and the
+// changes it would make reported, without making them.
+func dryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dryRun") == "true"
+}
+
+// writeDryRun writes the summary of a dry run which would have set the keys
+// set, and deleted the keys del. Only keys of del which are present are
+// listed, since deleting others changes nothing.
+func (s *Service) writeDryRun(w http.ResponseWriter, r *http.Request, set, del []string) {
+	summary := dryRunSummary{Set: []string{}, Delete: []string{}}
+	seen := make(map[string]bool)
+	for _, k := range set {
+		if !seen[k] {
+			seen[k] = true
+			summary.Set = append(summary.Set, k)
+		}
+	}
+	seen = make(map[string]bool)
+	for _, k := range del {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		ok, err := s.storeFor(r).Exists(k)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if ok {
+			summary.Delete = append(summary.Delete, k)
+		}
+	}
+	sort.Strings(summary.Set)
+	sort.Strings(summary.Delete)
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// handleKeyAction handles requests of the form /key/{k}/{action}.
+func (s *Service) handleKeyAction(w http.ResponseWriter, r *http.Request, key, action string) {
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "missing key")
+		return
+	}
+	if !s.checkKeys(w, r, key) {
+		return
+	}
+
+	switch action {
+	case "cas":
+		s.handleCompareAndSwap(w, r, key)
+	case "incr":
+		s.handleIncrement(w, r, key)
+	case "append":
+		s.handleAppend(w, r, key)
+	default:
+		writeError(w, http.StatusNotFound, "unknown key action")
+	}
+}
+
+func (s *Service) handleCompareAndSwap(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	var req struct {
+		Old string `json:"old"`
+		New string `json:"new"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !s.checkSchemas(w, r, map[string]string{key: req.New}) {
+		return
+	}
+	if dryRun(r) {
+		// A missing key swaps as if it held the empty string.
+		v, err := s.storeFor(r).Get(key)
+		if err != nil && err != store.ErrKeyNotFound {
+			writeStoreError(w, err)
+			return
+		}
+		var set []string
+		if v == req.Old {
+			set = append(set, key)
+		}
+		s.writeDryRun(w, r, set, nil)
+		return
+	}
+
+	var swapped bool
+	err := s.storeWrite(func() error {
+		var err error
+		swapped, err = s.storeFor(r).CompareAndSwapCtx(r.Context(), key, req.Old, req.New)
+		return err
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+
+	code := http.StatusOK
+	if !swapped {
+		code = http.StatusConflict
+	}
+	writeJSON(w, code, map[string]bool{"swapped": swapped})
+}
+
+// handleKeys returns all keys matching the "prefix" query parameter. Values are
+// included unless "values=false" is given, in which case only the sorted key
+// names are returned.
+func (s *Service) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		s.handleDeletePrefix(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if !s.waitForIndex(w, r) {
+		return
+	}
+
+	// Listing is paginated once the client asks for a page size or a cursor.
+	q := r.URL.Query()
+	if q.Get("limit") != "" || q.Get("after") != "" {
+		s.handleKeysPage(w, r)
+		return
+	}
+
+	m, err := s.storeFor(r).Scan(q.Get("prefix"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	var v interface{} = m
+	if r.URL.Query().Get("values") == "false" {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		v = keys
+	}
+
+	writeJSON(w, http.StatusOK, v)
+}
+
+// handleKeysPage lists a page of keys, without their values, along with the
+// cursor from which the next page should be listed.
+func (s *Service) handleKeysPage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := DefaultPageSize
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	keys, next, err := s.storeFor(r).ScanPage(q.Get("prefix"), q.Get("after"), limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Keys []string `json:"keys"`
+		Next string   `json:"next"`
+	}{keys, next})
+}
+
+// handleKeysMeta lists the size, version and TTL of every key matching the
+// "prefix" query parameter, sorted by key, without their values.
+func (s *Service) handleKeysMeta(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.waitForIndex(w, r) {
+		return
+	}
+
+	meta, err := s.storeFor(r).ScanMeta(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+// handleDeletePrefix deletes every key under the requested prefix. As a
+// guard against wiping the store by mistake, deleting every key must be
+// asked for explicitly.
+func (s *Service) handleDeletePrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" && r.URL.Query().Get("all") != "true" {
+		writeError(w, http.StatusBadRequest, "missing prefix, set all=true to delete every key")
+		return
+	}
+	if dryRun(r) {
+		m, err := s.storeFor(r).Scan(prefix)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		s.writeDryRun(w, r, nil, keys)
+		return
+	}
+
+	var n int
+	err := s.storeWrite(func() error {
+		var err error
+		n, err = s.storeFor(r).DeletePrefixCtx(r.Context(), prefix)
+		return err
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": n})
+}
+
+// handleDeleteMulti deletes the keys given as a JSON array, in one change,
+// responding with how many were present.
+func (s *Service) handleDeleteMulti(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be a JSON array of keys")
+		return
+	}
+	if len(keys) > s.MaxDeleteKeys {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("too many keys, at most %d may be deleted at once", s.MaxDeleteKeys))
+		return
+	}
+	if !s.checkKeys(w, r, keys...) || !s.permitted(w, r, keys...) {
+		return
+	}
+	if dryRun(r) {
+		s.writeDryRun(w, r, nil, keys)
+		return
+	}
+
+	var n int
+	err := s.storeWrite(func() error {
+		var err error
+		n, err = s.storeFor(r).DeleteMultiCtx(r.Context(), keys)
+		return err
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": n})
+}
+
+func (s *Service) handleIncrement(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	var req struct {
+		Delta int64 `json:"delta"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if dryRun(r) {
+		s.dryRunIncrement(w, r, key, req.Delta)
+		return
+	}
+	sc, err := s.schemaFor(namespacedKey(r, key))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if sc != nil {
+		s.incrementChecked(w, r, key, req.Delta)
+		return
+	}
+
+	var n int64
+	err = s.storeWrite(func() error {
+		var err error
+		n, err = s.storeFor(r).IncrementCtx(r.Context(), key, req.Delta)
+		return err
+	})
+	if err == store.ErrNotInteger {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	s.setIndexHeader(w)
+	writeJSON(w, http.StatusOK, map[string]int64{"value": n})
+}
+
+// dryRunIncrement checks that the value at key is an integer, and that adding
+// delta to it gives a value matching its schema, if it has one, without
+// changing it.
+func (s *Service) dryRunIncrement(w http.ResponseWriter, r *http.Request, key string, delta int64) {
+	v, err := s.storeFor(r).Get(key)
+	if err != nil && err != store.ErrKeyNotFound {
+		writeStoreError(w, err)
+		return
+	}
+	var n int64
+	if v != "" {
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, store.ErrNotInteger.Error())
+			return
+		}
+	}
+	if !s.checkSchemas(w, r, map[string]string{key: strconv.FormatInt(n+delta, 10)}) {
+		return
+	}
+	s.writeDryRun(w, r, []string{key}, nil)
+}
+
+// incrementChecked adds delta to the integer value at key, which has a
+// schema. Since the result must be checked against the schema before it is
+// written, the increment is made as a compare-and-swap of the value read,
+// retried until no other write intervenes. Each attempt carries an
+// idempotency key of its own, derived from the request's, so that a retried
+// request replays the attempts already made rather than repeating them.
+func (s *Service) incrementChecked(w http.ResponseWriter, r *http.Request, key string, delta int64) {
+	st := s.storeFor(r)
+	for attempt := 0; ; attempt++ {
+		old, err := st.Get(key)
+		if err == store.ErrKeyNotFound {
+			old = ""
+		} else if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		var n int64
+		if old != "" {
+			if n, err = strconv.ParseInt(old, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, store.ErrNotInteger.Error())
+				return
+			}
+		}
+		n += delta
+		v := strconv.FormatInt(n, 10)
+		if !s.checkSchemas(w, r, map[string]string{key: v}) {
+			return
+		}
+
+		ctx := r.Context()
+		if k := store.IdempotencyKey(ctx); k != "" {
+			ctx = store.WithIdempotencyKey(ctx, k+"#"+strconv.Itoa(attempt))
+		}
+		var swapped bool
+		if err := s.storeWrite(func() error {
+			var err error
+			swapped, err = st.CompareAndSwapCtx(ctx, key, old, v)
+			return err
+		}); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if swapped {
+			s.setIndexHeader(w)
+			writeJSON(w, http.StatusOK, map[string]int64{"value": n})
+			return
+		}
+	}
+}
+
+// handleAppend adds the request body to the end of the value at key, so that
+// clients can upload a value in parts, each within MaxBodySize. Keys with a
+// schema cannot be appended to, since the value is only whole, and so can
+// only be checked against the schema, once the last part is appended.
+func (s *Service) handleAppend(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if sc, err := s.schemaFor(namespacedKey(r, key)); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if sc != nil {
+		writeError(w, http.StatusUnprocessableEntity, "keys with a schema cannot be appended to")
+		return
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxBodySize))
+	if bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if dryRun(r) {
+		s.writeDryRun(w, r, []string{key}, nil)
+		return
+	}
+
+	if err := s.storeWrite(func() error {
+		return s.storeFor(r).AppendCtx(r.Context(), key, string(b))
+	}); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+}
+
+func (s *Service) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	m := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&m); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil || len(m) == 0 {
+		writeError(w, http.StatusBadRequest, "request body must be a non-empty JSON object")
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if !s.checkKeys(w, r, keys...) || !s.permitted(w, r, keys...) || !s.checkSchemas(w, r, m) {
+		return
+	}
+	if dryRun(r) {
+		s.writeDryRun(w, r, keys, nil)
+		return
+	}
+
+	if err := s.storeWrite(func() error {
+		return s.storeFor(r).SetMultiCtx(r.Context(), m)
+	}); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+}
+
+// handleTxn applies the transaction in the request body atomically,
+// responding with whether its comparisons held.
+func (s *Service) handleTxn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	var txn store.Txn
+	if err := json.NewDecoder(r.Body).Decode(&txn); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be a JSON transaction")
+		return
+	}
+	puts := map[string]string{}
+	for _, ops := range [][]store.TxnOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if op.Op == "put" {
+				puts[op.Key] = op.Value
+			}
+		}
+	}
+	keys := txn.Keys()
+	if !s.checkKeys(w, r, keys...) || !s.permitted(w, r, keys...) || !s.checkSchemas(w, r, puts) {
+		return
+	}
+	if dryRun(r) {
+		s.dryRunTxn(w, r, txn)
+		return
+	}
+
+	var succeeded bool
+	err := s.storeWrite(func() error {
+		var err error
+		succeeded, err = s.storeFor(r).Txn(r.Context(), txn)
+		return err
+	})
+	if err == store.ErrInvalidTxn {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.setIndexHeader(w)
+	writeJSON(w, http.StatusOK, map[string]bool{"succeeded": succeeded})
+}
+
+// dryRunTxn reports the changes txn would make, were it applied now, without
+// applying it. Like the store, it treats a missing key as holding the empty
+// string.
+func (s *Service) dryRunTxn(w http.ResponseWriter, r *http.Request, txn store.Txn) {
+	for _, branch := range [][]store.TxnOp{txn.Success, txn.Failure} {
+		for _, op := range branch {
+			if op.Op != "put" && op.Op != "delete" {
+				writeError(w, http.StatusBadRequest, store.ErrInvalidTxn.Error())
+				return
+			}
+		}
+	}
+
+	ops := txn.Success
+	for _, c := range txn.Compares {
+		v, err := s.storeFor(r).Get(c.Key)
+		if err != nil && err != store.ErrKeyNotFound {
+			writeStoreError(w, err)
+			return
+		}
+		if v != c.Value {
+			ops = txn.Failure
+			break
+		}
+	}
+
+	var set, del []string
+	for _, op := range ops {
+		if op.Op == "put" {
+			set = append(set, op.Key)
+		} else {
+			del = append(del, op.Key)
+		}
+	}
+	s.writeDryRun(w, r, set, del)
+}
+
+// handleGetMulti reads the keys given as a JSON array, responding with an
+// object mapping each to its value, or to null if it is not present.
+func (s *Service) handleGetMulti(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodySize)
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); bodyTooLarge(err) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be a JSON array of keys")
+		return
+	}
+	if len(keys) > s.MaxGetKeys {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("too many keys, at most %d may be read at once", s.MaxGetKeys))
+		return
+	}
+	if !s.checkKeys(w, r, keys...) {
+		return
+	}
+
+	if !s.waitForIndex(w, r) {
+		return
+	}
+	m, err := s.storeFor(r).GetMulti(keys)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// validateKey returns an error describing why key may not be used, or nil if
+// it may.
+func (s *Service) validateKey(key string) error {
+	if s.MaxKeyLength > 0 && len(key) > s.MaxKeyLength {
+		return fmt.Errorf("key longer than %d bytes", s.MaxKeyLength)
+	}
+	for _, c := range key {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("key contains control character %q", c)
+		}
+	}
+	if s.KeyPattern != nil && !s.KeyPattern.MatchString(key) {
+		return fmt.Errorf("key does not match pattern %s", s.KeyPattern)
+	}
+	return nil
+}
+
+// checkKeys writes a 400 response, and returns false, if any of keys, named
+// in request r, may not be used, or a 403 response if any is reserved for
+// schemas, which may only be changed through /schema/, where they are
+// checked.
+func (s *Service) checkKeys(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	for _, k := range keys {
+		if err := s.validateKey(k); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+		if strings.HasPrefix(namespacedKey(r, k), schemaKeyPrefix) {
+			writeError(w, http.StatusForbidden, "keys under "+schemaKeyPrefix+" are reserved for schemas")
+			return false
+		}
+	}
+	return true
+}
+
+// storeErrorCode returns the status code for a failed store operation. An
+// operation abandoned because the request timed out, the client went away, or
+// the change took too long to apply, is not an internal error.
+func storeErrorCode(err error) int {
+	// Errors are matched through any wrapping, so that a store operation
+	// which timed out is not mistaken for one which failed.
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, store.ErrApplyTimeout), errors.Is(err, context.Canceled),
+		errors.Is(err, errBreakerOpen), errors.Is(err, store.ErrMaintenance):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, store.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, store.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeStoreError writes the error response for a failed store operation.
+// Clients are asked to retry changes which timed out being applied, as the
+// cluster is likely only briefly overloaded.
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrApplyTimeout) {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeError(w, storeErrorCode(err), err.Error())
+}
+
+// bodyTooLarge returns whether err was returned by a reader created by
+// http.MaxBytesReader, because the request body exceeded the limit.
+func bodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// setIndexHeader tells the client, via the X-Raft-Index header, a log index
+// which includes its write, so that it can later ask any node to reflect the
+// write when reading. The store has applied the write by the time this is
+// called, so its applied index is at least that of the write.
+func (s *Service) setIndexHeader(w http.ResponseWriter) {
+	w.Header().Set("X-Raft-Index", strconv.FormatUint(s.store.AppliedIndex(), 10))
+}
+
+// waitForIndex waits until the store has applied the log index given by r's
+// X-Min-Raft-Index header, if any. If the header is invalid, or the index is
+// not applied within IndexWaitTimeout, an error is written and false returned.
+func (s *Service) waitForIndex(w http.ResponseWriter, r *http.Request) bool {
+	h := r.Header.Get("X-Min-Raft-Index")
+	if h == "" {
+		return true
+	}
+	min, err := strconv.ParseUint(h, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid X-Min-Raft-Index header")
+		return false
+	}
+
+	timeout := time.NewTimer(s.IndexWaitTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(indexPollInterval)
+	defer ticker.Stop()
+	for s.store.AppliedIndex() < min {
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			writeError(w, http.StatusServiceUnavailable, "timed out waiting for log index to be applied")
+			return false
+		case <-r.Context().Done():
+			writeError(w, storeErrorCode(r.Context().Err()), r.Context().Err().Error())
+			return false
+		}
+	}
+	return true
+}
+
+// ttlHeader returns the TTL requested by r, which is zero if none was. It
+// returns false if the header is present but not a positive number of seconds.
+func ttlHeader(r *http.Request) (time.Duration, bool) {
+	h := r.Header.Get("X-TTL-Seconds")
+	if h == "" {
+		return 0, true
+	}
+	secs, err := strconv.Atoi(h)
+	if err != nil || secs <= 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// consistencyLevel returns the read consistency level requested by r. If no
+// level is requested the read is served locally, as if stale was given.
+func consistencyLevel(r *http.Request) (store.ConsistencyLevel, bool) {
+	switch r.URL.Query().Get("consistency") {
+	case "", "stale":
+		return store.Stale, true
+	case "default":
+		return store.Default, true
+	case "strong":
+		return store.Strong, true
+	default:
+		return store.Stale, false
+	}
+}
+
+// writeJSON writes v, encoded as JSON, as the response body with the given
+// status code. If v cannot be encoded a 500 is written instead, and the
+// encoding error is returned.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	return nil
+}
+
+// writeError writes a JSON error response, carrying msg and the status code.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}{msg, code})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
 }
 
 // Addr returns the address on which the Service is listening
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
 }
+
+// PlainListenAddr returns the address of the additional plain HTTP listener, or nil
+// if there is none.
+func (s *Service) PlainListenAddr() net.Addr {
+	if s.plainLn == nil {
+		return nil
+	}
+	return s.plainLn.Addr()
+}
@@ -1,20 +1,53 @@
 package httpd
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/otoolep/hraftd/logging"
+	"github.com/otoolep/hraftd/metrics"
+	"github.com/otoolep/hraftd/store"
+	"github.com/otoolep/hraftd/version"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
 )
 
 // Test_NewServer tests that a server can perform all basic operations.
 func Test_NewServer(t *testing.T) {
 	store := newTestStore()
-	s := &testServer{New(":0", store)}
+	s := &testServer{New(":0", store, nil)}
 	if s == nil {
 		t.Fatal("failed to create HTTP service")
 	}
@@ -24,8 +57,8 @@ func Test_NewServer(t *testing.T) {
 	}
 
 	b := doGet(t, s.URL(), "k1")
-	if string(b) != `{"k1":""}` {
-		t.Fatalf("wrong value received for key k1: %s (expected empty string)", string(b))
+	if string(b) != `{"error":"key not found","code":404}` {
+		t.Fatalf("wrong response received for missing key k1: %s", string(b))
 	}
 
 	doPost(t, s.URL(), "k1", "v1")
@@ -43,47 +76,3980 @@ func Test_NewServer(t *testing.T) {
 
 	doDelete(t, s.URL(), "k2")
 	b = doGet(t, s.URL(), "k2")
-	if string(b) != `{"k2":""}` {
-		t.Fatalf(`wrong value received for key k2: %s (expected empty string)`, string(b))
+	if string(b) != `{"error":"key not found","code":404}` {
+		t.Fatalf(`wrong response received for deleted key k2: %s`, string(b))
 	}
 
 }
 
-type testServer struct {
-	*Service
+// Test_GetEmptyKey tests that a GET without a key is rejected exactly once.
+func Test_GetEmptyKey(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	w := &countingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest("GET", "/key/", nil)
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusBadRequest)
+	}
+	if w.headerWrites != 1 {
+		t.Fatalf("header written %d times (expected 1)", w.headerWrites)
+	}
+	if w.Body.String() != `{"error":"missing key","code":400}` {
+		t.Fatalf("wrong body received: %s", w.Body.String())
+	}
 }
 
-func (t *testServer) URL() string {
-	port := strings.TrimLeft(t.Addr().String(), "[::]:")
-	return fmt.Sprintf("http://127.0.0.1:%s", port)
+// Test_DeleteCallsStoreOnce tests that a single DELETE results in a single store delete.
+func Test_DeleteCallsStoreOnce(t *testing.T) {
+	store := newTestStore()
+	store.m["k1"] = "v1"
+	s := New(":0", store, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/key/k1", nil)
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if store.deleteCalls != 1 {
+		t.Fatalf("store delete called %d times (expected 1)", store.deleteCalls)
+	}
+	if _, ok := store.m["k1"]; ok {
+		t.Fatalf("key k1 still present after delete")
+	}
 }
 
-type testStore struct {
-	m map[string]string
+// Test_BatchSet tests that a batch write sets all keys in a single store call.
+func Test_BatchSet(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/keys/batch", strings.NewReader(`{"a":"1","b":"2"}`))
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if store.setMultiCalls != 1 {
+		t.Fatalf("store set multi called %d times (expected 1)", store.setMultiCalls)
+	}
+	if store.m["a"] != "1" || store.m["b"] != "2" {
+		t.Fatalf("wrong values stored: %v", store.m)
+	}
+
+	for _, body := range []string{`{}`, ``} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", "/keys/batch", strings.NewReader(body))
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status code received for body %q: %d (expected %d)", body, w.Code, http.StatusBadRequest)
+		}
+	}
 }
 
-func newTestStore() *testStore {
-	return &testStore{
-		m: make(map[string]string),
+// Test_Txn tests that a transaction applies its success ops if its comparisons
+// hold, and its failure ops otherwise.
+func Test_Txn(t *testing.T) {
+	st := newTestStore()
+	st.m["a"] = "1"
+	s := New(":0", st, nil)
+
+	body := `{"compare":[{"key":"a","value":"1"}],
+		"success":[{"op":"put","key":"b","value":"2"},{"op":"delete","key":"a"}],
+		"failure":[{"op":"put","key":"failed","value":"yes"}]}`
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/txn", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if exp := `{"succeeded":true}`; strings.TrimSpace(w.Body.String()) != exp {
+		t.Fatalf("wrong body received: %s (expected %s)", w.Body.String(), exp)
+	}
+	if _, ok := st.m["a"]; ok || st.m["b"] != "2" {
+		t.Fatalf("success ops not applied: %v", st.m)
+	}
+
+	// a was deleted, so the comparison now fails.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/txn", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if exp := `{"succeeded":false}`; strings.TrimSpace(w.Body.String()) != exp {
+		t.Fatalf("wrong body received: %s (expected %s)", w.Body.String(), exp)
+	}
+	if st.m["failed"] != "yes" {
+		t.Fatalf("failure ops not applied: %v", st.m)
+	}
+
+	for _, body := range []string{``, `{"success":[{"op":"frob","key":"a"}]}`} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/txn", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status code received for body %q: %d (expected %d)", body, w.Code, http.StatusBadRequest)
+		}
 	}
 }
 
-func (t *testStore) Get(key string) (string, error) {
-	return t.m[key], nil
+// Test_Leader tests that a node reports whether it is the leader, and where
+// the leader is.
+func Test_Leader(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	tests := []struct {
+		follower   bool
+		leaderHTTP string
+		exp        string
+	}{
+		{false, "10.0.0.1:11000", `{"isLeader":true,"leader":"http://10.0.0.1:11000"}`},
+		{true, "10.0.0.2:11000", `{"isLeader":false,"leader":"http://10.0.0.2:11000"}`},
+		{true, "", `{"isLeader":false,"leader":""}`},
+	}
+	for _, tt := range tests {
+		st.follower = tt.follower
+		st.leaderHTTP = tt.leaderHTTP
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/leader", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != tt.exp {
+			t.Fatalf("wrong leader reported: %s (expected %s)", got, tt.exp)
+		}
+	}
 }
 
-func (t *testStore) Set(key, value string) error {
-	t.m[key] = value
-	return nil
+// Test_GetAtIndex tests that each retained version of a key can be read, and
+// that pruned versions, unknown keys and unapplied indexes are reported.
+func Test_GetAtIndex(t *testing.T) {
+	st := newTestStore()
+	st.history = map[string]map[uint64]string{"foo": {10: "a", 20: "b", 30: "c"}}
+	st.index = 30
+	s := New(":0", st, nil)
+
+	for _, tt := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/key/foo?atIndex=10", http.StatusOK, `{"foo":"a"}`},
+		{"/key/foo?atIndex=25", http.StatusOK, `{"foo":"b"}`},
+		{"/key/foo?atIndex=30", http.StatusOK, `{"foo":"c"}`},
+		{"/key/foo?atIndex=5", http.StatusGone, ""},
+		{"/key/bar?atIndex=10", http.StatusNotFound, ""},
+		{"/key/foo?atIndex=31", http.StatusBadRequest, ""},
+		{"/key/foo?atIndex=x", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s: %d (expected %d)", tt.path, w.Code, tt.code)
+		}
+		if tt.body != "" && strings.TrimSpace(w.Body.String()) != tt.body {
+			t.Fatalf("wrong body received for %s: %s (expected %s)", tt.path, w.Body.String(), tt.body)
+		}
+	}
 }
 
-func (t *testStore) Delete(key string) error {
-	delete(t.m, key)
-	return nil
+// Test_GetMulti tests that several keys can be read at once, with absent keys
+// mapped to null, and that reads of too many keys are rejected.
+func Test_GetMulti(t *testing.T) {
+	st := newTestStore()
+	st.follower = true
+	st.m["a"] = "1"
+	st.m["b"] = "2"
+	s := New(":0", st, nil)
+	s.MaxGetKeys = 3
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/keys/get", strings.NewReader(`["a","b","c"]`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if exp := `{"a":"1","b":"2","c":null}`; w.Body.String() != exp {
+		t.Fatalf("wrong body received: %s (expected %s)", w.Body.String(), exp)
+	}
+
+	for _, body := range []string{`["a","b","c","d"]`, `{"a":"1"}`} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/keys/get", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status code received for body %s: %d (expected %d)", body, w.Code, http.StatusBadRequest)
+		}
+	}
 }
 
-func (t *testStore) Join(nodeID, addr string) error {
-	return nil
+// Test_Msgpack tests that keys can be set and read as msgpack, chosen by the
+// Content-Type and Accept headers.
+func Test_Msgpack(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	b, err := msgpackCodec{}.Marshal(map[string]string{"k1": "v1"})
+	if err != nil {
+		t.Fatalf("failed to encode msgpack: %s", err)
+	}
+	r := httptest.NewRequest("POST", "/key", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/msgpack")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for msgpack POST: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if st.m["k1"] != "v1" {
+		t.Fatalf("wrong value stored: %q", st.m["k1"])
+	}
+
+	r = httptest.NewRequest("GET", "/key/k1", nil)
+	r.Header.Set("Accept", "text/html, application/msgpack;q=0.9")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Fatalf("wrong content type received: %s", ct)
+	}
+	m := map[string]string{}
+	if err := (msgpackCodec{}).Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("failed to decode msgpack response: %s", err)
+	}
+	if m["k1"] != "v1" {
+		t.Fatalf("wrong value received: %v", m)
+	}
+
+	// JSON is used when no supported type is accepted.
+	r = httptest.NewRequest("GET", "/key/k1", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Body.String() != `{"k1":"v1"}` {
+		t.Fatalf("wrong body received: %s", w.Body.String())
+	}
+}
+
+// Test_CompareAndSwap tests that CAS swaps on a matching value and conflicts otherwise.
+func Test_CompareAndSwap(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		body string
+		code int
+		resp string
+		val  string
+	}{
+		// A missing key is treated as holding the empty string.
+		{`{"old":"","new":"v1"}`, http.StatusOK, `{"swapped":true}`, "v1"},
+		{`{"old":"v1","new":"v2"}`, http.StatusOK, `{"swapped":true}`, "v2"},
+		{`{"old":"v1","new":"v3"}`, http.StatusConflict, `{"swapped":false}`, "v2"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/key/k1/cas", strings.NewReader(tt.body))
+		s.ServeHTTP(w, r)
+
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s: %d (expected %d)", tt.body, w.Code, tt.code)
+		}
+		if w.Body.String() != tt.resp {
+			t.Fatalf("wrong response received for %s: %s (expected %s)", tt.body, w.Body.String(), tt.resp)
+		}
+		if store.m["k1"] != tt.val {
+			t.Fatalf("wrong value stored for %s: %s (expected %s)", tt.body, store.m["k1"], tt.val)
+		}
+	}
+}
+
+// Test_KeyExistence tests that GET and HEAD distinguish missing keys from empty ones.
+func Test_KeyExistence(t *testing.T) {
+	store := newTestStore()
+	store.m["empty"] = ""
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		method string
+		key    string
+		code   int
+	}{
+		{"HEAD", "empty", http.StatusOK},
+		{"HEAD", "missing", http.StatusNotFound},
+		{"GET", "empty", http.StatusOK},
+		{"GET", "missing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, "/key/"+tt.key, nil)
+		s.ServeHTTP(w, r)
+
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s %s: %d (expected %d)", tt.method, tt.key, w.Code, tt.code)
+		}
+		if tt.method == "HEAD" && w.Body.Len() != 0 {
+			t.Fatalf("unexpected body received for HEAD %s: %s", tt.key, w.Body.String())
+		}
+	}
+
+	// A key explicitly set to "" reads back as such, while one never set
+	// is not found.
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/a", strings.NewReader("")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received setting empty value: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/a", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for empty value: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if exp := `{"a":""}`; strings.TrimSpace(w.Body.String()) != exp {
+		t.Fatalf("wrong body received for empty value: %s (expected %s)", w.Body.String(), exp)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/b", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("wrong status code received for unset key: %d (expected %d)", w.Code, http.StatusNotFound)
+	}
+}
+
+// Test_ScanKeys tests that a prefix scan returns only matching keys.
+func Test_ScanKeys(t *testing.T) {
+	store := newTestStore()
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			store.m[fmt.Sprintf("group/%02d", i)] = "g"
+		} else {
+			store.m[fmt.Sprintf("user/%02d", i)] = "u"
+		}
+	}
+	s := New(":0", store, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/keys?prefix=user/", nil)
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	m := map[string]string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("failed to decode scan response: %s", err)
+	}
+	if len(m) != 50 {
+		t.Fatalf("wrong number of keys received: %d (expected 50)", len(m))
+	}
+	for k, v := range m {
+		if !strings.HasPrefix(k, "user/") || v != "u" {
+			t.Fatalf("unexpected key received: %s=%s", k, v)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/keys?prefix=group/&values=false", nil)
+	s.ServeHTTP(w, r)
+	var keys []string
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil {
+		t.Fatalf("failed to decode scan response: %s", err)
+	}
+	if len(keys) != 50 || keys[0] != "group/00" || keys[49] != "group/98" {
+		t.Fatalf("wrong keys received: %v", keys)
+	}
+}
+
+// Test_SetWithTTL tests that the TTL header is passed through to the store.
+func Test_SetWithTTL(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1":"v1"}`))
+	r.Header.Set("X-TTL-Seconds", "60")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if store.m["k1"] != "v1" || store.ttl["k1"] != 60*time.Second {
+		t.Fatalf("wrong value or TTL stored: %s, %s", store.m["k1"], store.ttl["k1"])
+	}
+
+	for _, h := range []string{"0", "-1", "soon"} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", "/key", strings.NewReader(`{"k2":"v2"}`))
+		r.Header.Set("X-TTL-Seconds", h)
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status code received for TTL %q: %d (expected %d)", h, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// Test_Increment tests that increments return the new value, and reject non-integers.
+func Test_Increment(t *testing.T) {
+	store := newTestStore()
+	store.m["name"] = "bob"
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		key  string
+		body string
+		code int
+		resp string
+	}{
+		{"counter", `{"delta":5}`, http.StatusOK, `{"value":5}`},
+		{"counter", `{"delta":-2}`, http.StatusOK, `{"value":3}`},
+		{"counter", `{"delta":"x"}`, http.StatusBadRequest, `{"error":"invalid request body","code":400}`},
+		{"name", `{"delta":1}`, http.StatusBadRequest, `{"error":"value is not an integer","code":400}`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/key/"+tt.key+"/incr", strings.NewReader(tt.body))
+		s.ServeHTTP(w, r)
+
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s: %d (expected %d)", tt.body, w.Code, tt.code)
+		}
+		if w.Body.String() != tt.resp {
+			t.Fatalf("wrong response received for %s: %s (expected %s)", tt.body, w.Body.String(), tt.resp)
+		}
+	}
+}
+
+// Test_Append tests that a value can be assembled from appended chunks.
+func Test_Append(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	for _, chunk := range []string{"abc", "def", "gh"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/key/foo/append", strings.NewReader(chunk)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("failed to append %s: %d", chunk, w.Code)
+		}
+	}
+	if v := st.m["foo"]; v != "abcdefgh" {
+		t.Fatalf("wrong value after appends: %s", v)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/foo/append", strings.NewReader("x")))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("wrong status code received for PUT: %d (expected %d)", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	st.err = store.ErrValueTooLarge
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/key/foo/append", strings.NewReader("x")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("wrong status code received past limit: %d (expected %d)", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// Test_JSONContentType tests that JSON responses carry the JSON content type.
+func Test_JSONContentType(t *testing.T) {
+	store := newTestStore()
+	store.m["k1"] = "v1"
+	s := New(":0", store, nil)
+
+	for _, path := range []string{"/key/k1", "/keys?prefix=k"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		s.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong status code received for %s: %d (expected %d)", path, w.Code, http.StatusOK)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("wrong content type received for %s: %s", path, ct)
+		}
+	}
+}
+
+// Test_CloseDrainsRequests tests that Close waits for an in-flight request to complete.
+func Test_CloseDrainsRequests(t *testing.T) {
+	store := newTestStore()
+	store.setDelay = 500 * time.Millisecond
+	s := &testServer{New(":0", store, nil)}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+
+	codeCh := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(fmt.Sprintf("%s/key", s.URL()), "application-type/json", strings.NewReader(`{"k1":"v1"}`))
+		if err != nil {
+			t.Errorf("POST request failed: %s", err)
+			codeCh <- 0
+			return
+		}
+		defer resp.Body.Close()
+		codeCh <- resp.StatusCode
+	}()
+
+	// Give the request time to reach the store before closing.
+	time.Sleep(100 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close HTTP service: %s", err)
+	}
+
+	if code := <-codeCh; code != http.StatusOK {
+		t.Fatalf("wrong status code received for in-flight request: %d (expected %d)", code, http.StatusOK)
+	}
+	if store.m["k1"] != "v1" {
+		t.Fatalf("in-flight write not applied")
+	}
+}
+
+// signalStore is a Store recording, on each leadership transfer, whether the
+// service was already closing.
+type signalStore struct {
+	*testStore
+	transfer func()
+}
+
+func (st signalStore) TransferLeadership(target string) error {
+	st.transfer()
+	return st.testStore.TransferLeadership(target)
+}
+
+// Test_HandleSignals tests that, on a signal, the leader hands over
+// leadership before the service is closed, and that followers just close.
+func Test_HandleSignals(t *testing.T) {
+	for _, follower := range []bool{false, true} {
+		var steps []string
+		var s *Service
+		st := signalStore{testStore: newTestStore()}
+		st.follower = follower
+		st.transfer = func() {
+			select {
+			case <-s.closing:
+				steps = append(steps, "transfer after close")
+			default:
+				steps = append(steps, "transfer")
+			}
+		}
+		s = New("127.0.0.1:0", st, logging.New(ioutil.Discard, ""))
+		s.HandleSignals = true
+		if err := s.Start(); err != nil {
+			t.Fatalf("failed to start HTTP service: %s", err)
+		}
+
+		s.signals <- syscall.SIGTERM
+		select {
+		case <-s.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("service not shut down after signal")
+		}
+		steps = append(steps, "closed")
+
+		exp := []string{"transfer", "closed"}
+		if follower {
+			exp = []string{"closed"}
+		}
+		if !reflect.DeepEqual(steps, exp) {
+			t.Fatalf("wrong shutdown sequence for follower=%v: %v (expected %v)", follower, steps, exp)
+		}
+		if _, err := http.Get("http://" + s.Addr().String() + "/status"); err == nil {
+			t.Fatalf("service still serving after shutdown")
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("failed to close service again: %s", err)
+		}
+	}
+}
+
+// Test_CloseNoError tests that closing a service is not reported as a
+// failure, while a listener failing is.
+func Test_CloseNoError(t *testing.T) {
+	s := New(":0", newTestStore(), nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close HTTP service: %s", err)
+	}
+	select {
+	case err := <-s.Err():
+		t.Fatalf("error reported after close: %s", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s = New(":0", newTestStore(), nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+	s.ln.Close()
+	select {
+	case err := <-s.Err():
+		if err == nil {
+			t.Fatalf("nil error reported for failed listener")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("failed listener not reported")
+	}
+}
+
+// Test_MultipleServices tests that more than one service can run in a process.
+func Test_MultipleServices(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		store := newTestStore()
+		store.m["k1"] = fmt.Sprintf("v%d", i)
+		s := &testServer{New(":0", store, nil)}
+		if err := s.Start(); err != nil {
+			t.Fatalf("failed to start HTTP service %d: %s", i, err)
+		}
+		defer s.Close()
+
+		b := doGet(t, s.URL(), "k1")
+		if exp := fmt.Sprintf(`{"k1":"v%d"}`, i); b != exp {
+			t.Fatalf("wrong value received from service %d: %s (expected %s)", i, b, exp)
+		}
+	}
+}
+
+// Test_HealthAndReady tests that health and readiness reflect the store state.
+func Test_HealthAndReady(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		leader    string
+		ready     bool
+		health    int
+		readyCode int
+	}{
+		{"", false, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"127.0.0.1:12000", false, http.StatusOK, http.StatusServiceUnavailable},
+		{"127.0.0.1:12000", true, http.StatusOK, http.StatusOK},
+	}
+	for _, tt := range tests {
+		store.leader = tt.leader
+		store.ready = tt.ready
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != tt.health {
+			t.Fatalf("wrong health status for leader %q: %d (expected %d)", tt.leader, w.Code, tt.health)
+		}
+
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+		if w.Code != tt.readyCode {
+			t.Fatalf("wrong ready status for ready %v: %d (expected %d)", tt.ready, w.Code, tt.readyCode)
+		}
+	}
+}
+
+// Test_RequestID tests that a request's ID is echoed in the response, is
+// generated if absent, and is passed on when a write is forwarded.
+func Test_RequestID(t *testing.T) {
+	leader := &testServer{New(":0", newTestStore(), nil)}
+	if err := leader.Start(); err != nil {
+		t.Fatalf("failed to start leader HTTP service: %s", err)
+	}
+	defer leader.Close()
+
+	followerStore := newTestStore()
+	followerStore.follower = true
+	followerStore.leaderHTTP = strings.TrimPrefix(leader.URL(), "http://")
+	follower := New(":0", followerStore, nil)
+
+	w := httptest.NewRecorder()
+	follower.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if id := w.Header().Get("X-Request-ID"); len(id) != 32 {
+		t.Fatalf("wrong request ID generated: %q", id)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1":"v1"}`))
+	r.Header.Set("X-Request-ID", "abc123")
+	follower.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for forwarded write: %d", w.Code)
+	}
+	// The leader's response headers are relayed, so the ID is only echoed if
+	// the leader received it.
+	if id := w.Header().Get("X-Request-ID"); id != "abc123" {
+		t.Fatalf("wrong request ID echoed: %q", id)
+	}
+}
+
+// Test_ForwardWrites tests that a follower forwards writes to the leader, once.
+func Test_ForwardWrites(t *testing.T) {
+	leaderStore := newTestStore()
+	leader := &testServer{New(":0", leaderStore, nil)}
+	if err := leader.Start(); err != nil {
+		t.Fatalf("failed to start leader HTTP service: %s", err)
+	}
+	defer leader.Close()
+
+	followerStore := newTestStore()
+	followerStore.follower = true
+	followerStore.leaderHTTP = strings.TrimPrefix(leader.URL(), "http://")
+	follower := New(":0", followerStore, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1":"v1"}`))
+	follower.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for forwarded write: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if leaderStore.m["k1"] != "v1" {
+		t.Fatalf("forwarded write not applied on leader")
+	}
+	if _, ok := followerStore.m["k1"]; ok {
+		t.Fatalf("forwarded write applied on follower")
+	}
+
+	// Reads are served locally.
+	followerStore.m["k2"] = "v2"
+	w = httptest.NewRecorder()
+	follower.ServeHTTP(w, httptest.NewRequest("GET", "/key/k2", nil))
+	if w.Body.String() != `{"k2":"v2"}` {
+		t.Fatalf("wrong value received for local read: %s", w.Body.String())
+	}
+
+	// An already-forwarded write must not be forwarded again.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/key", strings.NewReader(`{"k3":"v3"}`))
+	r.Header.Set("X-Forwarded-By", "127.0.0.1:11001")
+	follower.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received for re-forwarded write: %d (expected %d)", w.Code, http.StatusServiceUnavailable)
+	}
+	if _, ok := leaderStore.m["k3"]; ok {
+		t.Fatalf("re-forwarded write applied on leader")
+	}
+
+	followerStore.leaderHTTP = ""
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/key", strings.NewReader(`{"k4":"v4"}`))
+	follower.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received with no leader: %d (expected %d)", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("no Retry-After header received with no leader")
+	}
+}
+
+// Test_RedirectWrites tests that a follower redirects writes to the leader when configured to.
+func Test_RedirectWrites(t *testing.T) {
+	store := newTestStore()
+	store.follower = true
+	store.leaderHTTP = "127.0.0.1:11000"
+	s := New(":0", store, nil)
+	s.RedirectWrites = true
+
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/key/k1?a=b", strings.NewReader(`{"k1":"v1"}`))
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("wrong status code received for %s: %d (expected %d)", method, w.Code, http.StatusTemporaryRedirect)
+		}
+		if loc := w.Header().Get("Location"); loc != "http://127.0.0.1:11000/key/k1?a=b" {
+			t.Fatalf("wrong location received for %s: %s", method, loc)
+		}
+	}
+	if len(store.m) != 0 || store.deleteCalls != 0 {
+		t.Fatalf("redirected write applied on follower")
+	}
+
+	store.leaderHTTP = ""
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1":"v1"}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received with no leader: %d (expected %d)", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("no Retry-After header received with no leader")
+	}
+}
+
+// Test_BasePath tests that, with a base path, requests under it are routed
+// with it removed, bare paths are not found, and redirects keep it.
+func Test_BasePath(t *testing.T) {
+	st := newTestStore()
+	st.m["foo"] = "bar"
+	s := New(":0", st, nil)
+	s.BasePath = "/hraftd"
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/hraftd/key/foo", http.StatusOK},
+		{"GET", "/hraftd/status", http.StatusOK},
+		{"GET", "/key/foo", http.StatusNotFound},
+		{"GET", "/status", http.StatusNotFound},
+		{"GET", "/hraftdkey/foo", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s %s: %d (expected %d)", tt.method, tt.path, w.Code, tt.code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/hraftd/key/foo", nil))
+	if exp := `{"foo":"bar"}`; strings.TrimSpace(w.Body.String()) != exp {
+		t.Fatalf("wrong body received: %s (expected %s)", w.Body.String(), exp)
+	}
+
+	st.follower = true
+	st.leaderHTTP = "127.0.0.1:11000"
+	s.RedirectWrites = true
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/hraftd/key/foo", strings.NewReader("baz")))
+	if loc := w.Header().Get("Location"); loc != "http://127.0.0.1:11000/hraftd/key/foo" {
+		t.Fatalf("wrong location received: %s", loc)
+	}
+}
+
+// Test_ReadConsistency tests that consistency levels are passed to the store, and
+// that a follower rejects reads which require the leader.
+func Test_ReadConsistency(t *testing.T) {
+	store := newTestStore()
+	store.m["k1"] = "v1"
+	store.follower = true
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusOK},
+		{"?consistency=stale", http.StatusOK},
+		{"?consistency=default", http.StatusServiceUnavailable},
+		{"?consistency=strong", http.StatusServiceUnavailable},
+		{"?consistency=eventual", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/key/k1"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %q: %d (expected %d)", tt.query, w.Code, tt.code)
+		}
+	}
+
+	store.follower = false
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/k1?consistency=strong", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for strong read on leader: %d (expected %d)", w.Code, http.StatusOK)
+	}
+}
+
+// Test_JoinLeave tests that a node can join and then leave the cluster.
+func Test_JoinLeave(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/join", strings.NewReader(`{"id":"node1","addr":"127.0.0.1:12001"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for join: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if len(store.nodes) != 1 {
+		t.Fatalf("wrong number of nodes after join: %d (expected 1)", len(store.nodes))
+	}
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"id":"node2"}`, http.StatusNotFound},
+		{`{"node":"node1"}`, http.StatusBadRequest},
+		{`{"id":"node1"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/leave", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for leave %s: %d (expected %d)", tt.body, w.Code, tt.code)
+		}
+	}
+	if len(store.nodes) != 0 {
+		t.Fatalf("wrong number of nodes after leave: %d (expected 0)", len(store.nodes))
+	}
+}
+
+// Test_JoinVoter tests that nodes join as voters unless asked otherwise.
+func Test_JoinVoter(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	tests := []struct {
+		body  string
+		code  int
+		id    string
+		voter bool
+	}{
+		{`{"id":"node1","addr":"127.0.0.1:12001"}`, http.StatusOK, "node1", true},
+		{`{"id":"node2","addr":"127.0.0.1:12002","voter":true}`, http.StatusOK, "node2", true},
+		{`{"id":"node3","addr":"127.0.0.1:12003","httpAddr":"127.0.0.1:11003","voter":false}`, http.StatusOK, "node3", false},
+		{`{"id":"node4","addr":"127.0.0.1:12004","voter":"false"}`, http.StatusBadRequest, "", false},
+		{`{"id":"node4","addr":12004}`, http.StatusBadRequest, "", false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/join", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for join %s: %d (expected %d)", tt.body, w.Code, tt.code)
+		}
+		if tt.id == "" {
+			continue
+		}
+		if voter, ok := st.voter[tt.id]; !ok || voter != tt.voter {
+			t.Fatalf("node %s joined with wrong suffrage: voter %t (expected %t)", tt.id, voter, tt.voter)
+		}
+	}
+	if _, ok := st.nodes["node4"]; ok {
+		t.Fatalf("node joined despite invalid request")
+	}
+}
+
+// Test_Promote tests that a non-voter is promoted only once it has caught up
+// with the leader.
+func Test_Promote(t *testing.T) {
+	replica := newTestStore()
+	rs := New(":0", replica, nil)
+	if err := rs.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer rs.Close()
+	atomic.StoreUint64(&replica.index, 100)
+
+	st := newTestStore()
+	st.servers = []store.ServerInfo{
+		{ID: "node0", Address: "127.0.0.1:12000", Suffrage: "voter", Leader: true},
+		{ID: "node3", Address: "127.0.0.1:12003", Suffrage: "nonvoter"},
+	}
+	st.nodeHTTP = map[string]string{"node3": rs.Addr().String()}
+	s := New(":0", st, nil)
+	s.PromoteMaxLag = 50
+
+	promote := func(body string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/promote", strings.NewReader(body)))
+		return w.Code
+	}
+
+	atomic.StoreUint64(&st.index, 200)
+	if code := promote(`{"id":"node3"}`); code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received for lagging node: %d", code)
+	}
+	if code := promote(`{"id":"node0"}`); code != http.StatusNotFound {
+		t.Fatalf("wrong status code received for voter: %d", code)
+	}
+	if code := promote(`{}`); code != http.StatusBadRequest {
+		t.Fatalf("wrong status code received for missing id: %d", code)
+	}
+
+	atomic.StoreUint64(&st.index, 120)
+	if code := promote(`{"id":"node3"}`); code != http.StatusOK {
+		t.Fatalf("wrong status code received for promotion: %d", code)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/cluster", nil))
+	if !strings.Contains(w.Body.String(), `{"id":"node3","address":"127.0.0.1:12003","suffrage":"voter"`) {
+		t.Fatalf("node not promoted: %s", w.Body.String())
+	}
+}
+
+// Test_TransferLeadership tests that leadership is handed to the node given,
+// if any, and that failures are reported.
+func Test_TransferLeadership(t *testing.T) {
+	st := newTestStore()
+	st.nodes["node2"] = "127.0.0.1:12002"
+	s := New(":0", st, nil)
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{``, http.StatusOK},
+		{`{"id":"node2"}`, http.StatusOK},
+		{`{"id":"node3"}`, http.StatusNotFound},
+		{`{"id":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/leadership/transfer", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for transfer %q: %d (expected %d)", tt.body, w.Code, tt.code)
+		}
+	}
+	if len(st.transfers) != 2 || st.transfers[0] != "" || st.transfers[1] != "node2" {
+		t.Fatalf("wrong transfers made: %q", st.transfers)
+	}
+
+	st.err = fmt.Errorf("leadership transfer timeout")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/leadership/transfer", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received for timed out transfer: %d", w.Code)
+	}
+
+	st.follower = true
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/leadership/transfer", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("wrong status code received for transfer on follower: %d", w.Code)
+	}
+}
+
+// Test_Cluster tests that cluster membership is returned as JSON.
+func Test_Cluster(t *testing.T) {
+	st := newTestStore()
+	st.servers = []store.ServerInfo{
+		{ID: "node0", Address: "127.0.0.1:12000", Suffrage: "voter", Leader: true},
+		{ID: "node1", Address: "127.0.0.1:12001", Suffrage: "nonvoter"},
+	}
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/cluster", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	exp := `{"servers":[{"id":"node0","address":"127.0.0.1:12000","suffrage":"voter","leader":true},` +
+		`{"id":"node1","address":"127.0.0.1:12001","suffrage":"nonvoter","leader":false}]}`
+	if w.Body.String() != exp {
+		t.Fatalf("wrong cluster received: %s (expected %s)", w.Body.String(), exp)
+	}
+}
+
+// Test_Replication tests that the leader reports how far each follower is
+// behind, and that followers refuse to.
+func Test_Replication(t *testing.T) {
+	st := newTestStore()
+	now := time.Now()
+	stale := now.Add(-time.Minute)
+	st.replication = []store.FollowerReplication{
+		{ID: "node1", Address: "localhost:12001", LastContact: &now, MatchIndex: 100, Lag: 0},
+		{ID: "node2", Address: "localhost:12002", LastContact: &stale, MatchIndex: 40, Lag: 60},
+	}
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/replication", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	var resp struct {
+		Followers []struct {
+			ID          string    `json:"id"`
+			LastContact time.Time `json:"lastContact"`
+			Lag         uint64    `json:"lag"`
+		} `json:"followers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(resp.Followers) != 2 {
+		t.Fatalf("wrong number of followers: %s", w.Body.String())
+	}
+	lag := map[string]uint64{}
+	for _, f := range resp.Followers {
+		lag[f.ID] = f.Lag
+	}
+	if lag["node2"] != 60 || lag["node2"] <= lag["node1"] {
+		t.Fatalf("lagging follower not reported: %s", w.Body.String())
+	}
+	if !resp.Followers[1].LastContact.Equal(stale) {
+		t.Fatalf("wrong last contact reported: %s", w.Body.String())
+	}
+
+	st.follower = true
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/replication", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("wrong status code received from follower: %d (expected %d)", w.Code, http.StatusConflict)
+	}
+}
+
+// Test_JoinHTTPAddr tests that the HTTP address a node joins with is listed
+// by /cluster, and that nodes may join without one.
+func Test_JoinHTTPAddr(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	for _, body := range []string{
+		`{"id":"node1","addr":"127.0.0.1:12001","httpAddr":"127.0.0.1:11001"}`,
+		`{"id":"node2","addr":"127.0.0.1:12002"}`,
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/join", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong status code received for join %s: %d", body, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/cluster", nil))
+	exp := `{"servers":[{"id":"node1","address":"127.0.0.1:12001","suffrage":"voter","leader":false,"httpAddr":"127.0.0.1:11001"},` +
+		`{"id":"node2","address":"127.0.0.1:12002","suffrage":"voter","leader":false}]}`
+	if w.Body.String() != exp {
+		t.Fatalf("wrong cluster received: %s (expected %s)", w.Body.String(), exp)
+	}
+}
+
+// Test_ErrorResponses tests that errors are returned as JSON documents.
+func Test_ErrorResponses(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1":`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code received for malformed POST: %d (expected %d)", w.Code, http.StatusBadRequest)
+	}
+	if w.Body.String() != `{"error":"invalid request body","code":400}` {
+		t.Fatalf("wrong body received for malformed POST: %s", w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("wrong content type received for malformed POST: %s", ct)
+	}
+
+	store.err = fmt.Errorf("disk full")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1":"v1"}`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("wrong status code received for store error: %d (expected %d)", w.Code, http.StatusInternalServerError)
+	}
+	if w.Body.String() != `{"error":"disk full","code":500}` {
+		t.Fatalf("wrong body received for store error: %s", w.Body.String())
+	}
+}
+
+// Test_PutKey tests that PUT sets a single key to the raw request body.
+func Test_PutKey(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		path string
+		body string
+		code int
+	}{
+		{"/key/k1", `{"raw": "json"}`, http.StatusOK},
+		{"/key/k2", ``, http.StatusOK},
+		{"/key/", `v3`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("PUT", tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for PUT %s: %d (expected %d)", tt.path, w.Code, tt.code)
+		}
+	}
+
+	if store.m["k1"] != `{"raw": "json"}` {
+		t.Fatalf("wrong value stored for k1: %s", store.m["k1"])
+	}
+	if v, ok := store.m["k2"]; !ok || v != "" {
+		t.Fatalf("empty value not stored for k2")
+	}
+}
+
+// Test_MaxBodySize tests that oversized request bodies are rejected without
+// writing to the store.
+func Test_MaxBodySize(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+	s.MaxBodySize = 64
+
+	big := strings.Repeat("x", 128)
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/key", `{"k1": "` + big + `"}`},
+		{"PUT", "/key/k1", big},
+		{"POST", "/keys/batch", `{"k1": "` + big + `"}`},
+		{"POST", "/join", `{"id": "` + big + `", "addr": "127.0.0.1:12001"}`},
+		{"POST", "/leave", `{"id": "` + big + `"}`},
+		{"POST", "/key/k1/cas", `{"old": "", "new": "` + big + `"}`},
+		{"POST", "/key/k1/incr", `{"delta": 1, "pad": "` + big + `"}`},
+	}
+	for _, tt := range tests {
+		// Bodies are sent chunked, of unknown length, so that each handler
+		// must limit what it reads itself.
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("wrong status code received for %s %s: %d (expected %d)", tt.method, tt.path, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	if len(store.m) != 0 || len(store.nodes) != 0 {
+		t.Fatalf("store written despite oversized bodies")
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1": "v1"}`)))
+	if w.Code != http.StatusOK || store.m["k1"] != "v1" {
+		t.Fatalf("body within limit not accepted: %d", w.Code)
+	}
+}
+
+// Test_ExpectContinue tests that a request declaring a body too large, or
+// failing authentication, is refused without waiting for its body, so that a
+// client expecting 100 Continue never sends it.
+func Test_ExpectContinue(t *testing.T) {
+	s := New(":0", newTestStore(), nil)
+	s.MaxBodySize = 64
+	s.AuthToken = "secret"
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		auth   string
+		length int
+		code   int
+	}{
+		{"Bearer secret", 1 << 30, http.StatusRequestEntityTooLarge},
+		{"", 32, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req := fmt.Sprintf("PUT /key/k1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\nExpect: 100-continue\r\n", tt.length)
+		if tt.auth != "" {
+			req += "Authorization: " + tt.auth + "\r\n"
+		}
+		if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+			t.Fatalf("failed to send request: %s", err)
+		}
+
+		// No body is sent, so a server waiting to read it would time out.
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Fatalf("wrong status code received: %d (expected %d)", resp.StatusCode, tt.code)
+		}
+	}
+
+	// A body within the limit is still read once the client is told to
+	// continue.
+	req, _ := http.NewRequest("PUT", "http://"+s.Addr().String()+"/key/k1", strings.NewReader("v1"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Expect", "100-continue")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("body within limit not accepted: %d", resp.StatusCode)
+	}
+}
+
+// Test_RequestContext tests that a write stops waiting on the store once the
+// request's context is done.
+func Test_RequestContext(t *testing.T) {
+	store := newTestStore()
+	store.setDelay = time.Minute
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		timeout time.Duration
+		code    int
+	}{
+		{0, http.StatusServiceUnavailable},
+		{10 * time.Millisecond, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if tt.timeout == 0 {
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+		} else {
+			ctx, cancel = context.WithTimeout(context.Background(), tt.timeout)
+		}
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1": "v1"}`))
+		s.ServeHTTP(w, r.WithContext(ctx))
+		cancel()
+		if d := time.Since(start); d > 5*time.Second {
+			t.Fatalf("handler blocked for %s", d)
+		}
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received: %d (expected %d)", w.Code, tt.code)
+		}
+	}
+	if _, ok := store.m["k1"]; ok {
+		t.Fatalf("abandoned write applied")
+	}
+}
+
+// Test_ErrorMetrics tests that failed requests are counted against the
+// endpoint they were made to.
+func Test_ErrorMetrics(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		method   string
+		path     string
+		endpoint string
+		code     int
+	}{
+		{"POST", "/join", "/join", http.StatusBadRequest},
+		{"GET", "/nope", "unknown", http.StatusNotFound},
+		{"POST", "/key/k1/cas", "/key/cas", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		c := s.httpMetrics().Errors.WithLabelValues(tt.endpoint, tt.method, strconv.Itoa(tt.code))
+		before := testutil.ToFloat64(c)
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader("not json")))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s %s: %d (expected %d)", tt.method, tt.path, w.Code, tt.code)
+		}
+		if after := testutil.ToFloat64(c); after != before+1 {
+			t.Fatalf("error counter for %s not incremented: %v -> %v", tt.endpoint, before, after)
+		}
+	}
+}
+
+// Test_TimeoutMetrics tests that store operations which time out are counted,
+// and answered, as 503s, even when wrapped, while other store errors are 500s.
+func Test_TimeoutMetrics(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+	s.Metrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{store.ErrApplyTimeout, http.StatusServiceUnavailable},
+		{fmt.Errorf("error setting k1: %w", store.ErrApplyTimeout), http.StatusServiceUnavailable},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		st.err = tt.err
+		c := s.Metrics.Errors.WithLabelValues("/key", "PUT", strconv.Itoa(tt.code))
+		before := testutil.ToFloat64(c)
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/k1", strings.NewReader("v1")))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %q: %d (expected %d)", tt.err, w.Code, tt.code)
+		}
+		if after := testutil.ToFloat64(c); after != before+1 {
+			t.Fatalf("error counter for status %d not incremented for %q: %v -> %v", tt.code, tt.err, before, after)
+		}
+	}
+}
+
+// Test_Snapshot tests that a snapshot of the store can be requested.
+func Test_Snapshot(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/snapshot", nil))
+	if w.Code != http.StatusMethodNotAllowed || store.snapshotCalls != 0 {
+		t.Fatalf("GET /snapshot not rejected: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/snapshot", nil))
+	if w.Code != http.StatusOK || store.snapshotCalls != 1 {
+		t.Fatalf("POST /snapshot failed: %d, %d calls", w.Code, store.snapshotCalls)
+	}
+
+	store.err = fmt.Errorf("disk full")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/snapshot", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusInternalServerError)
+	}
+	if w.Body.String() != `{"error":"disk full","code":500}` {
+		t.Fatalf("wrong body received: %s", w.Body.String())
+	}
+}
+
+// Test_BackupRestore tests that a backup can be taken from one node, and only
+// restored into an empty one unless forced.
+func Test_BackupRestore(t *testing.T) {
+	src := newTestStore()
+	src.m["k1"] = "v1"
+	w := httptest.NewRecorder()
+	New(":0", src, nil).ServeHTTP(w, httptest.NewRequest("GET", "/backup", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "k1=v1\n" {
+		t.Fatalf("wrong backup received: %d, %s", w.Code, w.Body.String())
+	}
+	backup := w.Body.String()
+
+	dst := newTestStore()
+	dst.m["k2"] = "v2"
+	s := New(":0", dst, nil)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/restore", strings.NewReader(backup)))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusConflict)
+	}
+	if _, ok := dst.m["k1"]; ok {
+		t.Fatalf("backup restored into non-empty store")
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/restore?force=true", strings.NewReader(backup)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if dst.m["k1"] != "v1" || dst.m["k2"] != "v2" {
+		t.Fatalf("backup not merged: %v", dst.m)
+	}
+}
+
+// Test_Gzip tests that gzip-encoded request bodies are accepted, and that GET
+// responses are gzip-encoded for clients which accept it.
+func Test_Gzip(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"k1": "v1"}`))
+	zw.Close()
+	tests := []struct {
+		method string
+		path   string
+		body   []byte
+		code   int
+	}{
+		{"POST", "/key", buf.Bytes(), http.StatusOK},
+		{"PUT", "/key/k2", nil, http.StatusOK},
+		{"PUT", "/key/k3", []byte("not gzip"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+		r.Header.Set("Content-Encoding", "gzip")
+		s.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s %s: %d (expected %d)", tt.method, tt.path, w.Code, tt.code)
+		}
+	}
+	if store.m["k1"] != "v1" {
+		t.Fatalf("gzip-encoded value not stored: %q", store.m["k1"])
+	}
+	if v, ok := store.m["k2"]; !ok || v != "" {
+		t.Fatalf("empty gzip-encoded value not stored")
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/key/k1", nil)
+	r.Header.Set("Accept-Encoding", "deflate, gzip")
+	s.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("response not gzip-encoded")
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("failed to read gzip response: %s", err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("failed to read gzip response: %s", err)
+	}
+	if string(b) != `{"k1":"v1"}` {
+		t.Fatalf("wrong value received: %s", string(b))
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/k1", nil))
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"k1":"v1"}` {
+		t.Fatalf("response encoded for client not accepting gzip: %s", w.Body.String())
+	}
+}
+
+// Test_DeleteMulti tests that several keys can be deleted at once, that only
+// keys which were present are counted, and that deletes of too many keys are
+// rejected.
+func Test_DeleteMulti(t *testing.T) {
+	st := newTestStore()
+	st.m["a"] = "1"
+	st.m["b"] = "2"
+	st.m["keep"] = "3"
+	s := New(":0", st, nil)
+	s.MaxDeleteKeys = 3
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/keys/delete", strings.NewReader(`["a","b","missing"]`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if exp := `{"deleted":2}`; strings.TrimSpace(w.Body.String()) != exp {
+		t.Fatalf("wrong body received: %s (expected %s)", w.Body.String(), exp)
+	}
+	if len(st.m) != 1 || st.m["keep"] != "3" {
+		t.Fatalf("wrong keys remaining: %v", st.m)
+	}
+
+	for _, body := range []string{`["a","b","c","d"]`, `{"a":"1"}`} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/keys/delete", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status code received for body %s: %d (expected %d)", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// Test_DeletePrefix tests that only keys under the prefix are deleted, and
+// that deleting every key must be asked for explicitly.
+func Test_DeletePrefix(t *testing.T) {
+	store := newTestStore()
+	store.m["tmp/a"] = "1"
+	store.m["tmp/b"] = "2"
+	store.m["tmpx"] = "3"
+	store.m["user/a"] = "4"
+	s := New(":0", store, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("DELETE", "/keys?prefix=tmp/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"deleted":2}` {
+		t.Fatalf("wrong response received: %d, %s", w.Code, w.Body.String())
+	}
+	if len(store.m) != 2 || store.m["tmpx"] != "3" || store.m["user/a"] != "4" {
+		t.Fatalf("wrong keys remain: %v", store.m)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("DELETE", "/keys", nil))
+	if w.Code != http.StatusBadRequest || len(store.m) != 2 {
+		t.Fatalf("delete without prefix not rejected: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("DELETE", "/keys?all=true", nil))
+	if w.Code != http.StatusOK || len(store.m) != 0 {
+		t.Fatalf("delete of all keys failed: %d", w.Code)
+	}
+}
+
+// Test_Flush tests that every key is deleted once a flush is confirmed, and
+// that only the leader flushes.
+func Test_Flush(t *testing.T) {
+	st := newTestStore()
+	st.m["a"] = "1"
+	st.m["b/c"] = "2"
+	st.m["_schemas/b/"] = "{}"
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/admin/flush", nil))
+	if w.Code != http.StatusBadRequest || len(st.m) != 3 {
+		t.Fatalf("unconfirmed flush not rejected: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/admin/flush?confirm=true", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"deleted":3}` {
+		t.Fatalf("wrong response received: %d, %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/keys", nil))
+	if w.Body.String() != `{}` {
+		t.Fatalf("keys remain after flush: %s", w.Body.String())
+	}
+
+	st.follower = true
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/admin/flush?confirm=true", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received on follower: %d (expected %d)", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// Test_KeysPagination tests that keys can be listed a page at a time.
+func Test_KeysPagination(t *testing.T) {
+	store := newTestStore()
+	for _, k := range []string{"a", "b", "c", "d", "other"} {
+		store.m[k] = "v"
+	}
+	s := New(":0", store, nil)
+
+	tests := []struct {
+		query string
+		body  string
+	}{
+		{"limit=2", `{"keys":["a","b"],"next":"b"}`},
+		{"limit=2&after=b", `{"keys":["c","d"],"next":"d"}`},
+		{"limit=2&after=d", `{"keys":["other"],"next":""}`},
+		{"limit=1&after=other", `{"keys":[],"next":""}`},
+		{"limit=5", `{"keys":["a","b","c","d","other"],"next":""}`},
+		{"limit=4", `{"keys":["a","b","c","d"],"next":"d"}`},
+		{"prefix=o&after=a", `{"keys":["other"],"next":""}`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/keys?"+tt.query, nil))
+		if w.Code != http.StatusOK || w.Body.String() != tt.body {
+			t.Fatalf("wrong response received for %s: %d, %s (expected %s)", tt.query, w.Code, w.Body.String(), tt.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/keys?limit=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusBadRequest)
+	}
+}
+
+// Test_UnixSocket tests that the service can be served over a Unix domain
+// socket, replacing a stale socket file, and removing it once closed.
+func Test_UnixSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "service_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "hraftd.sock")
+
+	// Leave a stale socket file behind, as a crashed process would.
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen on socket: %s", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	store := newTestStore()
+	s := New("unix://"+path, store, nil)
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	if s.Addr().Network() != "unix" || s.Addr().String() != path {
+		t.Fatalf("wrong address: %s %s", s.Addr().Network(), s.Addr())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Post("http://hraftd/key", "application/json", strings.NewReader(`{"k1": "v1"}`))
+	if err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+	resp.Body.Close()
+	resp, err = client.Get("http://hraftd/key/k1")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != `{"k1":"v1"}` {
+		t.Fatalf("wrong value received: %s", string(b))
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close HTTP service: %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file not removed: %v", err)
+	}
+}
+
+// Test_H2C tests that HTTP/2 is served without TLS when enabled.
+func Test_H2C(t *testing.T) {
+	store := newTestStore()
+	store.m["k1"] = "v1"
+	s := New(":0", store, nil)
+	s.EnableH2C = true
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get(fmt.Sprintf("http://%s/key/k1", s.Addr()))
+	if err != nil {
+		t.Fatalf("failed to get key over HTTP/2: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("wrong protocol negotiated: %s", resp.Proto)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != `{"k1":"v1"}` {
+		t.Fatalf("wrong value received: %s", string(b))
+	}
+}
+
+// Test_Version tests that the build version is reported.
+func Test_Version(t *testing.T) {
+	defer func(v, c string) {
+		version.Version, version.Commit = v, c
+	}(version.Version, version.Commit)
+	version.Version, version.Commit = "v1.2.3", "abc123"
+
+	s := New(":0", newTestStore(), nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	exp := fmt.Sprintf(`{"version":"v1.2.3","commit":"abc123","raftProtocol":%d}`, version.RaftProtocol)
+	if w.Code != http.StatusOK || w.Body.String() != exp {
+		t.Fatalf("wrong response received: %d, %s (expected %s)", w.Code, w.Body.String(), exp)
+	}
+}
+
+// Test_RaftConfig tests that the Raft tuning in effect is reported.
+func Test_RaftConfig(t *testing.T) {
+	s := New(":0", newTestStore(), nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/config/raft", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"HeartbeatTimeout":"1s"`) {
+		t.Fatalf("heartbeat timeout not reported: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/config/raft", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("wrong status code received for PUT: %d", w.Code)
+	}
+	// The snapshot threshold can be changed at runtime, and is reported
+	// once changed.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PATCH", "/config/raft", strings.NewReader(`{"SnapshotThreshold": 1000, "SnapshotInterval": "1m"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for PATCH: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/config/raft", nil))
+	if !strings.Contains(w.Body.String(), `"SnapshotThreshold":1000`) || !strings.Contains(w.Body.String(), `"SnapshotInterval":"1m0s"`) {
+		t.Fatalf("reloaded tuning not reported: %s", w.Body.String())
+	}
+
+	for _, body := range []string{
+		`{"SnapshotThreshold": 0}`,
+		`{"SnapshotThreshold": -1}`,
+		`{"SnapshotInterval": "soon"}`,
+		`{"HeartbeatTimeout": "2s"}`,
+	} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("PATCH", "/config/raft", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status code received for PATCH %s: %d (expected %d)", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// Test_LogLevel tests that the log level can be raised to debug at runtime,
+// after which requests are logged.
+func Test_LogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(":0", newTestStore(), logging.New(&buf, ""))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("request logged at info level: %s", buf.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/loglevel", strings.NewReader(`{"level":"verbose"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code received for invalid level: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/loglevel", strings.NewReader(`{"level":"debug"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d", w.Code)
+	}
+
+	buf.Reset()
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if l := buf.String(); !strings.Contains(l, "DEBUG") || !strings.Contains(l, "GET /status") {
+		t.Fatalf("request not logged at debug level: %q", buf.String())
+	}
+}
+
+// Test_AccessLog tests that a parseable line is logged for each request.
+func Test_AccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(":0", newTestStore(), logging.New(&buf, ""))
+	s.AccessLog = true
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/missing", nil))
+
+	line := strings.TrimSpace(buf.String())
+	i := strings.Index(line, "method=")
+	if i < 0 {
+		t.Fatalf("no access log line emitted: %q", line)
+	}
+	fields := map[string]string{}
+	for _, kv := range strings.Fields(line[i:]) {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			t.Fatalf("malformed field %q in access log line: %q", kv, line)
+		}
+		fields[p[0]] = p[1]
+	}
+	if fields["status"] != "404" || fields["method"] != "GET" || fields["path"] != "/key/missing" {
+		t.Fatalf("wrong fields in access log line: %v", fields)
+	}
+	if n, err := strconv.Atoi(fields["bytes"]); err != nil || n != w.Body.Len() {
+		t.Fatalf("wrong size in access log line: %s (expected %d)", fields["bytes"], w.Body.Len())
+	}
+}
+
+// Test_KeyMethods tests that OPTIONS requests for keys are answered with the
+// methods supported, even by a follower, and that TRACE, also refused by a
+// follower, and other unsupported methods are refused, listing them.
+func Test_KeyMethods(t *testing.T) {
+	st := newTestStore()
+	st.follower = true
+	st.leaderHTTP = "127.0.0.1:1"
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/key/foo", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("wrong status code received for OPTIONS: %d (expected %d)", w.Code, http.StatusNoContent)
+	}
+	if a := w.Header().Get("Allow"); a != "GET, HEAD, POST, PUT, DELETE, OPTIONS" {
+		t.Fatalf("wrong Allow header received for OPTIONS: %q", a)
+	}
+
+	for _, method := range []string{"TRACE", "PATCH"} {
+		// Any other method could be a write, so is left to the leader.
+		st.follower = method != "PATCH"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, "/key/foo", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("wrong status code received for %s: %d (expected %d)", method, w.Code, http.StatusMethodNotAllowed)
+		}
+		if w.Header().Get("Allow") == "" {
+			t.Fatalf("no Allow header received for %s", method)
+		}
+	}
+}
+
+// Test_CORS tests that browsers at allowed origins, and only those, may make
+// cross-origin requests.
+func Test_CORS(t *testing.T) {
+	st := newTestStore()
+	st.m["k1"] = "v1"
+	s := New(":0", st, nil)
+	s.AllowedOrigins = []string{"https://dash.example.com"}
+	s.AuthToken = "s3cret"
+
+	r := httptest.NewRequest("OPTIONS", "/key/k1", nil)
+	r.Header.Set("Origin", "https://dash.example.com")
+	r.Header.Set("Access-Control-Request-Method", "PUT")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("wrong status code received for preflight: %d", w.Code)
+	}
+	if o := w.Header().Get("Access-Control-Allow-Origin"); o != "https://dash.example.com" {
+		t.Fatalf("wrong allowed origin: %q", o)
+	}
+	if m := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(m, "PUT") {
+		t.Fatalf("wrong allowed methods: %q", m)
+	}
+	if h := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(h, "Authorization") {
+		t.Fatalf("wrong allowed headers: %q", h)
+	}
+
+	r = httptest.NewRequest("GET", "/key/k1", nil)
+	r.Header.Set("Origin", "https://dash.example.com")
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://dash.example.com" {
+		t.Fatalf("wrong response for allowed origin: %d, %v", w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest("OPTIONS", "/key/k1", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	r.Header.Set("Access-Control-Request-Method", "DELETE")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("wrong response for preflight from disallowed origin: %d, %v", w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest("GET", "/key/k1", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("disallowed origin allowed: %v", w.Header())
+	}
+}
+
+// Test_RateLimit tests that a client exceeding its write limit is rejected,
+// while its reads, and other clients' writes, are not.
+func Test_RateLimit(t *testing.T) {
+	st := newTestStore()
+	st.m["k1"] = "v1"
+	s := New(":0", st, nil)
+	s.WriteRateLimit, s.WriteBurst = 0.1, 2
+	s.ReadRateLimit, s.ReadBurst = 100, 100
+	s.RateLimitHeader = "X-Client-ID"
+
+	write := func(client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/key", strings.NewReader(`{"k2":"v2"}`))
+		r.Header.Set("X-Client-ID", client)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := write("c1"); w.Code != http.StatusOK {
+			t.Fatalf("wrong status code received for write %d: %d", i, w.Code)
+		}
+	}
+	w := write("c1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("wrong status code received for write over limit: %d", w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "10" {
+		t.Fatalf("wrong Retry-After received: %q", ra)
+	}
+	if w := write("c2"); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for other client's write: %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/key/k1", nil)
+	r.Header.Set("X-Client-ID", "c1")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for read: %d", w.Code)
+	}
+}
+
+// Test_InFlight tests that a request is counted as in flight while it is
+// being served, and no longer once it completes.
+func Test_InFlight(t *testing.T) {
+	st := newTestStore()
+	st.setDelay = 500 * time.Millisecond
+	s := New(":0", st, nil)
+	s.Metrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+	g := s.Metrics.InFlight.WithLabelValues("/key")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/key/foo", strings.NewReader("bar")))
+	}()
+
+	deadline := time.Now().Add(st.setDelay)
+	for testutil.ToFloat64(g) < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("slow request not counted as in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-done
+	if v := testutil.ToFloat64(g); v != 0 {
+		t.Fatalf("completed request still counted as in flight: %v", v)
+	}
+}
+
+// Test_Breaker tests that repeated store failures open the circuit breaker,
+// after which writes fail fast until a probe succeeds.
+func Test_Breaker(t *testing.T) {
+	st := newTestStore()
+	st.err = fmt.Errorf("timed out enqueuing operation")
+	s := New(":0", st, nil)
+	s.Metrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+	s.BreakerThreshold = 3
+	s.BreakerCooldown = 100 * time.Millisecond
+
+	del := func() int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("DELETE", "/key/k1", nil))
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := del(); code != http.StatusInternalServerError {
+			t.Fatalf("wrong status code received for failed delete %d: %d", i, code)
+		}
+	}
+	if v := testutil.ToFloat64(s.Metrics.Breaker); v != 1 {
+		t.Fatalf("breaker not open after failures: %v", v)
+	}
+	for i := 0; i < 5; i++ {
+		if code := del(); code != http.StatusServiceUnavailable {
+			t.Fatalf("wrong status code received while breaker open: %d", code)
+		}
+	}
+	if st.deleteCalls != 3 {
+		t.Fatalf("store called while breaker open: %d calls (expected 3)", st.deleteCalls)
+	}
+	for _, tt := range []struct {
+		method, path string
+	}{
+		{"POST", "/keys/batch"},
+		{"POST", "/key/k1/cas"},
+		{"POST", "/key/k1/incr"},
+		{"DELETE", "/keys?prefix=k"},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"k1": "v1"}`)))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("wrong status code received for %s %s while breaker open: %d", tt.method, tt.path, w.Code)
+		}
+	}
+
+	// After the cooldown a probe is let through, and closes the breaker.
+	time.Sleep(s.BreakerCooldown)
+	st.err = nil
+	if code := del(); code != http.StatusOK {
+		t.Fatalf("wrong status code received for probe: %d", code)
+	}
+	if v := testutil.ToFloat64(s.Metrics.Breaker); v != 0 {
+		t.Fatalf("breaker not closed after probe: %v", v)
+	}
+}
+
+// writeRecordingStore is a Store which records, rather than makes, the writes
+// the service issues, each of which would be a Raft command.
+type writeRecordingStore struct {
+	*testStore
+	writes []string
+}
+
+func (w *writeRecordingStore) SetCtx(ctx context.Context, key, value string) error {
+	w.writes = append(w.writes, "set "+key)
+	return nil
+}
+
+func (w *writeRecordingStore) SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error {
+	w.writes = append(w.writes, "set "+key)
+	return nil
+}
+
+func (w *writeRecordingStore) SetIfVersion(ctx context.Context, key, value string, version uint64) error {
+	w.writes = append(w.writes, "set "+key)
+	return nil
+}
+
+func (w *writeRecordingStore) DeleteIfVersion(ctx context.Context, key string, version uint64) error {
+	w.writes = append(w.writes, "delete "+key)
+	return nil
+}
+
+func (w *writeRecordingStore) SetMultiCtx(ctx context.Context, kv map[string]string) error {
+	w.writes = append(w.writes, "setmulti")
+	return nil
+}
+
+func (w *writeRecordingStore) CompareAndSwapCtx(ctx context.Context, key, old, new string) (bool, error) {
+	w.writes = append(w.writes, "cas "+key)
+	return true, nil
+}
+
+func (w *writeRecordingStore) IncrementCtx(ctx context.Context, key string, delta int64) (int64, error) {
+	w.writes = append(w.writes, "incr "+key)
+	return 0, nil
+}
+
+func (w *writeRecordingStore) Txn(ctx context.Context, txn store.Txn) (bool, error) {
+	w.writes = append(w.writes, "txn")
+	return true, nil
+}
+
+func (w *writeRecordingStore) AppendCtx(ctx context.Context, key, chunk string) error {
+	w.writes = append(w.writes, "append "+key)
+	return nil
+}
+
+func (w *writeRecordingStore) DeleteCtx(ctx context.Context, key string) error {
+	w.writes = append(w.writes, "delete "+key)
+	return nil
+}
+
+func (w *writeRecordingStore) DeleteMultiCtx(ctx context.Context, keys []string) (int, error) {
+	w.writes = append(w.writes, "deletemulti")
+	return 0, nil
+}
+
+func (w *writeRecordingStore) DeletePrefixCtx(ctx context.Context, prefix string) (int, error) {
+	w.writes = append(w.writes, "deleteprefix "+prefix)
+	return 0, nil
+}
+
+// panicStore is a Store whose reads panic.
+type panicStore struct {
+	*testStore
+}
+
+func (panicStore) GetWithVersion(ctx context.Context, key string, level store.ConsistencyLevel) (string, uint64, error) {
+	panic("store failure")
+}
+
+// Test_Panic tests that a panicking store, or a missing one, fails requests
+// with a 500 rather than crashing, and that a service without a store cannot
+// be started.
+func Test_Panic(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(":0", panicStore{newTestStore()}, logging.New(&buf, ""))
+	s.Metrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/foo", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(w.Body.String(), `"code":500`) {
+		t.Fatalf("wrong body received: %s", w.Body.String())
+	}
+	if v := testutil.ToFloat64(s.Metrics.Panics); v != 1 {
+		t.Fatalf("wrong number of panics counted: %v (expected 1)", v)
+	}
+	if !strings.Contains(buf.String(), "store failure") {
+		t.Fatalf("panic not logged: %s", buf.String())
+	}
+
+	s = New(":0", nil, logging.New(&buf, ""))
+	s.Metrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("wrong status code received with nil store: %d (expected %d)", w.Code, http.StatusInternalServerError)
+	}
+	if err := s.Start(); err != errNilStore {
+		t.Fatalf("wrong error starting service with nil store: %v", err)
+	}
+}
+
+// Test_PanickingHandler tests that a panic in any handler is answered with a
+// 500, and counted.
+func Test_PanickingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(":0", newTestStore(), logging.New(&buf, ""))
+	s.Metrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+	s.mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failure")
+	})
+
+	for i := 1; i <= 2; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusInternalServerError)
+		}
+		if v := testutil.ToFloat64(s.Metrics.Panics); v != float64(i) {
+			t.Fatalf("wrong number of panics counted: %v (expected %d)", v, i)
+		}
+	}
+	if !strings.Contains(buf.String(), "handler failure") || !strings.Contains(buf.String(), "goroutine") {
+		t.Fatalf("panic and stack not logged: %s", buf.String())
+	}
+
+	// Other requests are still served.
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received after panic: %d", w.Code)
+	}
+}
+
+// Test_DryRun tests that dry-run writes are validated and summarized, but
+// never reach the store's mutating methods.
+func Test_DryRun(t *testing.T) {
+	st := newTestStore()
+	st.m["a"] = "1"
+	st.m["n"] = "1"
+	st.m["_schemas/s"] = `{"type": "integer", "maximum": 1}`
+	ws := &writeRecordingStore{testStore: st}
+	s := New(":0", ws, nil)
+
+	for _, tt := range []struct {
+		method, path, body string
+		code               int
+		exp                string
+	}{
+		{"POST", "/key?dryRun=true", `{"b":"2","a":"3"}`, http.StatusOK, `{"set":["a","b"],"delete":[]}`},
+		{"PUT", "/key/c?dryRun=true", "4", http.StatusOK, `{"set":["c"],"delete":[]}`},
+		{"DELETE", "/key/a?dryRun=true", "", http.StatusOK, `{"set":[],"delete":["a"]}`},
+		{"DELETE", "/key/x?dryRun=true", "", http.StatusOK, `{"set":[],"delete":[]}`},
+		{"POST", "/key?dryRun=true", `not json`, http.StatusBadRequest, ""},
+		{"PUT", "/key/?dryRun=true", "4", http.StatusBadRequest, ""},
+		{"POST", "/keys/batch?dryRun=true", `{"b":"2","a":"3"}`, http.StatusOK, `{"set":["a","b"],"delete":[]}`},
+		{"POST", "/keys/delete?dryRun=true", `["a","x","a"]`, http.StatusOK, `{"set":[],"delete":["a"]}`},
+		{"DELETE", "/keys?prefix=a&dryRun=true", "", http.StatusOK, `{"set":[],"delete":["a"]}`},
+		{"DELETE", "/keys?all=true&dryRun=true", "", http.StatusOK, `{"set":[],"delete":["_schemas/s","a","n"]}`},
+		{"POST", "/key/a/cas?dryRun=true", `{"old":"1","new":"2"}`, http.StatusOK, `{"set":["a"],"delete":[]}`},
+		{"POST", "/key/a/cas?dryRun=true", `{"old":"0","new":"2"}`, http.StatusOK, `{"set":[],"delete":[]}`},
+		{"POST", "/key/n/incr?dryRun=true", `{"delta":1}`, http.StatusOK, `{"set":["n"],"delete":[]}`},
+		{"POST", "/key/s/incr?dryRun=true", `{"delta":2}`, http.StatusUnprocessableEntity, ""},
+		{"POST", "/key/a/append?dryRun=true", "2", http.StatusOK, `{"set":["a"],"delete":[]}`},
+		{"POST", "/txn?dryRun=true", `{"compare":[{"key":"a","value":"1"}],"success":[{"op":"put","key":"b","value":"2"},{"op":"delete","key":"a"}],"failure":[{"op":"delete","key":"n"}]}`,
+			http.StatusOK, `{"set":["b"],"delete":["a"]}`},
+		{"POST", "/txn?dryRun=true", `{"compare":[{"key":"a","value":"0"}],"success":[{"op":"put","key":"b","value":"2"}],"failure":[{"op":"delete","key":"n"}]}`,
+			http.StatusOK, `{"set":[],"delete":["n"]}`},
+		{"POST", "/txn?dryRun=true", `{"success":[{"op":"rename","key":"a"}]}`, http.StatusBadRequest, ""},
+		{"PUT", "/schema/u?dryRun=true", `{"type": "string"}`, http.StatusOK, `{"set":["_schemas/u"],"delete":[]}`},
+		{"PUT", "/schema/u?dryRun=true", `{"type": 1}`, http.StatusBadRequest, ""},
+		{"DELETE", "/schema/s?dryRun=true", "", http.StatusOK, `{"set":[],"delete":["_schemas/s"]}`},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s %s: %d (expected %d)", tt.method, tt.path, w.Code, tt.code)
+		}
+		if tt.exp != "" && w.Body.String() != tt.exp {
+			t.Fatalf("wrong summary received for %s %s: %s (expected %s)", tt.method, tt.path, w.Body.String(), tt.exp)
+		}
+		if len(ws.writes) != 0 {
+			t.Fatalf("store written by dry run %s %s: %v", tt.method, tt.path, ws.writes)
+		}
+	}
+
+	if len(st.m) != 3 || st.m["a"] != "1" || st.m["n"] != "1" {
+		t.Fatalf("store changed by dry run: %v", st.m)
+	}
+}
+
+// Test_KeyValidation tests that over-long keys, keys failing the pattern, and
+// keys containing control characters are rejected before reaching the store.
+func Test_KeyValidation(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+	s.KeyPattern = regexp.MustCompile(`^[a-z0-9/]+$`)
+
+	long := strings.Repeat("a", DefaultMaxKeyLength+1)
+	for _, tt := range []struct {
+		method, path, body string
+	}{
+		{"GET", "/key/" + long, ""},
+		{"PUT", "/key/" + long, "v"},
+		{"DELETE", "/key/" + long, ""},
+		{"POST", "/key", `{"` + long + `":"v"}`},
+		{"GET", "/key/ABC", ""},
+		{"PUT", "/key/a-b", "v"},
+		{"POST", "/key", `{"ok":"v","a\nb":"v"}`},
+		{"POST", "/keys/batch", `{"a.b":"v"}`},
+		{"POST", "/keys/get", `["ok","A"]`},
+		{"POST", "/key/A/incr", `{"delta":1}`},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status code received for %s %.40s: %d (expected %d)", tt.method, tt.path, w.Code, http.StatusBadRequest)
+		}
+	}
+	if len(st.m) != 0 {
+		t.Fatalf("invalid keys written to store: %v", st.m)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/"+long[1:], strings.NewReader("v")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for key of maximum length: %d", w.Code)
+	}
+}
+
+// Test_ETags tests that reads return an ETag, and that writes carrying a
+// stale ETag in If-Match are refused with a 412.
+func Test_ETags(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	do := func(method, path, match, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if match != "" {
+			r.Header.Set("If-Match", match)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	do("PUT", "/key/foo", "", "a")
+	w := do("GET", "/key/foo", "", "")
+	tag := w.Header().Get("ETag")
+	if tag == "" {
+		t.Fatalf("no ETag returned")
+	}
+
+	if w := do("PUT", "/key/foo", tag, "b"); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for conditional update: %d", w.Code)
+	}
+	if st.m["foo"] != "b" {
+		t.Fatalf("wrong value after conditional update: %s", st.m["foo"])
+	}
+	w = do("GET", "/key/foo", "", "")
+	if w.Header().Get("ETag") == tag {
+		t.Fatalf("ETag not changed by update")
+	}
+
+	// The first ETag is now stale.
+	if w := do("PUT", "/key/foo", tag, "c"); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("wrong status code received for stale update: %d", w.Code)
+	}
+	if w := do("DELETE", "/key/foo", tag, ""); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("wrong status code received for stale delete: %d", w.Code)
+	}
+	if st.m["foo"] != "b" {
+		t.Fatalf("value changed by stale write: %s", st.m["foo"])
+	}
+
+	if w := do("DELETE", "/key/foo", w.Header().Get("ETag"), ""); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for conditional delete: %d", w.Code)
+	}
+	if w := do("PUT", "/key/foo", "*", "d"); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("wrong status code received for update of absent key: %d", w.Code)
+	}
+	if w := do("PUT", "/key/foo", "not-an-etag", "d"); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code received for invalid If-Match: %d", w.Code)
+	}
+}
+
+// Test_IfNoneMatch tests that a read carrying the key's current ETag in
+// If-None-Match is answered with a 304 and no body, and one carrying a stale
+// ETag with the value.
+func Test_IfNoneMatch(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	get := func(match string, gzip bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/key/foo", nil)
+		r.Header.Set("If-None-Match", match)
+		if gzip {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/key/foo", strings.NewReader("a")))
+	tag := get("", false).Header().Get("ETag")
+
+	for _, match := range []string{tag, "W/" + tag, `"0", ` + tag, "*"} {
+		for _, gzip := range []bool{false, true} {
+			w := get(match, gzip)
+			if w.Code != http.StatusNotModified {
+				t.Fatalf("wrong status code received for If-None-Match %s: %d (expected %d)", match, w.Code, http.StatusNotModified)
+			}
+			if w.Body.Len() != 0 || w.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("body returned with 304: %q", w.Body.String())
+			}
+			if w.Header().Get("ETag") != tag {
+				t.Fatalf("wrong ETag returned with 304: %s", w.Header().Get("ETag"))
+			}
+		}
+	}
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/key/foo", strings.NewReader("b")))
+	w := get(tag, false)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for stale ETag: %d (expected %d)", w.Code, http.StatusOK)
+	}
+	if w.Body.String() != `{"foo":"b"}` {
+		t.Fatalf("wrong value received for stale ETag: %s", w.Body.String())
+	}
+	if w.Header().Get("ETag") == tag || w.Header().Get("ETag") == "" {
+		t.Fatalf("new ETag not returned: %q", w.Header().Get("ETag"))
+	}
+}
+
+// readSignalStore is a testStore which signals on read after each read of a
+// key's version.
+type readSignalStore struct {
+	*testStore
+	read chan struct{}
+}
+
+func (st readSignalStore) GetWithVersion(ctx context.Context, key string, level store.ConsistencyLevel) (string, uint64, error) {
+	v, version, err := st.testStore.GetWithVersion(ctx, key, level)
+	st.read <- struct{}{}
+	return v, version, err
+}
+
+// Test_LongPoll tests that a read waiting for a key to change returns once it
+// is updated, and otherwise times out with a 304.
+func Test_LongPoll(t *testing.T) {
+	st := readSignalStore{newTestStore(), make(chan struct{}, 10)}
+	s := New(":0", st, nil)
+	st.SetCtx(context.Background(), "foo", "a")
+	st.events = make(chan store.Event, 10)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/key/foo?wait=true&"+query, nil))
+		return w
+	}
+
+	result := make(chan *httptest.ResponseRecorder, 1)
+	go func() { result <- get("index=1") }()
+	<-st.read
+	select {
+	case w := <-result:
+		t.Fatalf("read returned before key changed: %d", w.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/key/foo", strings.NewReader("b")))
+	select {
+	case w := <-result:
+		if w.Code != http.StatusOK || w.Body.String() != `{"foo":"b"}` {
+			t.Fatalf("wrong response received once key changed: %d, %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get("ETag") != `"2"` {
+			t.Fatalf("wrong ETag received once key changed: %s", w.Header().Get("ETag"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read not unblocked by change to key")
+	}
+
+	// A version already past the index is returned at once.
+	if w := get("index=1"); w.Code != http.StatusOK || w.Body.String() != `{"foo":"b"}` {
+		t.Fatalf("wrong response received for earlier index: %d, %s", w.Code, w.Body.String())
+	}
+
+	w := get("index=2&timeout=50ms")
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("wrong response received on timeout: %d, %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("wrong ETag received on timeout: %s", w.Header().Get("ETag"))
+	}
+
+	for _, q := range []string{"index=x", "index=1&timeout=soon"} {
+		if w := get(q); w.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status code received for %s: %d (expected %d)", q, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// Test_Pprof tests that the profiling handlers are only served once enabled.
+func Test_Pprof(t *testing.T) {
+	s := New(":0", newTestStore(), nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/cmdline", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("wrong status code received with pprof disabled: %d (expected %d)", w.Code, http.StatusNotFound)
+	}
+
+	s.EnablePprof = true
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/cmdline", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received with pprof enabled: %d (expected %d)", w.Code, http.StatusOK)
+	}
+}
+
+// Test_MountMetrics tests that metrics can be scraped on the service's own
+// port, once mounted.
+func Test_MountMetrics(t *testing.T) {
+	s := &testServer{New(":0", newTestStore(), nil)}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	resp, err := http.Get(s.URL() + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("wrong status code received with metrics unmounted: %d (expected %d)", resp.StatusCode, http.StatusNotFound)
+	}
+
+	s.MountMetrics = true
+	resp, err = http.Get(s.URL() + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %s", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code received with metrics mounted: %d (expected %d)", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(string(b), "go_goroutines") {
+		t.Fatalf("metrics missing from scrape:\n%s", b)
+	}
+}
+
+// Test_Registerer tests that a service given a registry of its own registers
+// its metrics there, rather than with the default registry, and serves them
+// from there when mounted.
+func Test_Registerer(t *testing.T) {
+	var services []*Service
+	for i := 0; i < 2; i++ {
+		s := New(":0", newTestStore(), nil)
+		s.Registerer = prometheus.NewRegistry()
+		s.MountMetrics = true
+		services = append(services, s)
+	}
+	for i, s := range services {
+		for j := 0; j <= i; j++ {
+			s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/key/missing", nil))
+		}
+	}
+
+	for i, s := range services {
+		families, err := s.Registerer.(prometheus.Gatherer).Gather()
+		if err != nil {
+			t.Fatalf("failed to gather metrics: %s", err)
+		}
+		for _, f := range families {
+			if !strings.HasPrefix(f.GetName(), "http_") {
+				t.Fatalf("metric %s of another source in service's registry", f.GetName())
+			}
+		}
+		if v := testutil.ToFloat64(s.httpMetrics().Errors.WithLabelValues("/key", "GET", "404")); v != float64(i+1) {
+			t.Fatalf("wrong count of errors for service %d: %v (expected %d)", i, v, i+1)
+		}
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		series := fmt.Sprintf(`http_request_errors{endpoint="/key",method="GET",status="404"} %d`, i+1)
+		if !strings.Contains(w.Body.String(), series) {
+			t.Fatalf("mounted metrics of service %d do not contain %s:\n%s", i, series, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "go_goroutines") {
+			t.Fatalf("mounted metrics of service %d served from default registry", i)
+		}
+	}
+}
+
+// Test_ApplyTimeout tests that a write which times out being applied fails
+// with a 503, asking the client to retry.
+func Test_ApplyTimeout(t *testing.T) {
+	st := newTestStore()
+	st.setDelay = time.Second
+	st.applyTimeout = time.Millisecond
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/foo", strings.NewReader("bar")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("no Retry-After header set")
+	}
+}
+
+// Test_ValueTooLarge tests that a value refused by the store as too large
+// fails with a 413.
+func Test_ValueTooLarge(t *testing.T) {
+	st := newTestStore()
+	st.err = store.ErrValueTooLarge
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/foo", strings.NewReader("bar")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// Test_Barrier tests that a barrier succeeds once complete, and fails with a
+// 503 if it times out or this node is not the leader.
+func Test_Barrier(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/barrier?timeout=1s", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("barrier failed: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/barrier?timeout=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid timeout not rejected: %d", w.Code)
+	}
+
+	st.err = store.ErrApplyTimeout
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/barrier", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received on timeout: %d (expected %d)", w.Code, http.StatusServiceUnavailable)
+	}
+
+	st.err = nil
+	st.follower = true
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/barrier", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received on follower: %d (expected %d)", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// Test_ACL tests that tokens with ACL rules are limited to the operations and
+// keys the rules allow.
+func Test_ACL(t *testing.T) {
+	st := newTestStore()
+	st.m["user/1"] = "fiona"
+	st.m["other"] = "x"
+	st.m["_schemas/other"] = `{"type": "integer"}`
+	s := New(":0", st, nil)
+	s.AuthToken = "s3cret"
+
+	do := func(token, method, path, body string) *httptest.ResponseRecorder {
+		var b io.Reader
+		if body != "" {
+			b = strings.NewReader(body)
+		}
+		r := httptest.NewRequest(method, path, b)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, rule := range []string{
+		`{"token": "reader", "read": true}`,
+		`{"token": "users", "read": true, "write": true, "prefixes": ["user/"]}`,
+	} {
+		if w := do("s3cret", "PUT", "/acl", rule); w.Code != http.StatusOK {
+			t.Fatalf("failed to set ACL rule %s: %d", rule, w.Code)
+		}
+	}
+	if w := do("reader", "PUT", "/acl", `{"token": "reader", "write": true}`); w.Code != http.StatusForbidden {
+		t.Fatalf("token without rights managed ACLs: %d", w.Code)
+	}
+
+	tests := []struct {
+		token, method, path, body string
+		code                      int
+	}{
+		{"reader", "GET", "/key/other", "", http.StatusOK},
+		{"reader", "POST", "/key", `{"other": "y"}`, http.StatusForbidden},
+		{"reader", "GET", "/cluster", "", http.StatusForbidden},
+		{"users", "GET", "/key/other", "", http.StatusForbidden},
+		{"users", "POST", "/key", `{"user/2": "bob"}`, http.StatusOK},
+		{"users", "POST", "/key", `{"user/3": "bob", "other": "y"}`, http.StatusForbidden},
+		{"users", "POST", "/keys/batch", `{"user/2": "bob"}`, http.StatusOK},
+		{"users", "POST", "/keys/batch", `{"user/3": "bob", "other": "y"}`, http.StatusForbidden},
+		{"users", "GET", "/keys?prefix=user/", "", http.StatusOK},
+		{"users", "GET", "/keys", "", http.StatusForbidden},
+		{"nobody", "GET", "/key/other", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if w := do(tt.token, tt.method, tt.path, tt.body); w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s %s %s by %s: %d (expected %d)", tt.method, tt.path, tt.body, tt.token, w.Code, tt.code)
+		}
+	}
+	if _, ok := st.m["user/3"]; ok || st.m["other"] != "x" {
+		t.Fatalf("keys changed by refused request")
+	}
+
+	if w := do("s3cret", "DELETE", "/acl", `{"token": "reader"}`); w.Code != http.StatusOK {
+		t.Fatalf("failed to remove ACL rule: %d", w.Code)
+	}
+	if w := do("reader", "GET", "/key/other", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token accepted after its rule was removed: %d", w.Code)
+	}
+}
+
+// Test_Maintenance tests that writes fail, but reads succeed, in maintenance
+// mode, and that turning it off allows writes again.
+func Test_Maintenance(t *testing.T) {
+	st := newTestStore()
+	st.m["foo"] = "bar"
+	s := New(":0", st, nil)
+
+	setMaintenance := func(body string, code int) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("PUT", "/maintenance", strings.NewReader(body)))
+		if w.Code != code {
+			t.Fatalf("wrong status code received for %s: %d (expected %d)", body, w.Code, code)
+		}
+	}
+	setMaintenance(`{}`, http.StatusBadRequest)
+	setMaintenance(`{"enabled":true}`, http.StatusOK)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/maintenance", nil))
+	if w.Body.String() != `{"enabled":true}` {
+		t.Fatalf("wrong maintenance mode received: %s", w.Body.String())
+	}
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("PUT", "/key/foo", strings.NewReader("baz")),
+		httptest.NewRequest("POST", "/key", strings.NewReader(`{"foo":"baz"}`)),
+		httptest.NewRequest("DELETE", "/key/foo", nil),
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("wrong status code received for %s in maintenance mode: %d (expected %d)", r.Method, w.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if st.m["foo"] != "bar" {
+		t.Fatalf("key changed in maintenance mode")
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/foo", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("read failed in maintenance mode: %d", w.Code)
+	}
+
+	setMaintenance(`{"enabled":false}`, http.StatusOK)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/foo", strings.NewReader("baz")))
+	if w.Code != http.StatusOK || st.m["foo"] != "baz" {
+		t.Fatalf("write failed after maintenance: %d", w.Code)
+	}
+}
+
+// Test_MaintenanceAllWrites tests that every write refused in maintenance
+// mode is refused by the node receiving it, with the same status, before
+// reaching the store.
+func Test_MaintenanceAllWrites(t *testing.T) {
+	st := newTestStore()
+	st.m["foo"] = "bar"
+	st.maintenance = true
+	s := New(":0", st, nil)
+	s.AuthToken = "s3cret"
+
+	tests := []struct {
+		method, path, body string
+	}{
+		{"PUT", "/key/foo", "baz"},
+		{"POST", "/key", `{"foo": "baz"}`},
+		{"DELETE", "/key/foo", ""},
+		{"POST", "/keys/batch", `{"foo": "baz"}`},
+		{"POST", "/keys/delete", `["foo"]`},
+		{"DELETE", "/keys?prefix=f", ""},
+		{"POST", "/key/foo/cas", `{"old": "bar", "new": "baz"}`},
+		{"POST", "/key/n/incr", `{"delta": 1}`},
+		{"POST", "/key/foo/append", "baz"},
+		{"POST", "/txn", `{"success": [{"op": "set", "key": "foo", "value": "baz"}]}`},
+		{"PUT", "/schema/user", `{"type": "string"}`},
+		{"DELETE", "/schema/user", ""},
+		{"PUT", "/acl", `{"token": "reader", "read": true}`},
+		{"DELETE", "/acl", `{"token": "reader"}`},
+		{"POST", "/admin/flush?confirm=true", ""},
+		{"POST", "/restore?force=true", "foo=baz"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		r.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("wrong status code received for %s %s in maintenance mode: %d (expected %d)", tt.method, tt.path, w.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if len(st.m) != 1 || st.m["foo"] != "bar" {
+		t.Fatalf("store changed in maintenance mode: %v", st.m)
+	}
+}
+
+// Test_Bootstrap tests that a node can be bootstrapped once, and bootstrapping
+// it again is a conflict.
+func Test_Bootstrap(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/bootstrap", nil))
+	if w.Code != http.StatusMethodNotAllowed || st.bootstrapped {
+		t.Fatalf("GET /bootstrap not rejected: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/bootstrap", nil))
+	if w.Code != http.StatusOK || !st.bootstrapped {
+		t.Fatalf("POST /bootstrap failed: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/bootstrap", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusConflict)
+	}
+}
+
+// Test_LeaderHeader tests that every response names the leader, and that the
+// header is empty if there is no leader.
+func Test_LeaderHeader(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if v, ok := w.Header()["X-Raft-Leader"]; !ok || v[0] != "" {
+		t.Fatalf("wrong X-Raft-Leader header with no leader: %v", v)
+	}
+
+	st.leaderHTTP = "10.0.0.1:11000"
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/foo", nil))
+	if v := w.Header().Get("X-Raft-Leader"); v != "10.0.0.1:11000" {
+		t.Fatalf("wrong X-Raft-Leader header: %s", v)
+	}
+}
+
+// Test_Schemas tests that values set under a prefix with a registered schema
+// must match it, and that the schema is stored in the store.
+func Test_Schemas(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/schema/user", strings.NewReader(`{"type": "bogus"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid schema not rejected: %d", w.Code)
+	}
+
+	sc := `{"type": "object", "required": ["name"], "properties": {"age": {"type": "integer", "minimum": 0}}}`
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/schema/user", strings.NewReader(sc)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to register schema: %d", w.Code)
+	}
+	if st.m["_schemas/user"] != sc {
+		t.Fatalf("schema not stored")
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/key", strings.NewReader(`{"user1": "{\"name\": \"fiona\", \"age\": 30}"}`)))
+	if w.Code != http.StatusOK || st.m["user1"] == "" {
+		t.Fatalf("matching value not set: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/user2", strings.NewReader(`{"age": -1}`)))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusUnprocessableEntity)
+	}
+	exp := `{"error":"value does not match schema","code":422,"errors":["user2: $: missing required property \"name\"","user2: $.age: must be at least 0"]}`
+	if w.Body.String() != exp {
+		t.Fatalf("wrong body received: %s (expected %s)", w.Body.String(), exp)
+	}
+	if _, ok := st.m["user2"]; ok {
+		t.Fatalf("mismatching value set")
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/other", strings.NewReader("not json")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("value without schema not set: %d", w.Code)
+	}
+}
+
+// Test_SchemasAllWrites tests that values written by batch, compare-and-swap
+// and increment requests are checked against schemas, as sets are.
+func Test_SchemasAllWrites(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+	st.m["_schemas/user"] = `{"type": "object", "required": ["name"]}`
+	st.m["_schemas/count"] = `{"type": "integer", "maximum": 2}`
+
+	do := func(path, body string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w.Code
+	}
+	tests := []struct {
+		path string
+		body string
+		code int
+	}{
+		{"/keys/batch", `{"user1": "{}", "other": "1"}`, http.StatusUnprocessableEntity},
+		{"/keys/batch", `{"user1": "{\"name\": \"a\"}", "other": "1"}`, http.StatusOK},
+		{"/key/user1/cas", `{"old": "{\"name\": \"a\"}", "new": "{}"}`, http.StatusUnprocessableEntity},
+		{"/key/count/incr", `{"delta": 2}`, http.StatusOK},
+		{"/key/count/incr", `{"delta": 1}`, http.StatusUnprocessableEntity},
+		{"/key/count/incr", `{"delta": -1}`, http.StatusOK},
+		{"/key/user1/append", `, "age": -1}`, http.StatusUnprocessableEntity},
+		{"/key/other/append", `2`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := do(tt.path, tt.body); code != tt.code {
+			t.Fatalf("wrong status code received for POST %s %s: %d (expected %d)", tt.path, tt.body, code, tt.code)
+		}
+	}
+	if st.m["user1"] != `{"name": "a"}` || st.m["count"] != "1" || st.m["other"] != "12" {
+		t.Fatalf("wrong values stored: %q, %q, %q", st.m["user1"], st.m["count"], st.m["other"])
+	}
+}
+
+// Test_SchemaKeysReserved tests that the keys holding schemas cannot be
+// written, except through /schema/, where schemas are checked, so that a
+// value which is not a schema cannot break writes under its prefix.
+func Test_SchemaKeysReserved(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+	s.AuthToken = "s3cret"
+	st.m[aclKey("writer")] = `{"read": true, "write": true}`
+
+	do := func(token, method, path, ns, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		if ns != "" {
+			r.Header.Set("X-Namespace", ns)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	tests := []struct {
+		token, method, path, ns, body string
+	}{
+		{"s3cret", "POST", "/key", "", `{"_schemas/user": "not a schema"}`},
+		{"s3cret", "POST", "/keys/batch", "", `{"_schemas/user": "not a schema"}`},
+		{"s3cret", "PUT", "/key/user", "_schemas", "not a schema"},
+		{"writer", "POST", "/key", "", `{"_schemas/user": "not a schema"}`},
+		{"writer", "DELETE", "/keys?prefix=_sch", "", ""},
+	}
+	for _, tt := range tests {
+		if code := do(tt.token, tt.method, tt.path, tt.ns, tt.body); code != http.StatusForbidden {
+			t.Fatalf("wrong status code received for %s %s %s by %s: %d (expected %d)", tt.method, tt.path, tt.body, tt.token, code, http.StatusForbidden)
+		}
+	}
+	if _, ok := st.m["_schemas/user"]; ok {
+		t.Fatalf("schema key written through key API")
+	}
+
+	if code := do("s3cret", "PUT", "/schema/user", "", `{"type": "string"}`); code != http.StatusOK {
+		t.Fatalf("failed to register schema: %d", code)
+	}
+	if code := do("s3cret", "PUT", "/key/user1", "", `"fiona"`); code != http.StatusOK {
+		t.Fatalf("failed to set key with schema: %d", code)
+	}
+}
+
+// Test_KeysMeta tests that key metadata is listed, in key order, without
+// values.
+func Test_KeysMeta(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+	st.m["user/b"] = "12345"
+	st.m["user/a"] = "1"
+	st.m["other"] = "1"
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/keys/meta?prefix=user/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received: %d", w.Code)
+	}
+	if exp := `[{"key":"user/a","size":1,"version":0},{"key":"user/b","size":5,"version":0}]`; w.Body.String() != exp {
+		t.Fatalf("wrong body received: %s (expected %s)", w.Body.String(), exp)
+	}
+}
+
+// Test_IdempotencyKey tests that the Idempotency-Key header of a write is
+// passed to the store.
+func Test_IdempotencyKey(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	for _, key := range []string{"abc", ""} {
+		r := httptest.NewRequest("POST", "/key/n/incr", strings.NewReader(`{"delta":1}`))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("wrong status code received: %d", w.Code)
+		}
+	}
+	if len(st.idempotencyKeys) != 2 || st.idempotencyKeys[0] != "abc" || st.idempotencyKeys[1] != "" {
+		t.Fatalf("wrong idempotency keys passed to store: %q", st.idempotencyKeys)
+	}
+	// Every other kind of write, including sets with a TTL, passes it on too.
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/key", `{"a": "1"}`},
+		{"PUT", "/key/a", "1"},
+		{"POST", "/keys/batch", `{"a": "1"}`},
+		{"POST", "/key/a/cas", `{"old": "1", "new": "2"}`},
+		{"POST", "/keys/delete", `["a"]`},
+		{"DELETE", "/keys?prefix=a", ""},
+	}
+	for _, tt := range tests {
+		st.idempotencyKeys = nil
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		r.Header.Set("Idempotency-Key", "def")
+		if tt.path == "/key" || tt.path == "/key/a" {
+			r.Header.Set("X-TTL-Seconds", "60")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK && w.Code != http.StatusConflict {
+			t.Fatalf("wrong status code received for %s %s: %d", tt.method, tt.path, w.Code)
+		}
+		if len(st.idempotencyKeys) != 1 || st.idempotencyKeys[0] != "def" {
+			t.Fatalf("wrong idempotency keys passed to store for %s %s: %q", tt.method, tt.path, st.idempotencyKeys)
+		}
+	}
+}
+
+// Test_Namespaces tests that two namespaces, given by header or by path, hold
+// the same logical key independently, and that invalid namespaces are rejected.
+func Test_Namespaces(t *testing.T) {
+	st := newTestStore()
+	s := New(":0", st, nil)
+
+	do := func(method, path, ns, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if ns != "" {
+			r.Header.Set("X-Namespace", ns)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("POST", "/key", "app1", `{"foo":"1"}`); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for app1 write: %d", w.Code)
+	}
+	if w := do("PUT", "/ns/app2/key/foo", "", "2"); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for app2 write: %d", w.Code)
+	}
+	if st.m["app1/foo"] != "1" || st.m["app2/foo"] != "2" {
+		t.Fatalf("keys not stored under their namespaces: %v", st.m)
+	}
+
+	if w := do("GET", "/ns/app1/key/foo", "", ""); w.Body.String() != `{"foo":"1"}` {
+		t.Fatalf("wrong body received for app1 read: %s", w.Body.String())
+	}
+	if w := do("GET", "/key/foo", "app2", ""); w.Body.String() != `{"foo":"2"}` {
+		t.Fatalf("wrong body received for app2 read: %s", w.Body.String())
+	}
+	if w := do("GET", "/key/foo", "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("wrong status code received for read outside namespaces: %d", w.Code)
+	}
+	if w := do("GET", "/ns/app1/keys", "", ""); w.Body.String() != `{"foo":"1"}` {
+		t.Fatalf("wrong body received for app1 scan: %s", w.Body.String())
+	}
+
+	if w := do("DELETE", "/ns/app1/key/foo", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("wrong status code received for app1 delete: %d", w.Code)
+	}
+	if _, ok := st.m["app1/foo"]; ok {
+		t.Fatalf("app1 key not deleted")
+	}
+	if st.m["app2/foo"] != "2" {
+		t.Fatalf("app2 key changed by app1 delete")
+	}
+
+	if w := do("GET", "/key/foo", "a/b", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code received for namespace containing '/': %d", w.Code)
+	}
+	if w := do("GET", "/ns//key/foo", "", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code received for empty namespace: %d", w.Code)
+	}
+	if w := do("GET", "/ns/app1/status", "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("wrong status code received for namespaced status: %d", w.Code)
+	}
+}
+
+// Test_ReadTimeout tests that a client which stalls while sending a request
+// body has its connection closed.
+func Test_ReadTimeout(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store, nil)
+	s.ReadTimeout = 200 * time.Millisecond
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /key HTTP/1.1\r\nHost: hraftd\r\nContent-Length: 100\r\n\r\n{\"k1\": ")
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("connection not closed by server: %s", err)
+	}
+	if d := time.Since(start); d < s.ReadTimeout {
+		t.Fatalf("connection closed after %s, before the read timeout", d)
+	}
+	if len(store.m) != 0 {
+		t.Fatalf("partial request applied")
+	}
+}
+
+// Test_Watch tests that changes are streamed to watchers as Server-Sent Events.
+func Test_Watch(t *testing.T) {
+	st := newTestStore()
+	st.events = make(chan store.Event, 1)
+	s := &testServer{New(":0", st, nil)}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	resp, err := http.Get(s.URL() + "/watch?prefix=config/")
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("wrong content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	doPost(t, s.URL(), "config/a", "1")
+
+	r := bufio.NewReader(resp.Body)
+	var frame string
+	for !strings.HasSuffix(frame, "\n\n") {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %s", err)
+		}
+		frame += l
+	}
+	if exp := "event: set\ndata: {\"key\":\"config/a\",\"value\":\"1\"}\n\n"; frame != exp {
+		t.Fatalf("wrong event received: %q (expected %q)", frame, exp)
+	}
+}
+
+// Test_WebSocketWatch tests that changes are sent to WebSocket clients once
+// they subscribe.
+func Test_WebSocketWatch(t *testing.T) {
+	st := newTestStore()
+	st.events = make(chan store.Event, 1)
+	s := &testServer{New(":0", st, nil)}
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTP service: %s", err)
+	}
+	defer s.Close()
+
+	addr := strings.TrimPrefix(s.URL(), "http://")
+	ws, err := websocket.Dial("ws://"+addr+"/ws/watch", "", "http://"+addr)
+	if err != nil {
+		t.Fatalf("failed to dial WebSocket: %s", err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := websocket.JSON.Send(ws, map[string]string{"op": "bogus"}); err != nil {
+		t.Fatalf("failed to send message: %s", err)
+	}
+	var ev map[string]string
+	if err := websocket.JSON.Receive(ws, &ev); err != nil {
+		t.Fatalf("failed to receive error: %s", err)
+	}
+	if ev["type"] != "error" {
+		t.Fatalf("unknown op not rejected: %v", ev)
+	}
+
+	if err := websocket.JSON.Send(ws, map[string]string{"op": "subscribe", "prefix": "config/"}); err != nil {
+		t.Fatalf("failed to send message: %s", err)
+	}
+	doPost(t, s.URL(), "config/a", "1")
+
+	ev = nil
+	if err := websocket.JSON.Receive(ws, &ev); err != nil {
+		t.Fatalf("failed to receive event: %s", err)
+	}
+	if ev["type"] != "set" || ev["key"] != "config/a" || ev["value"] != "1" {
+		t.Fatalf("wrong event received: %v", ev)
+	}
+}
+
+// Test_ReadYourWrites tests that writes report their log index, and that reads
+// wait for a lagging store to apply the index they ask for.
+func Test_ReadYourWrites(t *testing.T) {
+	st := newTestStore()
+	st.index = 7
+	s := New(":0", st, nil)
+	s.IndexWaitTimeout = 100 * time.Millisecond
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/key", strings.NewReader(`{"k1": "v1"}`)))
+	if w.Header().Get("X-Raft-Index") != "7" {
+		t.Fatalf("wrong index header: %q", w.Header().Get("X-Raft-Index"))
+	}
+
+	// A store which never catches up.
+	atomic.StoreUint64(&st.index, 5)
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/key/k1", nil)
+	r.Header.Set("X-Min-Raft-Index", "7")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status code received: %d (expected %d)", w.Code, http.StatusServiceUnavailable)
+	}
+
+	// A store which catches up while the read waits.
+	s.IndexWaitTimeout = 5 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreUint64(&st.index, 7)
+	}()
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{"k1":"v1"}` {
+		t.Fatalf("wrong response received: %d, %s", w.Code, w.Body.String())
+	}
+}
+
+// Test_TLS tests that keys can be set and read over HTTPS.
+func Test_TLS(t *testing.T) {
+	cert, certPEM, keyPEM := newTestCert(t)
+
+	tmpDir, err := ioutil.TempDir("", "service_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	certFile := filepath.Join(tmpDir, "cert.pem")
+	keyFile := filepath.Join(tmpDir, "key.pem")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	configs := map[string]func(*Service){
+		"config": func(s *Service) { s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}} },
+		"files":  func(s *Service) { s.CertFile, s.KeyFile = certFile, keyFile },
+	}
+	for name, configure := range configs {
+		store := newTestStore()
+		s := &testServer{New(":0", store, nil)}
+		configure(s.Service)
+		if err := s.Start(); err != nil {
+			t.Fatalf("failed to start HTTPS service with %s: %s", name, err)
+		}
+		defer s.Close()
+
+		if !strings.HasPrefix(s.URL(), "https://") {
+			t.Fatalf("wrong URL for HTTPS service with %s: %s", name, s.URL())
+		}
+		resp, err := client.Post(s.URL()+"/key", "application/json", strings.NewReader(`{"k1":"v1"}`))
+		if err != nil {
+			t.Fatalf("failed to POST over HTTPS with %s: %s", name, err)
+		}
+		resp.Body.Close()
+
+		resp, err = client.Get(s.URL() + "/key/k1")
+		if err != nil {
+			t.Fatalf("failed to GET over HTTPS with %s: %s", name, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != `{"k1":"v1"}` {
+			t.Fatalf("wrong value received over HTTPS with %s: %s", name, string(b))
+		}
+	}
+}
+
+// Test_JoinRequiresClientCert tests that only nodes with a trusted client
+// certificate may join, while the plain listener still serves keys.
+func Test_JoinRequiresClientCert(t *testing.T) {
+	cert, _, _ := newTestCert(t)
+	untrusted, _, _ := newTestCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	store := newTestStore()
+	s := &testServer{New(":0", store, nil)}
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.ClientCAs = pool
+	s.PlainAddr = "127.0.0.1:0"
+	if err := s.Start(); err != nil {
+		t.Fatalf("failed to start HTTPS service: %s", err)
+	}
+	defer s.Close()
+
+	clientWith := func(c tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{c},
+		}}}
+	}
+	join := `{"id":"node1","addr":"127.0.0.1:12001"}`
+
+	resp, err := clientWith(cert).Post(s.URL()+"/join", "application/json", strings.NewReader(join))
+	if err != nil {
+		t.Fatalf("failed to join with trusted certificate: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code received with trusted certificate: %d (expected %d)", resp.StatusCode, http.StatusOK)
+	}
+	if _, ok := store.nodes["node1"]; !ok {
+		t.Fatalf("node not joined with trusted certificate")
+	}
+
+	if resp, err := clientWith(untrusted).Post(s.URL()+"/join", "application/json", strings.NewReader(join)); err == nil {
+		resp.Body.Close()
+		t.Fatalf("join with untrusted certificate succeeded: %d", resp.StatusCode)
+	}
+
+	plainURL := fmt.Sprintf("http://%s", s.PlainListenAddr())
+	resp, err = http.Post(plainURL+"/join", "application/json", strings.NewReader(join))
+	if err != nil {
+		t.Fatalf("failed to POST to plain listener: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("wrong status code received for join on plain listener: %d (expected %d)", resp.StatusCode, http.StatusForbidden)
+	}
+
+	store.m["k1"] = "v1"
+	if b := doGet(t, plainURL, "k1"); b != `{"k1":"v1"}` {
+		t.Fatalf("wrong value received from plain listener: %s", b)
+	}
+}
+
+// Test_AuthToken tests that requests must carry the configured bearer token.
+func Test_AuthToken(t *testing.T) {
+	store := newTestStore()
+	store.m["k1"] = "v1"
+	store.leader = "127.0.0.1:12000"
+	s := New(":0", store, nil)
+	s.AuthToken = "secret"
+
+	tests := []struct {
+		path   string
+		header string
+		code   int
+	}{
+		{"/key/k1", "", http.StatusUnauthorized},
+		{"/key/k1", "Bearer wrong", http.StatusUnauthorized},
+		{"/key/k1", "secret", http.StatusUnauthorized},
+		{"/key/k1", "Bearer secret", http.StatusOK},
+		{"/status", "", http.StatusUnauthorized},
+		{"/status", "Bearer secret", http.StatusOK},
+		{"/health", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		s.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for %s with %q: %d (expected %d)", tt.path, tt.header, w.Code, tt.code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/join", strings.NewReader(`{"id":"node1","addr":"127.0.0.1:12001"}`)))
+	if w.Code != http.StatusUnauthorized || len(store.nodes) != 0 {
+		t.Fatalf("join without token not rejected: %d", w.Code)
+	}
+}
+
+type testServer struct {
+	*Service
+}
+
+func (t *testServer) URL() string {
+	port := strings.TrimLeft(t.Addr().String(), "[::]:")
+	return fmt.Sprintf("%s://127.0.0.1:%s", t.scheme(), port)
+}
+
+// newTestCert returns a self-signed certificate for 127.0.0.1, along with its
+// PEM-encoded certificate and private key.
+func newTestCert(t *testing.T) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hraftd test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("failed to load key pair: %s", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+type testStore struct {
+	m     map[string]string
+	ttl   map[string]time.Duration
+	nodes map[string]string
+	voter map[string]bool // Whether each node joined as a voter.
+
+	versions map[string]uint64 // Version of each key, set by SetCtx.
+	version  uint64
+
+	history map[string]map[uint64]string // Value of each key by log index.
+
+	nodeHTTP map[string]string // HTTP API address of each node, if set.
+
+	deleteCalls   int
+	setMultiCalls int
+	snapshotCalls int
+	bootstrapped  bool
+	maintenance   bool
+	transfers     []string // Targets of leadership transfers.
+	raftConfig    store.RaftConfigView
+
+	idempotencyKeys []string // Idempotency keys of increments.
+
+	servers     []store.ServerInfo
+	replication []store.FollowerReplication
+	err         error
+	setDelay    time.Duration
+	leader      string
+
+	// applyTimeout, if set, fails sets taking longer, like the store's
+	// ApplyTimeout.
+	applyTimeout time.Duration
+
+	leaderHTTP string
+	follower   bool
+	ready      bool
+
+	events chan store.Event // Receives an event for each Set, if not nil.
+	index  uint64           // Applied index, accessed atomically.
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		m:     make(map[string]string),
+		ttl:   make(map[string]time.Duration),
+		nodes: make(map[string]string),
+		voter: make(map[string]bool),
+
+		versions: make(map[string]uint64),
+	}
+}
+
+func (t *testStore) Get(key string) (string, error) {
+	v, ok := t.m[key]
+	if !ok {
+		return "", store.ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (t *testStore) Exists(key string) (bool, error) {
+	_, ok := t.m[key]
+	return ok, nil
+}
+
+func (t *testStore) GetWithLevel(key string, level store.ConsistencyLevel) (string, error) {
+	if level != store.Stale && t.follower {
+		return "", store.ErrNotLeader
+	}
+	return t.Get(key)
+}
+
+func (t *testStore) Scan(prefix string) (map[string]string, error) {
+	o := make(map[string]string)
+	for k, v := range t.m {
+		if strings.HasPrefix(k, prefix) {
+			o[k] = v
+		}
+	}
+	return o, nil
+}
+
+func (t *testStore) ScanMeta(prefix string) ([]store.KeyMeta, error) {
+	meta := []store.KeyMeta{}
+	for k, v := range t.m {
+		if strings.HasPrefix(k, prefix) {
+			meta = append(meta, store.KeyMeta{Key: k, Size: len(v), Version: t.versions[k]})
+		}
+	}
+	sort.Slice(meta, func(i, j int) bool { return meta[i].Key < meta[j].Key })
+	return meta, nil
+}
+
+func (t *testStore) GetMulti(keys []string) (map[string]*string, error) {
+	o := make(map[string]*string)
+	for _, k := range keys {
+		if v, ok := t.m[k]; ok {
+			o[k] = &v
+		} else {
+			o[k] = nil
+		}
+	}
+	return o, nil
+}
+
+func (t *testStore) GetCtx(ctx context.Context, key string, level store.ConsistencyLevel) (string, error) {
+	return t.GetWithLevel(key, level)
+}
+
+func (t *testStore) GetWithVersion(ctx context.Context, key string, level store.ConsistencyLevel) (string, uint64, error) {
+	v, err := t.GetWithLevel(key, level)
+	return v, t.versions[key], err
+}
+
+// GetAt returns the value of key with the greatest index at most index.
+// Earlier values are reported as pruned.
+func (t *testStore) GetAt(key string, index uint64) (string, error) {
+	h, ok := t.history[key]
+	if !ok {
+		return "", store.ErrKeyNotFound
+	}
+	var best uint64
+	found := false
+	for i := range h {
+		if i <= index && (!found || i > best) {
+			best, found = i, true
+		}
+	}
+	if !found {
+		return "", store.ErrHistoryPruned
+	}
+	return h[best], nil
+}
+
+func (t *testStore) ScanPage(prefix, after string, limit int) ([]string, string, error) {
+	keys := []string{}
+	for k := range t.m {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	next := ""
+	if len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+	return keys, next, nil
+}
+
+func (t *testStore) Set(key, value string) error {
+	return t.SetCtx(context.Background(), key, value)
+}
+
+func (t *testStore) SetCtx(ctx context.Context, key, value string) error {
+	if t.err != nil {
+		return t.err
+	}
+	var timeout <-chan time.Time
+	if t.applyTimeout > 0 {
+		timeout = time.After(t.applyTimeout)
+	}
+	select {
+	case <-time.After(t.setDelay):
+	case <-timeout:
+		return store.ErrApplyTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	t.m[key] = value
+	t.version++
+	t.versions[key] = t.version
+	if t.events != nil {
+		t.events <- store.Event{Type: store.EventSet, Key: key, Value: value}
+	}
+	return nil
+}
+
+func (t *testStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	t.m[key] = value
+	t.ttl[key] = ttl
+	return nil
+}
+
+func (t *testStore) SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error {
+	t.idempotencyKeys = append(t.idempotencyKeys, store.IdempotencyKey(ctx))
+	return t.SetWithTTL(key, value, ttl)
+}
+
+func (t *testStore) SetIfVersion(ctx context.Context, key, value string, version uint64) error {
+	if t.versions[key] != version {
+		return store.ErrVersionMismatch
+	}
+	return t.SetCtx(context.Background(), key, value)
+}
+
+func (t *testStore) DeleteIfVersion(ctx context.Context, key string, version uint64) error {
+	if v, ok := t.versions[key]; !ok || v != version {
+		return store.ErrVersionMismatch
+	}
+	return t.Delete(key)
+}
+
+func (t *testStore) SetMulti(kv map[string]string) error {
+	t.setMultiCalls++
+	for k, v := range kv {
+		t.m[k] = v
+	}
+	return nil
+}
+
+func (t *testStore) SetMultiCtx(ctx context.Context, kv map[string]string) error {
+	t.idempotencyKeys = append(t.idempotencyKeys, store.IdempotencyKey(ctx))
+	return t.SetMulti(kv)
+}
+
+func (t *testStore) Txn(ctx context.Context, txn store.Txn) (bool, error) {
+	succeeded := true
+	for _, c := range txn.Compares {
+		if t.m[c.Key] != c.Value {
+			succeeded = false
+		}
+	}
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case "put":
+			t.m[op.Key] = op.Value
+		case "delete":
+			delete(t.m, op.Key)
+		default:
+			return false, store.ErrInvalidTxn
+		}
+	}
+	return succeeded, nil
+}
+
+func (t *testStore) CompareAndSwap(key, old, new string) (bool, error) {
+	if t.m[key] != old {
+		return false, nil
+	}
+	t.m[key] = new
+	return true, nil
+}
+
+func (t *testStore) CompareAndSwapCtx(ctx context.Context, key, old, new string) (bool, error) {
+	t.idempotencyKeys = append(t.idempotencyKeys, store.IdempotencyKey(ctx))
+	return t.CompareAndSwap(key, old, new)
+}
+
+func (t *testStore) Increment(key string, delta int64) (int64, error) {
+	var n int64
+	if v, ok := t.m[key]; ok {
+		var err error
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, store.ErrNotInteger
+		}
+	}
+	n += delta
+	t.m[key] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (t *testStore) IncrementCtx(ctx context.Context, key string, delta int64) (int64, error) {
+	t.idempotencyKeys = append(t.idempotencyKeys, store.IdempotencyKey(ctx))
+	return t.Increment(key, delta)
+}
+
+func (t *testStore) Append(key, chunk string) error {
+	if t.err != nil {
+		return t.err
+	}
+	t.m[key] += chunk
+	return nil
+}
+
+func (t *testStore) AppendCtx(ctx context.Context, key, chunk string) error {
+	return t.Append(key, chunk)
+}
+
+func (t *testStore) DeleteCtx(ctx context.Context, key string) error {
+	return t.Delete(key)
+}
+
+func (t *testStore) Delete(key string) error {
+	t.deleteCalls++
+	if t.err != nil {
+		return t.err
+	}
+	delete(t.m, key)
+	delete(t.versions, key)
+	return nil
+}
+
+func (t *testStore) DeleteMulti(keys []string) (int, error) {
+	n := 0
+	for _, k := range keys {
+		if _, ok := t.m[k]; ok {
+			delete(t.m, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (t *testStore) DeleteMultiCtx(ctx context.Context, keys []string) (int, error) {
+	t.idempotencyKeys = append(t.idempotencyKeys, store.IdempotencyKey(ctx))
+	return t.DeleteMulti(keys)
+}
+
+func (t *testStore) DeletePrefix(prefix string) (int, error) {
+	n := 0
+	for k := range t.m {
+		if strings.HasPrefix(k, prefix) {
+			delete(t.m, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (t *testStore) DeletePrefixCtx(ctx context.Context, prefix string) (int, error) {
+	t.idempotencyKeys = append(t.idempotencyKeys, store.IdempotencyKey(ctx))
+	return t.DeletePrefix(prefix)
+}
+
+func (t *testStore) Flush() (int, error) {
+	if t.follower {
+		return 0, store.ErrNotLeader
+	}
+	n := len(t.m)
+	t.m = make(map[string]string)
+	return n, nil
+}
+
+func (t *testStore) Join(nodeID, addr, httpAddr string, voter bool) error {
+	t.nodes[nodeID] = addr
+	t.voter[nodeID] = voter
+	suffrage := "voter"
+	if !voter {
+		suffrage = "nonvoter"
+	}
+	t.servers = append(t.servers, store.ServerInfo{ID: nodeID, Address: addr, Suffrage: suffrage, HTTPAddr: httpAddr})
+	return nil
+}
+
+func (t *testStore) Remove(nodeID string) error {
+	if _, ok := t.nodes[nodeID]; !ok {
+		return store.ErrNodeNotFound
+	}
+	delete(t.nodes, nodeID)
+	return nil
+}
+
+func (t *testStore) Promote(nodeID string) error {
+	if t.follower {
+		return store.ErrNotLeader
+	}
+	for i := range t.servers {
+		if t.servers[i].ID == nodeID && t.servers[i].Suffrage == "nonvoter" {
+			t.servers[i].Suffrage = "voter"
+			return nil
+		}
+	}
+	return store.ErrNotNonvoter
+}
+
+func (t *testStore) NodeHTTPAddr(nodeID string) string {
+	return t.nodeHTTP[nodeID]
+}
+
+func (t *testStore) TransferLeadership(target string) error {
+	if t.follower {
+		return store.ErrNotLeader
+	}
+	if _, ok := t.nodes[target]; target != "" && !ok {
+		return store.ErrNodeNotFound
+	}
+	if t.err != nil {
+		return t.err
+	}
+	t.transfers = append(t.transfers, target)
+	return nil
+}
+
+func (t *testStore) Status() string {
+	return "Leader"
+}
+
+func (t *testStore) Snapshot() error {
+	t.snapshotCalls++
+	return t.err
+}
+
+func (t *testStore) Barrier(timeout time.Duration) error {
+	if t.follower {
+		return store.ErrNotLeader
+	}
+	return t.err
+}
+
+func (t *testStore) SetMaintenance(enabled bool) error {
+	if t.follower {
+		return store.ErrNotLeader
+	}
+	t.maintenance = enabled
+	return nil
+}
+
+func (t *testStore) Maintenance() bool {
+	return t.maintenance
+}
+
+func (t *testStore) Bootstrap() error {
+	if t.bootstrapped {
+		return store.ErrBootstrapped
+	}
+	t.bootstrapped = true
+	return nil
+}
+
+func (t *testStore) Watch(prefix string) (<-chan store.Event, func()) {
+	return t.events, func() {}
+}
+
+func (t *testStore) Backup(w io.Writer) error {
+	for k, v := range t.m {
+		fmt.Fprintf(w, "%s=%s\n", k, v)
+	}
+	return nil
+}
+
+func (t *testStore) Restore(r io.Reader, force bool) error {
+	if len(t.m) != 0 && !force {
+		return store.ErrNotEmpty
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for _, l := range strings.Fields(string(b)) {
+		kv := strings.SplitN(l, "=", 2)
+		t.m[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+func (t *testStore) Replication() ([]store.FollowerReplication, error) {
+	if t.follower {
+		return nil, store.ErrNotLeader
+	}
+	return t.replication, nil
+}
+
+func (t *testStore) Servers() ([]store.ServerInfo, error) {
+	return t.servers, nil
+}
+
+func (t *testStore) IsLeader() bool {
+	return !t.follower
+}
+
+func (t *testStore) LeaderHTTPAddr() (string, error) {
+	return t.leaderHTTP, nil
+}
+
+func (t *testStore) LeaderAddr() (string, error) {
+	return t.leader, nil
+}
+
+func (t *testStore) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&t.index)
+}
+
+func (t *testStore) RaftConfig() store.RaftConfigView {
+	c := t.raftConfig
+	c.HeartbeatTimeout, c.ElectionTimeout = "1s", "1s"
+	return c
+}
+
+func (t *testStore) ReloadRaftConfig(cfg store.RaftReloadable) error {
+	if cfg.SnapshotThreshold != nil && *cfg.SnapshotThreshold == 0 {
+		return fmt.Errorf("%w: snapshot threshold must be positive", store.ErrInvalidRaftConfig)
+	}
+	if cfg.SnapshotInterval != nil {
+		t.raftConfig.SnapshotInterval = cfg.SnapshotInterval.String()
+	}
+	if cfg.SnapshotThreshold != nil {
+		t.raftConfig.SnapshotThreshold = *cfg.SnapshotThreshold
+	}
+	if cfg.TrailingLogs != nil {
+		t.raftConfig.TrailingLogs = *cfg.TrailingLogs
+	}
+	return nil
+}
+
+func (t *testStore) Ready() bool {
+	return t.ready
+}
+
+// countingResponseWriter records how many times the status header is written.
+type countingResponseWriter struct {
+	*httptest.ResponseRecorder
+	headerWrites int
+}
+
+func (c *countingResponseWriter) WriteHeader(code int) {
+	c.headerWrites++
+	c.ResponseRecorder.WriteHeader(code)
 }
 
 func doGet(t *testing.T, url, key string) string {
@@ -0,0 +1,85 @@
+package httpd
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeSemaphore limits how many writes the store is asked to apply at once.
+// Writes beyond the limit wait up to timeout for a slot, or fail at once if
+// timeout is zero.
+type writeSemaphore struct {
+	slots   chan struct{}
+	timeout time.Duration
+	queued  prometheus.Gauge
+}
+
+func newWriteSemaphore(n int, timeout time.Duration, queued prometheus.Gauge) *writeSemaphore {
+	return &writeSemaphore{
+		slots:   make(chan struct{}, n),
+		timeout: timeout,
+		queued:  queued,
+	}
+}
+
+// acquire takes a slot, waiting for at most sem.timeout, or until ctx is done,
+// whichever is first. It returns whether a slot was taken, in which case it
+// must be given back with release.
+func (sem *writeSemaphore) acquire(ctx context.Context) bool {
+	select {
+	case sem.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if sem.timeout <= 0 {
+		return false
+	}
+
+	sem.queued.Inc()
+	defer sem.queued.Dec()
+	t := time.NewTimer(sem.timeout)
+	defer t.Stop()
+	select {
+	case sem.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (sem *writeSemaphore) release() {
+	<-sem.slots
+}
+
+// writeSlots returns the semaphore limiting concurrent writes, or nil if
+// unlimited. It is created on first use, so that the limit may be set after
+// New.
+func (s *Service) writeSlots() *writeSemaphore {
+	s.writesOnce.Do(func() {
+		if s.MaxConcurrentWrites > 0 {
+			s.writes = newWriteSemaphore(s.MaxConcurrentWrites, s.WriteQueueTimeout, s.httpMetrics().WriteQueue)
+		}
+	})
+	return s.writes
+}
+
+// acquireWrite takes a slot for the write r from the semaphore limiting
+// concurrent writes, if there is one, returning the function giving it back.
+// If no slot is free in time, a 503 response is written and false returned.
+func (s *Service) acquireWrite(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	sem := s.writeSlots()
+	if sem == nil {
+		return func() {}, true
+	}
+	if !sem.acquire(r.Context()) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, "too many concurrent writes")
+		return nil, false
+	}
+	return sem.release, true
+}
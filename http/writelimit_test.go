@@ -0,0 +1,132 @@
+package httpd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/otoolep/hraftd/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_WriteSemaphore(t *testing.T) {
+	queued := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_write_queue"})
+	sem := newWriteSemaphore(2, 0, queued)
+	for i := 0; i < 2; i++ {
+		if !sem.acquire(context.Background()) {
+			t.Fatalf("write %d within limit refused", i)
+		}
+	}
+	if sem.acquire(context.Background()) {
+		t.Fatalf("write over limit allowed")
+	}
+
+	// With a timeout, a write over the limit waits for a slot, and is
+	// counted as queued while it does.
+	sem.timeout = time.Minute
+	acquired := make(chan bool)
+	go func() { acquired <- sem.acquire(context.Background()) }()
+	for testutil.ToFloat64(queued) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	sem.release()
+	if !<-acquired {
+		t.Fatalf("queued write not given released slot")
+	}
+	if v := testutil.ToFloat64(queued); v != 0 {
+		t.Fatalf("wrong queue depth after write given slot: %v", v)
+	}
+
+	// A queued write whose request is abandoned stops waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sem.acquire(ctx) {
+		t.Fatalf("write over limit allowed for abandoned request")
+	}
+}
+
+// blockingStore is a testStore whose writes do not complete until release is
+// closed.
+type blockingStore struct {
+	*testStore
+	release chan struct{}
+}
+
+func (st blockingStore) SetCtx(ctx context.Context, key, value string) error {
+	<-st.release
+	return nil
+}
+
+// Test_MaxConcurrentWrites tests that a write over the limit of concurrent
+// writes fails with a 503, or waits for a slot if configured to, while reads
+// are unaffected.
+func Test_MaxConcurrentWrites(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		code    int
+	}{
+		{0, http.StatusServiceUnavailable},
+		{50 * time.Millisecond, http.StatusServiceUnavailable},
+		{time.Minute, http.StatusOK},
+	}
+	for _, tt := range tests {
+		st := blockingStore{newTestStore(), make(chan struct{})}
+		st.m["k1"] = "v1"
+		s := New(":0", st, nil)
+		s.Metrics = metrics.NewHTTPMetrics(metrics.Quantiles)
+		s.MaxConcurrentWrites = 1
+		s.WriteQueueTimeout = tt.timeout
+
+		put := func(key string) <-chan *httptest.ResponseRecorder {
+			ch := make(chan *httptest.ResponseRecorder, 1)
+			go func() {
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, httptest.NewRequest("PUT", "/key/"+key, strings.NewReader("v")))
+				ch <- w
+			}()
+			return ch
+		}
+
+		// Hold the only slot with a write which does not complete.
+		first := put("k2")
+		for testutil.ToFloat64(s.Metrics.InFlight.WithLabelValues("/key")) < 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/key/k1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("read refused while writes saturated: %d", w.Code)
+		}
+
+		second := put("k3")
+		if tt.code == http.StatusOK {
+			// The write waits for a slot, counted as queued, and gets
+			// one once the first write completes.
+			for testutil.ToFloat64(s.Metrics.WriteQueue) < 1 {
+				time.Sleep(time.Millisecond)
+			}
+			close(st.release)
+		}
+		w = <-second
+		if w.Code != tt.code {
+			t.Fatalf("wrong status code received for write over limit, with queue timeout %s: %d (expected %d)", tt.timeout, w.Code, tt.code)
+		}
+		if tt.code == http.StatusServiceUnavailable {
+			if w.Header().Get("Retry-After") == "" {
+				t.Fatalf("no Retry-After header on refused write")
+			}
+			close(st.release)
+		}
+		if w := <-first; w.Code != http.StatusOK {
+			t.Fatalf("wrong status code received for first write: %d", w.Code)
+		}
+		if v := testutil.ToFloat64(s.Metrics.WriteQueue); v != 0 {
+			t.Fatalf("wrong queue depth once writes complete: %v", v)
+		}
+	}
+}
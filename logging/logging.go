@@ -0,0 +1,123 @@
+// Package logging provides the leveled logger used by hraftd, whose verbosity
+// may be changed while it runs.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Logger is a logger with levels. Messages are formatted as by fmt.Printf.
+type Logger interface {
+	Debug(format string, v ...interface{})
+	Info(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+// Level is the least severe level of message a logger emits.
+type Level int32
+
+const (
+	// LevelDebug emits every message.
+	LevelDebug Level = iota
+
+	// LevelInfo emits informational messages and errors.
+	LevelInfo
+
+	// LevelError emits errors only.
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "error"}
+
+// String returns the name of the level, as accepted by ParseLevel.
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, such as "debug", case-insensitively.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+// LevelLogger is a Logger writing through a standard library logger. It is
+// safe for concurrent use, including changing its level.
+type LevelLogger struct {
+	level int32
+	l     *log.Logger
+}
+
+// New returns a LevelLogger writing to w, with each line beginning with
+// prefix. It emits messages at LevelInfo and above.
+func New(w io.Writer, prefix string) *LevelLogger {
+	return &LevelLogger{
+		level: int32(LevelInfo),
+		l:     log.New(w, prefix, log.LstdFlags),
+	}
+}
+
+// Level returns the least severe level of message emitted.
+func (l *LevelLogger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel sets the least severe level of message emitted.
+func (l *LevelLogger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Debug logs a debugging message.
+func (l *LevelLogger) Debug(format string, v ...interface{}) {
+	l.output(LevelDebug, format, v)
+}
+
+// Info logs an informational message.
+func (l *LevelLogger) Info(format string, v ...interface{}) {
+	l.output(LevelInfo, format, v)
+}
+
+// Error logs an error.
+func (l *LevelLogger) Error(format string, v ...interface{}) {
+	l.output(LevelError, format, v)
+}
+
+func (l *LevelLogger) output(level Level, format string, v []interface{}) {
+	if level < l.Level() {
+		return
+	}
+	l.l.Output(3, strings.ToUpper(level.String())+" "+fmt.Sprintf(format, v...))
+}
+
+// With returns a Logger which logs to l, with prefix inserted at the start of
+// each message, such as to identify the request it relates to.
+func With(l Logger, prefix string) Logger {
+	return &prefixLogger{l: l, prefix: prefix}
+}
+
+type prefixLogger struct {
+	l      Logger
+	prefix string
+}
+
+func (p *prefixLogger) Debug(format string, v ...interface{}) {
+	p.l.Debug("%s%s", p.prefix, fmt.Sprintf(format, v...))
+}
+
+func (p *prefixLogger) Info(format string, v ...interface{}) {
+	p.l.Info("%s%s", p.prefix, fmt.Sprintf(format, v...))
+}
+
+func (p *prefixLogger) Error(format string, v ...interface{}) {
+	p.l.Error("%s%s", p.prefix, fmt.Sprintf(format, v...))
+}
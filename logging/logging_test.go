@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_ParseLevel(t *testing.T) {
+	for _, tt := range []struct {
+		s   string
+		exp Level
+	}{
+		{"debug", LevelDebug},
+		{"INFO", LevelInfo},
+		{"Error", LevelError},
+	} {
+		l, err := ParseLevel(tt.s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", tt.s, err)
+		}
+		if l != tt.exp {
+			t.Fatalf("wrong level parsed from %q: %s", tt.s, l)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatalf("invalid level parsed without error")
+	}
+}
+
+func Test_LevelLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, "")
+	l.Debug("hidden")
+	l.Info("shown")
+	if s := buf.String(); strings.Contains(s, "hidden") || !strings.Contains(s, "INFO shown") {
+		t.Fatalf("wrong messages logged at info level: %q", s)
+	}
+
+	buf.Reset()
+	l.SetLevel(LevelDebug)
+	l.Debug("now %s", "shown")
+	if s := buf.String(); !strings.Contains(s, "DEBUG now shown") {
+		t.Fatalf("debug message not logged at debug level: %q", s)
+	}
+
+	buf.Reset()
+	l.SetLevel(LevelError)
+	l.Info("hidden")
+	l.Error("failed")
+	if s := buf.String(); strings.Contains(s, "hidden") || !strings.Contains(s, "ERROR failed") {
+		t.Fatalf("wrong messages logged at error level: %q", s)
+	}
+}
+
+func Test_With(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, "")
+	With(l, "[req] ").Info("handled %d%%", 100)
+	if s := buf.String(); !strings.Contains(s, "INFO [req] handled 100%") {
+		t.Fatalf("wrong message logged with prefix: %q", s)
+	}
+}
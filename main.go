@@ -2,17 +2,27 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/otoolep/hraftd/http"
+	"github.com/otoolep/hraftd/logging"
 	"github.com/otoolep/hraftd/metrics"
 	"github.com/otoolep/hraftd/store"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Command line defaults
@@ -21,19 +31,87 @@ const (
 	DefaultRaftAddr = ":12000"
 )
 
+// encryptionKeyEnv is the environment variable which may hold the encryption
+// key, hex-encoded, instead of a file.
+const encryptionKeyEnv = "HRAFTD_ENCRYPTION_KEY"
+
 // Command line parameters
 var inmem bool
+var boltKV bool
 var httpAddr string
 var raftAddr string
 var joinAddr string
+var nonVoter bool
 var nodeID string
+var metricsAddr string
+var redirectWrites bool
+var certFile string
+var keyFile string
+var caFile string
+var plainAddr string
+var basePath string
+var authToken string
+var quantiles string
+var enableH2C bool
+var logLevel string
+var accessLog bool
+var allowedOrigins string
+var readRate float64
+var readBurst int
+var writeRate float64
+var writeBurst int
+var maxWrites int
+var writeQueueTimeout time.Duration
+var maxKeyLength int
+var keyPattern string
+var leaderWebhook string
+var enablePprof bool
+var mountMetrics bool
+var applyTimeout time.Duration
+var maxValueSize int
+var historyDepth int
+var writePrefixDepth int
+var encryptionKeyFile string
+var noBootstrap bool
 
 func init() {
 	flag.BoolVar(&inmem, "inmem", false, "Use in-memory storage for Raft")
+	flag.BoolVar(&boltKV, "boltkv", false, "Keep keys in a BoltDB file in the Raft storage directory, instead of in memory")
 	flag.StringVar(&httpAddr, "haddr", DefaultHTTPAddr, "Set the HTTP bind address")
 	flag.StringVar(&raftAddr, "raddr", DefaultRaftAddr, "Set Raft bind address")
 	flag.StringVar(&joinAddr, "join", "", "Set join address, if any")
+	flag.BoolVar(&noBootstrap, "nobootstrap", false, "Without -join, start uninitialized, until bootstrapped with POST /bootstrap")
+	flag.BoolVar(&nonVoter, "nonvoter", false, "Join as a non-voter, which does not count towards quorum until promoted")
 	flag.StringVar(&nodeID, "id", "", "Node ID")
+	flag.StringVar(&metricsAddr, "maddr", metrics.DefaultAddr, "Set the metrics bind address, empty to serve metrics on no address of their own")
+	flag.BoolVar(&mountMetrics, "mountmetrics", false, "Also serve metrics under /metrics on the HTTP API")
+	flag.StringVar(&certFile, "cert", "", "Path to the TLS certificate for the HTTP API, enables HTTPS if set")
+	flag.StringVar(&keyFile, "key", "", "Path to the TLS private key for the HTTP API")
+	flag.StringVar(&caFile, "ca", "", "Path to the CA certificate which must have signed client certificates of joining nodes")
+	flag.StringVar(&basePath, "basepath", "", "Serve every endpoint under this path prefix, such as /hraftd")
+	flag.StringVar(&plainAddr, "plainaddr", "", "Set an additional plain HTTP bind address for clients without certificates")
+	flag.StringVar(&authToken, "token", "", "Bearer token clients must present, also sent when joining")
+	flag.StringVar(&quantiles, "quantiles", "0.5,0.9,0.99", "Comma-separated quantiles of request latency to track")
+	flag.BoolVar(&enableH2C, "h2c", false, "Also serve HTTP/2 without TLS, for clients which ask for it")
+	flag.StringVar(&logLevel, "loglevel", "info", "Log level of the HTTP API and metrics: debug, info or error")
+	flag.BoolVar(&accessLog, "accesslog", false, "Log a line, in logfmt, for every HTTP request served")
+	flag.StringVar(&allowedOrigins, "origins", "", "Comma-separated origins from which browsers may access keys, or * for any")
+	flag.Float64Var(&readRate, "readrate", 0, "Reads a second allowed per client, 0 for no limit")
+	flag.IntVar(&readBurst, "readburst", 100, "Reads a client may make at once, when -readrate is set")
+	flag.Float64Var(&writeRate, "writerate", 0, "Writes a second allowed per client, 0 for no limit")
+	flag.IntVar(&writeBurst, "writeburst", 10, "Writes a client may make at once, when -writerate is set")
+	flag.IntVar(&maxWrites, "maxwrites", httpd.DefaultMaxConcurrentWrites, "Writes this node may apply at once, 0 for no limit")
+	flag.DurationVar(&writeQueueTimeout, "writequeuetimeout", 0, "Time a write over -maxwrites waits for another to complete, before failing with a 503")
+	flag.IntVar(&maxKeyLength, "maxkeylen", httpd.DefaultMaxKeyLength, "Longest key name, in bytes, clients may use, 0 for no limit")
+	flag.StringVar(&keyPattern, "keypattern", "", "Regular expression every key name must match, if set")
+	flag.StringVar(&leaderWebhook, "webhook", "", "URL to POST a JSON event to whenever this node becomes leader")
+	flag.BoolVar(&enablePprof, "pprof", false, "Serve profiling data under /debug/pprof/ on the HTTP API")
+	flag.DurationVar(&applyTimeout, "applytimeout", store.DefaultApplyTimeout, "Time a change may take to be applied before failing with a 503")
+	flag.IntVar(&maxValueSize, "maxvaluesize", store.DefaultMaxValueSize, "Largest value, in bytes, which may be set, 0 for no limit")
+	flag.StringVar(&encryptionKeyFile, "encryptionkey", "", "Path to a file holding a hex-encoded AES key with which to encrypt the Raft log and snapshots, overriding "+encryptionKeyEnv)
+	flag.IntVar(&historyDepth, "historydepth", 0, "Number of recent values of each key retained for reads at an earlier index, 0 for none")
+	flag.IntVar(&writePrefixDepth, "writeprefixdepth", store.DefaultWritePrefixDepth, "Number of \"/\"-separated key segments by which writes are counted in metrics, 0 to not count them")
+	flag.BoolVar(&redirectWrites, "redirect", false, "Redirect writes received by followers to the leader, instead of forwarding them")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <raft-data-path> \n", os.Args[0])
 		flag.PrintDefaults()
@@ -42,7 +120,24 @@ func init() {
 
 func main() {
 	flag.Parse()
-	go metrics.Expose()
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		log.Fatalf("failed to parse log level: %s", err.Error())
+	}
+	logger := logging.New(os.Stderr, "[hraftd] ")
+	logger.SetLevel(level)
+	metrics.Logger = logger
+	if err := metrics.RegisterRaftMetrics(); err != nil {
+		log.Fatalf("failed to register Raft metrics: %s", err.Error())
+	}
+
+	if metricsAddr != "" {
+		go func() {
+			if err := metrics.ExposeOn(metricsAddr); err != nil {
+				log.Fatalf("failed to expose metrics: %s", err.Error())
+			}
+		}()
+	}
 
 	if flag.NArg() == 0 {
 		fmt.Fprintf(os.Stderr, "No Raft storage directory specified\n")
@@ -57,21 +152,79 @@ func main() {
 	}
 	os.MkdirAll(raftDir, 0700)
 
-	s := store.New(inmem)
+	var kv store.KVBackend = store.NewMemBackend()
+	if boltKV {
+		b, err := store.NewBoltBackend(filepath.Join(raftDir, "kv.db"))
+		if err != nil {
+			log.Fatalf("failed to open key-value backend: %s", err.Error())
+		}
+		defer b.Close()
+		kv = b
+	}
+
+	s := store.NewWithBackend(inmem, kv)
 	s.RaftDir = raftDir
 	s.RaftBind = raftAddr
-	if err := s.Open(joinAddr == "", nodeID); err != nil {
+	s.HTTPAddr = httpAddr
+	s.LeaderWebhook = leaderWebhook
+	s.ApplyTimeout = applyTimeout
+	s.MaxValueSize = maxValueSize
+	s.HistoryDepth = historyDepth
+	s.WritePrefixDepth = writePrefixDepth
+	if s.EncryptionKey, err = loadEncryptionKey(encryptionKeyFile); err != nil {
+		log.Fatalf("failed to load encryption key: %s", err.Error())
+	}
+	if err := s.Open(joinAddr == "" && !noBootstrap, nodeID); err != nil {
 		log.Fatalf("failed to open store: %s", err.Error())
 	}
 
-	h := httpd.New(httpAddr, s)
+	h := httpd.New(httpAddr, s, logger)
+	h.RedirectWrites = redirectWrites
+	h.CertFile = certFile
+	h.KeyFile = keyFile
+	h.PlainAddr = plainAddr
+	h.BasePath = basePath
+	h.AuthToken = authToken
+	h.EnableH2C = enableH2C
+	h.AccessLog = accessLog
+	h.EnablePprof = enablePprof
+	h.MountMetrics = mountMetrics
+	h.ReadRateLimit, h.ReadBurst = readRate, readBurst
+	h.WriteRateLimit, h.WriteBurst = writeRate, writeBurst
+	h.MaxConcurrentWrites, h.WriteQueueTimeout = maxWrites, writeQueueTimeout
+	h.MaxKeyLength = maxKeyLength
+	if keyPattern != "" {
+		re, err := regexp.Compile(keyPattern)
+		if err != nil {
+			log.Fatalf("failed to parse key pattern: %s", err.Error())
+		}
+		h.KeyPattern = re
+	}
+	if allowedOrigins != "" {
+		h.AllowedOrigins = strings.Split(allowedOrigins, ",")
+	}
+	objectives, err := metrics.ParseQuantiles(quantiles)
+	if err != nil {
+		log.Fatalf("failed to parse quantiles: %s", err.Error())
+	}
+	h.Metrics = metrics.NewHTTPMetrics(objectives)
+	if err := h.Metrics.Register(prometheus.DefaultRegisterer); err != nil {
+		log.Fatalf("failed to register metrics: %s", err.Error())
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			log.Fatalf("failed to load CA certificate: %s", err.Error())
+		}
+		h.ClientCAs = pool
+	}
 	if err := h.Start(); err != nil {
 		log.Fatalf("failed to start HTTP service: %s", err.Error())
 	}
 
 	// If join was specified, make the join request.
 	if joinAddr != "" {
-		if err := join(joinAddr, raftAddr, nodeID); err != nil {
+		if err := join(joinAddr, httpAddr, raftAddr, nodeID); err != nil {
 			log.Fatalf("failed to join node at %s: %s", joinAddr, err.Error())
 		}
 	}
@@ -80,16 +233,49 @@ func main() {
 
 	terminate := make(chan os.Signal, 1)
 	signal.Notify(terminate, os.Interrupt)
-	<-terminate
+	select {
+	case <-terminate:
+	case err := <-h.Err():
+		log.Fatalf("HTTP service failed: %s", err.Error())
+	}
 	log.Println("hraftd exiting")
+	if err := s.Close(); err != nil {
+		log.Printf("failed to close store: %s", err.Error())
+	}
 }
 
-func join(joinAddr, raftAddr, nodeID string) error {
-	b, err := json.Marshal(map[string]string{"addr": raftAddr, "id": nodeID})
+func join(joinAddr, httpAddr, raftAddr, nodeID string) error {
+	m := map[string]interface{}{"addr": raftAddr, "id": nodeID, "httpAddr": httpAddr}
+	if nonVoter {
+		m["voter"] = false
+	}
+	b, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(fmt.Sprintf("http://%s/join", joinAddr), "application-type/json", bytes.NewReader(b))
+	// Every node in a cluster is expected to serve the same scheme, and to
+	// identify itself with its own certificate when joining.
+	scheme := "http"
+	client := http.DefaultClient
+	if certFile != "" {
+		scheme = "https"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}}
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s%s/join", scheme, joinAddr, strings.TrimSuffix(basePath, "/")), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application-type/json")
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -97,3 +283,33 @@ func join(joinAddr, raftAddr, nodeID string) error {
 
 	return nil
 }
+
+// loadEncryptionKey returns the hex-encoded AES key held in the file at path,
+// if set, or otherwise in the environment variable encryptionKeyEnv. It
+// returns nil if neither is set.
+func loadEncryptionKey(path string) ([]byte, error) {
+	h := os.Getenv(encryptionKeyEnv)
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		h = string(b)
+	}
+	if h = strings.TrimSpace(h); h == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(h)
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
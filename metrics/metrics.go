@@ -1,20 +1,233 @@
 package metrics
 
 import (
-	"log"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 
+	gometrics "github.com/armon/go-metrics"
+	gometricsprom "github.com/armon/go-metrics/prometheus"
+	"github.com/otoolep/hraftd/logging"
+	"github.com/otoolep/hraftd/version"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const metricsPort = ":9100"
+// DefaultAddr is the address metrics are exposed on by Expose.
+const DefaultAddr = ":9100"
 
+// Logger is the logger used when exposing metrics.
+var Logger logging.Logger = logging.New(os.Stderr, "[metrics] ")
+
+// Quantiles are the default quantile objectives, mapped to their allowed
+// error, of request summaries.
 var Quantiles = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
 
+// ParseQuantiles parses a comma-separated list of quantiles, such as
+// "0.5,0.9,0.99,0.999", into objectives. The allowed error of each is a tenth
+// of the distance from the quantile to 1, as it is for the defaults.
+func ParseQuantiles(s string) (map[float64]float64, error) {
+	objectives := make(map[float64]float64)
+	for _, f := range strings.Split(s, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || q <= 0 || q >= 1 {
+			return nil, fmt.Errorf("invalid quantile %q", f)
+		}
+		objectives[q] = (1 - q) / 10
+	}
+	return objectives, nil
+}
+
+// Buckets are the upper bounds, in seconds, of latency histograms. They span
+// local reads through to writes waiting out a Raft timeout.
+var Buckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	// RaftState is 1 for the Raft state the node is in, labelled in lower
+	// case, and 0 for every other state.
+	RaftState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "raft_state",
+		Help: "Current Raft state of the node",
+	}, []string{"state"})
+
+	// RaftLastLogIndex is the index of the last entry in the node's Raft log.
+	RaftLastLogIndex = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "raft_last_log_index",
+		Help: "Index of the last entry in the Raft log",
+	})
+
+	// RaftCommitIndex is the index of the last entry known to be committed.
+	RaftCommitIndex = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "raft_commit_index",
+		Help: "Index of the last committed Raft log entry",
+	})
+
+	// BuildInfo is always 1, labelled with the version and commit of the
+	// running binary.
+	BuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "build_info",
+		Help: "Version and commit hraftd was built from",
+	}, []string{"version", "commit"})
+
+	// RaftAppliedIndex is the index of the last entry applied to the store.
+	RaftAppliedIndex = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "raft_applied_index",
+		Help: "Index of the last Raft log entry applied to the store",
+	})
+)
+
+// HTTP are the metrics recorded by the HTTP service.
+type HTTP struct {
+	Requests *prometheus.SummaryVec
+	Errors   *prometheus.CounterVec
+	Duration *prometheus.HistogramVec
+
+	// InFlight is the number of requests being served, by endpoint, which
+	// shows whether latency comes from requests queuing.
+	InFlight *prometheus.GaugeVec
+
+	// Breaker is the state of the circuit breaker guarding writes to the
+	// store: 0 when closed, 1 when open, and 2 when half-open.
+	Breaker prometheus.Gauge
+
+	// Panics counts requests whose handler panicked, and which were
+	// answered with a 500 rather than crashing.
+	Panics prometheus.Counter
+
+	// WriteQueue is the number of writes waiting for one of the limited
+	// number of concurrent writes to complete.
+	WriteQueue prometheus.Gauge
+}
+
+// NewHTTPMetrics returns unregistered HTTP service metrics, whose request
+// summary tracks the given quantile objectives.
+func NewHTTPMetrics(objectives map[float64]float64) *HTTP {
+	return &HTTP{
+		Requests: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:       "http_requests",
+			Help:       "HTTP requests to the hraftd service",
+			Objectives: objectives,
+		}, []string{"endpoint", "method"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_request_errors",
+			Help: "Failed HTTP requests to the hraftd service",
+		}, []string{"endpoint", "method", "status"}),
+		Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of HTTP requests to the hraftd service",
+			Buckets: Buckets,
+		}, []string{"endpoint", "method"}),
+		InFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests to the hraftd service currently being served",
+		}, []string{"endpoint"}),
+		Breaker: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_store_breaker_state",
+			Help: "State of the circuit breaker guarding store writes: 0 closed, 1 open, 2 half-open",
+		}),
+		Panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "http_panics_total",
+			Help: "HTTP requests to the hraftd service whose handler panicked",
+		}),
+		WriteQueue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_write_queue_depth",
+			Help: "Writes waiting for a slot among the concurrent writes allowed",
+		}),
+	}
+}
+
+// Register registers the metrics with r. Any already registered there are
+// reused, as Register does.
+func (m *HTTP) Register(r prometheus.Registerer) error {
+	for _, c := range []interface{}{&m.Requests, &m.Errors, &m.Duration, &m.InFlight, &m.Breaker, &m.Panics, &m.WriteQueue} {
+		if err := Register(r, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register registers the collector held by the variable c points to with r.
+// If an identical collector, of the same type, is already registered, the
+// variable is set to it instead, so that registering the same metrics twice,
+// such as when a package is loaded twice, reuses them rather than failing.
+func Register(r prometheus.Registerer, c interface{}) error {
+	v := reflect.ValueOf(c).Elem()
+	err := r.Register(v.Interface().(prometheus.Collector))
+	are, ok := err.(prometheus.AlreadyRegisteredError)
+	if !ok {
+		return err
+	}
+	existing := reflect.ValueOf(are.ExistingCollector)
+	if !existing.Type().AssignableTo(v.Type()) {
+		return err
+	}
+	v.Set(existing)
+	return nil
+}
+
+// MustRegister registers each of the collectors held by the variables cs
+// point to with the default registry, as Register does, panicking if any
+// conflicts with one already registered.
+func MustRegister(cs ...interface{}) {
+	for _, c := range cs {
+		if err := Register(prometheus.DefaultRegisterer, c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterRaftMetrics bridges the metrics hashicorp/raft records internally,
+// via go-metrics, into the default Prometheus registry, under names prefixed
+// "raft_". It must be called at most once, before Raft is started.
+func RegisterRaftMetrics() error {
+	sink, err := gometricsprom.NewPrometheusSink()
+	if err != nil {
+		return err
+	}
+	conf := gometrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false // Already collected by Prometheus.
+	_, err = gometrics.NewGlobal(conf, sink)
+	return err
+}
+
+func init() {
+	MustRegister(&RaftState, &RaftLastLogIndex, &RaftCommitIndex, &RaftAppliedIndex, &BuildInfo)
+	BuildInfo.WithLabelValues(version.Version, version.Commit).Set(1)
+}
+
+// Expose serves metrics on DefaultAddr, exiting the process on failure.
 func Expose() {
-	log.Printf("Metrics exposed on %s", metricsPort)
-	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe(metricsPort, nil); err != nil {
-		log.Fatalf("Error exposing metrics: %v", err)
+	if err := ExposeOn(DefaultAddr); err != nil {
+		Logger.Error("Error exposing metrics: %v", err)
+		os.Exit(1)
+	}
+}
+
+// ExposeOn serves metrics on addr. It blocks until serving fails, and returns
+// the error.
+func ExposeOn(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
+	return serve(ln)
+}
+
+func serve(ln net.Listener) error {
+	Logger.Info("Metrics exposed on %s", ln.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.Serve(ln, mux)
+}
+
+// Handler returns a handler serving metrics, in Prometheus format, for
+// mounting alongside other handlers rather than on an address of its own.
+func Handler() http.Handler {
+	return promhttp.Handler()
 }
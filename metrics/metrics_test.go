@@ -0,0 +1,166 @@
+package metrics_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/otoolep/hraftd/http"
+	"github.com/otoolep/hraftd/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// leaderlessStore is a store which knows of no leader. The requests made
+// against it in these tests fail before reaching the store.
+type leaderlessStore struct {
+	httpd.Store
+}
+
+func (leaderlessStore) LeaderHTTPAddr() (string, error) {
+	return "", nil
+}
+
+// Test_ExposeOn tests that metrics can be scraped from a configured address.
+func Test_ExposeOn(t *testing.T) {
+	// Find a free port for the metrics server.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find free port: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- metrics.ExposeOn(addr)
+	}()
+
+	// Make a request so the HTTP service records a sample.
+	s := httpd.New(":0", leaderlessStore{}, nil)
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/key/", nil))
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nope", nil))
+
+	var body string
+	for i := 0; i < 50; i++ {
+		select {
+		case err := <-errCh:
+			t.Fatalf("failed to expose metrics: %s", err)
+		default:
+		}
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read metrics: %s", err)
+		}
+		body = string(b)
+		break
+	}
+
+	if !strings.Contains(body, "http_requests") {
+		t.Fatalf("metrics do not contain http_requests:\n%s", body)
+	}
+	for _, series := range []string{
+		`http_request_duration_seconds_bucket{endpoint="/key",method="GET",le="0.001"}`,
+		`http_request_duration_seconds_bucket{endpoint="unknown",method="GET",le="+Inf"}`,
+		`build_info{commit="unknown",version="dev"} 1`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Fatalf("metrics do not contain %s:\n%s", series, body)
+		}
+	}
+}
+
+// Test_NewHTTPMetrics tests that request summaries track the quantiles they
+// are created with.
+func Test_NewHTTPMetrics(t *testing.T) {
+	objectives, err := metrics.ParseQuantiles("0.5, 0.999")
+	if err != nil {
+		t.Fatalf("failed to parse quantiles: %s", err)
+	}
+	if _, ok := objectives[0.999]; !ok || len(objectives) != 2 {
+		t.Fatalf("wrong objectives parsed: %v", objectives)
+	}
+	if _, err := metrics.ParseQuantiles("0.5,1"); err == nil {
+		t.Fatalf("invalid quantile parsed")
+	}
+
+	reg := prometheus.NewRegistry()
+	m := metrics.NewHTTPMetrics(objectives)
+	if err := m.Register(reg); err != nil {
+		t.Fatalf("failed to register metrics: %s", err)
+	}
+
+	s := httpd.New(":0", leaderlessStore{}, nil)
+	s.Metrics = m
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/key/", nil))
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, series := range []string{
+		`http_requests{endpoint="/key",method="GET",quantile="0.999"}`,
+		`http_request_errors{endpoint="/key",method="GET",status="400"} 1`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Fatalf("metrics do not contain %s:\n%s", series, body)
+		}
+	}
+	if strings.Contains(body, `quantile="0.9"`) {
+		t.Fatalf("metrics contain a default quantile:\n%s", body)
+	}
+}
+
+// Test_RegisterTwice tests that services can each register their metrics
+// with a registry of their own, and that registering metrics already
+// registered reuses them, rather than failing.
+func Test_RegisterTwice(t *testing.T) {
+	var services []*httpd.Service
+	var regs []*prometheus.Registry
+	for i := 0; i < 2; i++ {
+		reg := prometheus.NewRegistry()
+		m := metrics.NewHTTPMetrics(metrics.Quantiles)
+		if err := m.Register(reg); err != nil {
+			t.Fatalf("failed to register metrics: %s", err)
+		}
+		s := httpd.New(":0", leaderlessStore{}, nil)
+		s.Metrics = m
+		services = append(services, s)
+		regs = append(regs, reg)
+	}
+	services[0].ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/key/", nil))
+	services[1].ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/key/", nil))
+	services[1].ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/key/", nil))
+	for i, reg := range regs {
+		w := httptest.NewRecorder()
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		series := fmt.Sprintf(`http_request_errors{endpoint="/key",method="GET",status="400"} %d`, i+1)
+		if !strings.Contains(w.Body.String(), series) {
+			t.Fatalf("metrics of service %d do not contain %s:\n%s", i, series, w.Body.String())
+		}
+	}
+
+	m := metrics.NewHTTPMetrics(metrics.Quantiles)
+	if err := m.Register(regs[0]); err != nil {
+		t.Fatalf("failed to register metrics a second time: %s", err)
+	}
+	if m.Errors != services[0].Metrics.Errors || m.Breaker != services[0].Metrics.Breaker {
+		t.Fatalf("metrics registered a second time not reused")
+	}
+
+	conflict := prometheus.NewGauge(prometheus.GaugeOpts{Name: "http_request_errors", Help: "Failed HTTP requests to the hraftd service"})
+	if err := metrics.Register(regs[0], &conflict); err == nil {
+		t.Fatalf("conflicting metric registered")
+	}
+}
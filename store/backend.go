@@ -0,0 +1,144 @@
+package store
+
+import (
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVBackend holds the keys and values of a Store. The Store serializes all
+// access, so implementations need not be safe for concurrent use.
+//
+// A Store rebuilds its keys from the Raft log and snapshots when it starts,
+// so a backend need not be durable, and should start out empty.
+type KVBackend interface {
+	// Get returns the value of key, and whether it is present.
+	Get(key string) (value string, ok bool, err error)
+
+	// Set sets key to value.
+	Set(key, value string) error
+
+	// Delete deletes key, if present.
+	Delete(key string) error
+
+	// Iterate calls fn for every key, in no particular order, until fn
+	// returns false. fn must not modify the backend.
+	Iterate(fn func(key, value string) bool) error
+}
+
+// MemBackend is a KVBackend holding keys in memory. It is the default.
+type MemBackend struct {
+	m map[string]string
+}
+
+// NewMemBackend returns an empty MemBackend.
+func NewMemBackend() *MemBackend {
+	return &MemBackend{m: make(map[string]string)}
+}
+
+// Get implements KVBackend.
+func (b *MemBackend) Get(key string) (string, bool, error) {
+	v, ok := b.m[key]
+	return v, ok, nil
+}
+
+// Set implements KVBackend.
+func (b *MemBackend) Set(key, value string) error {
+	b.m[key] = value
+	return nil
+}
+
+// Delete implements KVBackend.
+func (b *MemBackend) Delete(key string) error {
+	delete(b.m, key)
+	return nil
+}
+
+// Iterate implements KVBackend.
+func (b *MemBackend) Iterate(fn func(key, value string) bool) error {
+	for k, v := range b.m {
+		if !fn(k, v) {
+			break
+		}
+	}
+	return nil
+}
+
+var boltBucket = []byte("kv")
+
+// boltKey returns the BoltDB key under which key is kept. BoltDB does not
+// accept empty keys, but a Store does, so every key is given a prefix.
+func boltKey(key string) []byte {
+	return append([]byte{'k'}, key...)
+}
+
+// BoltBackend is a KVBackend holding keys in a BoltDB file, so that the key
+// set may be larger than memory.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+// NewBoltBackend returns a BoltBackend keeping keys in the file at path. Any
+// existing file is removed first, since the Store rebuilds its keys from Raft.
+// Writes are not synced to disk, for the same reason.
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = true
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+// Get implements KVBackend.
+func (b *BoltBackend) Get(key string) (value string, ok bool, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltBucket).Get(boltKey(key)); v != nil {
+			value, ok = string(v), true
+		}
+		return nil
+	})
+	return value, ok, err
+}
+
+// Set implements KVBackend.
+func (b *BoltBackend) Set(key, value string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(boltKey(key), []byte(value))
+	})
+}
+
+// Delete implements KVBackend.
+func (b *BoltBackend) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(boltKey(key))
+	})
+}
+
+// Iterate implements KVBackend. Keys are visited in byte order.
+func (b *BoltBackend) Iterate(fn func(key, value string) bool) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !fn(string(k[1:]), string(v)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the BoltDB file.
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
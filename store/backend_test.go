@@ -0,0 +1,95 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBackends returns each KVBackend implementation, empty, by name, and a
+// function to call once they are no longer needed.
+func testBackends(t *testing.T) (map[string]KVBackend, func()) {
+	dir, err := ioutil.TempDir("", "backend_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	b, err := NewBoltBackend(filepath.Join(dir, "kv.db"))
+	if err != nil {
+		t.Fatalf("failed to create bolt backend: %s", err)
+	}
+	return map[string]KVBackend{
+		"mem":  NewMemBackend(),
+		"bolt": b,
+	}, func() {
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Test_FSMBackends tests that the FSM behaves the same whichever backend
+// holds its keys.
+func Test_FSMBackends(t *testing.T) {
+	backends, cleanup := testBackends(t)
+	defer cleanup()
+	for name, kv := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := NewWithBackend(true, kv)
+			f := (*fsm)(s)
+
+			applyCommand(t, f, &command{Op: "set", Key: "a", Value: "1"})
+			applyCommand(t, f, &command{Op: "set", Key: "", Value: ""})
+			applyCommand(t, f, &command{Op: "setmulti", Values: map[string]string{"b/1": "x", "b/2": "y"}})
+			if ok := applyCommand(t, f, &command{Op: "cas", Key: "a", Old: "1", Value: "2"}); ok != true {
+				t.Fatalf("compare-and-swap failed")
+			}
+			if n := applyCommand(t, f, &command{Op: "incr", Key: "a", Delta: 3}); n != int64(5) {
+				t.Fatalf("wrong result of increment: %v", n)
+			}
+			if n := applyCommand(t, f, &command{Op: "deleteprefix", Key: "b/"}); n != 2 {
+				t.Fatalf("wrong number of keys deleted by prefix: %v", n)
+			}
+			applyCommand(t, f, &command{Op: "set", Key: "c", Value: "3"})
+			applyCommand(t, f, &command{Op: "delete", Key: "c"})
+
+			exp := map[string]string{"a": "5", "": ""}
+			checkKeys := func(s *Store) {
+				t.Helper()
+				m, err := s.Scan("")
+				if err != nil {
+					t.Fatalf("failed to scan: %s", err)
+				}
+				if len(m) != len(exp) || s.keys != len(exp) {
+					t.Fatalf("wrong keys: %v (%d counted)", m, s.keys)
+				}
+				for k, v := range exp {
+					if m[k] != v {
+						t.Fatalf("wrong value for key %q: %q", k, m[k])
+					}
+				}
+				if s.size != 1 {
+					t.Fatalf("wrong size: %d", s.size)
+				}
+			}
+			checkKeys(s)
+
+			snap, err := f.Snapshot()
+			if err != nil {
+				t.Fatalf("failed to snapshot: %s", err)
+			}
+			b, err := json.Marshal(snap)
+			if err != nil {
+				t.Fatalf("failed to encode snapshot: %s", err)
+			}
+
+			// Restoring replaces any keys already present.
+			applyCommand(t, f, &command{Op: "set", Key: "d", Value: "4"})
+			if err := f.Restore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+				t.Fatalf("failed to restore snapshot: %s", err)
+			}
+			checkKeys(s)
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// encryptedMagic prefixes log entries and snapshots encrypted by the store.
+// Plaintext ones are JSON, so never begin with it, which lets a store given
+// a key still read what was written before it had one.
+var encryptedMagic = []byte("\x00hraftd-aes-gcm\x00")
+
+// ErrNoEncryptionKey is returned when reading an encrypted log entry or
+// snapshot without an encryption key.
+var ErrNoEncryptionKey = errors.New("data is encrypted, but no encryption key is set")
+
+// newAEAD returns AES-GCM keyed by key, which must be 16, 24 or 32 bytes long.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns b encrypted with aead, under a random nonce, or b itself if
+// aead is nil.
+func seal(aead cipher.AEAD, b []byte) ([]byte, error) {
+	if aead == nil {
+		return b, nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, encryptedMagic...), nonce...)
+	return aead.Seal(out, nonce, b, nil), nil
+}
+
+// open returns b, sealed by seal, decrypted with aead. b is returned as is if
+// it was never encrypted.
+func open(aead cipher.AEAD, b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, encryptedMagic) {
+		return b, nil
+	}
+	if aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+	b = b[len(encryptedMagic):]
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+}
@@ -0,0 +1,106 @@
+package store
+
+import "errors"
+
+// ErrHistoryPruned is returned when reading a key as of a log index older
+// than the history retained for it.
+var ErrHistoryPruned = errors.New("version no longer retained")
+
+// historyEntry is the value a key was given by the log entry at index, or its
+// deletion by it.
+type historyEntry struct {
+	index   uint64
+	value   string
+	deleted bool
+}
+
+// keyHistory is the recent history of a key, oldest first. pruned is whether
+// earlier changes to the key were made but not retained, so that the key's
+// value before the oldest entry is unknown.
+type keyHistory struct {
+	entries []historyEntry
+	pruned  bool
+}
+
+// recordHistory notes that the log entry being applied set key to value, or
+// deleted it. existed is whether the key was present beforehand. f.mu must be
+// held.
+func (f *fsm) recordHistory(key, value string, deleted, existed bool) {
+	if f.HistoryDepth <= 0 {
+		return
+	}
+	h, ok := f.history[key]
+	if !ok {
+		// The key's earlier values, if it had any, were never recorded.
+		h = &keyHistory{pruned: existed}
+		f.history[key] = h
+	}
+	h.entries = append(h.entries, historyEntry{index: f.applyIndex, value: value, deleted: deleted})
+	if n := len(h.entries) - f.HistoryDepth; n > 0 {
+		h.entries = append(h.entries[:0], h.entries[n:]...)
+		h.pruned = true
+	}
+	if deleted {
+		f.deletedHistories = append(f.deletedHistories, key)
+		f.dropDeletedHistories()
+	}
+}
+
+// dropDeletedHistories drops the history of the keys deleted longest ago,
+// until that of at most MaxDeletedHistories deleted keys is retained. Keys
+// which were set again since being deleted are skipped, since their history
+// is that of a present key. f.mu must be held.
+func (f *fsm) dropDeletedHistories() {
+	for len(f.deletedHistories) > f.MaxDeletedHistories {
+		key := f.deletedHistories[0]
+		f.deletedHistories = f.deletedHistories[1:]
+		h, ok := f.history[key]
+		if !ok {
+			continue
+		}
+		last := h.entries[len(h.entries)-1]
+		if !last.deleted {
+			continue
+		}
+		delete(f.history, key)
+		if last.index > f.historyDropped {
+			f.historyDropped = last.index
+		}
+	}
+}
+
+// GetAt returns the value key had once the log entry at index was applied, on
+// this node. ErrKeyNotFound is returned if the key was not present then, and
+// ErrHistoryPruned if that is no longer known. At most HistoryDepth values are
+// retained per key, none from before the node last restored a snapshot, and
+// none of keys deleted before the last MaxDeletedHistories deletions.
+func (s *Store) GetAt(key string, index uint64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.history[key]
+	if !ok {
+		// The key has not changed since history was last recorded, so its
+		// current value may or may not be the one it had at index.
+		// Likewise if its history may have been dropped after it was
+		// deleted.
+		if _, ok := (*fsm)(s).get(key); ok || index < s.historyDropped {
+			return "", ErrHistoryPruned
+		}
+		return "", ErrKeyNotFound
+	}
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if e.index > index {
+			continue
+		}
+		if e.deleted {
+			return "", ErrKeyNotFound
+		}
+		return e.value, nil
+	}
+	if h.pruned {
+		return "", ErrHistoryPruned
+	}
+	return "", ErrKeyNotFound
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+)
+
+// idempotencyCacheSize is how many results of commands carrying idempotency
+// keys are remembered. Past this, the least recently used are forgotten.
+const idempotencyCacheSize = 10000
+
+type idempotencyContextKey struct{}
+
+// WithIdempotencyKey returns a context which makes a change made with it
+// idempotent. Once a change carrying the idempotency key has been applied, a
+// later one carrying the same key, and applying the same operation to the same
+// key, is not applied again, but returns the result of the first, so long as
+// that result is still remembered. A change refused with an error, such as
+// ErrMaintenance, was not applied, so may be retried with the same key.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyContextKey{}, key)
+}
+
+// IdempotencyKey returns the idempotency key of ctx, as given to
+// WithIdempotencyKey, or the empty string if there is none.
+func IdempotencyKey(ctx context.Context) string {
+	k, _ := ctx.Value(idempotencyContextKey{}).(string)
+	return k
+}
+
+// idempotentResult is the result of a command carrying an idempotency key.
+// Value holds the result as it is persisted in snapshots. Error is only set in
+// snapshots taken when refusals were remembered too, and such results are not
+// restored.
+type idempotentResult struct {
+	ID    string          `json:"id"`
+	Op    string          `json:"op"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Error string          `json:"error,omitempty"`
+
+	result interface{}
+}
+
+// idempotencyCache is a bounded LRU cache of the results of commands carrying
+// idempotency keys. It is part of the FSM, so every node applies the same
+// sequence of lookups and insertions, and so remembers the same results.
+type idempotencyCache struct {
+	order *list.List // Of *idempotentResult, most recently used first.
+	byID  map[string]*list.Element
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{order: list.New(), byID: make(map[string]*list.Element)}
+}
+
+// idempotencyID returns the ID under which the result of c is remembered, or
+// the empty string if c carries no idempotency key.
+func idempotencyID(c *command) string {
+	if c.IdempotencyKey == "" {
+		return ""
+	}
+	return c.IdempotencyKey + "\x00" + c.Op + "\x00" + c.Key
+}
+
+func (i *idempotencyCache) get(id string) (interface{}, bool) {
+	e, ok := i.byID[id]
+	if !ok {
+		return nil, false
+	}
+	i.order.MoveToFront(e)
+	return e.Value.(*idempotentResult).result, true
+}
+
+func (i *idempotencyCache) put(r *idempotentResult) {
+	i.byID[r.ID] = i.order.PushFront(r)
+	for i.order.Len() > idempotencyCacheSize {
+		e := i.order.Back()
+		i.order.Remove(e)
+		delete(i.byID, e.Value.(*idempotentResult).ID)
+	}
+}
+
+// record remembers result, returned by applying op, under id. result must
+// not be an error.
+func (i *idempotencyCache) record(id, op string, result interface{}) {
+	r := &idempotentResult{ID: id, Op: op, result: result}
+	if result != nil {
+		r.Value, _ = json.Marshal(result)
+	}
+	i.put(r)
+}
+
+// results returns the remembered results, least recently used first.
+func (i *idempotencyCache) results() []*idempotentResult {
+	o := make([]*idempotentResult, 0, i.order.Len())
+	for e := i.order.Back(); e != nil; e = e.Prev() {
+		o = append(o, e.Value.(*idempotentResult))
+	}
+	return o
+}
+
+// restoreIdempotencyCache returns a cache remembering results, as returned
+// by results.
+func restoreIdempotencyCache(results []*idempotentResult) (*idempotencyCache, error) {
+	i := newIdempotencyCache()
+	for _, r := range results {
+		if r.Error != "" {
+			continue
+		}
+		if r.Value != nil {
+			if err := r.decodeValue(); err != nil {
+				return nil, err
+			}
+		}
+		i.put(r)
+	}
+	return i, nil
+}
+
+// decodeValue sets r.result from r.Value, as the type returned by r.Op.
+func (r *idempotentResult) decodeValue() error {
+	switch r.Op {
+	case "incr":
+		var n int64
+		if err := json.Unmarshal(r.Value, &n); err != nil {
+			return err
+		}
+		r.result = n
+	case "cas", "txn":
+		var b bool
+		if err := json.Unmarshal(r.Value, &b); err != nil {
+			return err
+		}
+		r.result = b
+	case "deleteprefix", "deletemulti", "flush":
+		var n int
+		if err := json.Unmarshal(r.Value, &n); err != nil {
+			return err
+		}
+		r.result = n
+	}
+	return nil
+}
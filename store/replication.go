@@ -0,0 +1,207 @@
+package store
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// FollowerReplication describes how far a follower is behind the leader.
+type FollowerReplication struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+
+	// LastContact is when the follower last answered the leader, or nil if
+	// it has not since this node became leader.
+	LastContact *time.Time `json:"lastContact,omitempty"`
+
+	// MatchIndex is the index of the last log entry the follower is known
+	// to hold, and Lag how many entries the leader's log has beyond it.
+	MatchIndex uint64 `json:"matchIndex"`
+	Lag        uint64 `json:"lag"`
+}
+
+// followerProgress is what a progressTransport knows of a follower, as of
+// the term in which it was learned.
+type followerProgress struct {
+	term        uint64
+	lastContact time.Time
+	matchIndex  uint64
+}
+
+// progressTransport is a raft.Transport recording, from the responses to the
+// RPCs sent by a leader, how far each follower has replicated the log. The
+// raft library tracks this itself, but does not expose it.
+type progressTransport struct {
+	raft.Transport
+
+	mu       sync.Mutex
+	progress map[raft.ServerID]followerProgress
+}
+
+func newProgressTransport(t raft.Transport) *progressTransport {
+	return &progressTransport{
+		Transport: t,
+		progress:  make(map[raft.ServerID]followerProgress),
+	}
+}
+
+// record notes a successful AppendEntries RPC to the follower id.
+func (t *progressTransport) record(id raft.ServerID, req *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.progress[id]
+	if p.term != req.Term {
+		p = followerProgress{term: req.Term}
+	}
+	p.lastContact = time.Now()
+	if resp.Success {
+		// Heartbeats carry no log position, so say nothing of the match.
+		if n := len(req.Entries); n > 0 {
+			p.matchIndex = req.Entries[n-1].Index
+		} else if req.PrevLogEntry > 0 {
+			p.matchIndex = req.PrevLogEntry
+		}
+	}
+	t.progress[id] = p
+}
+
+// get returns what is known of the follower id, if it was learned during
+// term. What was learned as leader in an earlier term no longer holds.
+func (t *progressTransport) get(id raft.ServerID, term uint64) (followerProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.progress[id]
+	return p, ok && p.term == term
+}
+
+func (t *progressTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	if err := t.Transport.AppendEntries(id, target, args, resp); err != nil {
+		return err
+	}
+	t.record(id, args, resp)
+	return nil
+}
+
+func (t *progressTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	if err := t.Transport.InstallSnapshot(id, target, args, resp, data); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.progress[id]
+	if p.term != args.Term {
+		p = followerProgress{term: args.Term}
+	}
+	p.lastContact = time.Now()
+	if resp.Success {
+		p.matchIndex = args.LastLogIndex
+	}
+	t.progress[id] = p
+	return nil
+}
+
+func (t *progressTransport) AppendEntriesPipeline(id raft.ServerID, target raft.ServerAddress) (raft.AppendPipeline, error) {
+	p, err := t.Transport.AppendEntriesPipeline(id, target)
+	if err != nil {
+		return nil, err
+	}
+	pp := &progressPipeline{
+		AppendPipeline: p,
+		t:              t,
+		id:             id,
+		consumer:       make(chan raft.AppendFuture),
+		done:           make(chan struct{}),
+	}
+	go pp.relay()
+	return pp, nil
+}
+
+// Close closes the underlying transport, if it may be closed.
+func (t *progressTransport) Close() error {
+	if c, ok := t.Transport.(raft.WithClose); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// progressPipeline records the responses to pipelined AppendEntries RPCs as
+// they are consumed.
+type progressPipeline struct {
+	raft.AppendPipeline
+	t        *progressTransport
+	id       raft.ServerID
+	consumer chan raft.AppendFuture
+
+	once sync.Once
+	done chan struct{}
+}
+
+// relay passes on the futures of the underlying pipeline, once complete.
+func (p *progressPipeline) relay() {
+	for {
+		select {
+		case f := <-p.AppendPipeline.Consumer():
+			if f.Error() == nil {
+				p.t.record(p.id, f.Request(), f.Response())
+			}
+			select {
+			case p.consumer <- f:
+			case <-p.done:
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *progressPipeline) Consumer() <-chan raft.AppendFuture {
+	return p.consumer
+}
+
+func (p *progressPipeline) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return p.AppendPipeline.Close()
+}
+
+// Replication returns how far each follower is behind this node, which must
+// be the leader. ErrNotLeader is returned otherwise.
+func (s *Store) Replication() ([]FollowerReplication, error) {
+	if s.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+
+	term, _ := strconv.ParseUint(s.raft.Stats()["term"], 10, 64)
+	last := s.raft.LastIndex()
+	followers := []FollowerReplication{}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(s.localID) {
+			continue
+		}
+		f := FollowerReplication{
+			ID:      string(srv.ID),
+			Address: string(srv.Address),
+			Lag:     last,
+		}
+		if p, ok := s.progress.get(srv.ID, term); ok {
+			lc := p.lastContact
+			f.LastContact = &lc
+			f.MatchIndex = p.matchIndex
+			if p.matchIndex < last {
+				f.Lag = last - p.matchIndex
+			} else {
+				f.Lag = 0
+			}
+		}
+		followers = append(followers, f)
+	}
+	return followers, nil
+}
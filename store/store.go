@@ -8,51 +8,336 @@
 package store
 
 import (
+	"context"
+	"crypto/cipher"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
-	"github.com/hashicorp/raft-boltdb"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/otoolep/hraftd/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultApplyTimeout is the default time a change may take to be applied.
+	DefaultApplyTimeout = 10 * time.Second
+
+	// DefaultMaxValueSize is the default limit, in bytes, on values.
+	DefaultMaxValueSize = 1 << 20
+
+	// DefaultWritePrefixDepth is the default depth of the key prefixes by
+	// which changes are counted.
+	DefaultWritePrefixDepth = 1
+
+	// DefaultMaxWritePrefixes is the default number of key prefixes by
+	// which changes are counted, before the rest are counted as "other".
+	DefaultMaxWritePrefixes = 100
+
+	// DefaultMaxDeletedHistories is the default number of deleted keys
+	// whose history is retained.
+	DefaultMaxDeletedHistories = 1000
 )
 
 const (
 	retainSnapshotCount = 2
 	raftTimeout         = 10 * time.Second
+	expiryScanInterval  = time.Second
+	restoreBatchSize    = 1000
+	watchBufferSize     = 64
+	metricsInterval     = time.Second
+	leaderPollInterval  = 10 * time.Millisecond
+)
+
+var (
+	// ErrKeyNotFound is returned when a requested key is not present in the store.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrNotInteger is returned when incrementing a key whose value is not an integer.
+	ErrNotInteger = errors.New("value is not an integer")
+
+	// ErrNotLeader is returned when an operation requires the leader, but
+	// this node is not the leader.
+	ErrNotLeader = errors.New("not leader")
+
+	// ErrNodeNotFound is returned when a node is not part of the cluster.
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrNotNonvoter is returned when promoting a node which is not a
+	// non-voter in the cluster.
+	ErrNotNonvoter = errors.New("node is not a non-voter")
+
+	// ErrNotEmpty is returned when restoring into a store which has keys,
+	// without forcing the restore.
+	ErrNotEmpty = errors.New("store is not empty")
+
+	// ErrVersionMismatch is returned when a conditional write finds the key
+	// at a version other than the one expected.
+	ErrVersionMismatch = errors.New("version mismatch")
+
+	// ErrApplyTimeout is returned when a change is not applied within the
+	// store's ApplyTimeout. It may still be applied later.
+	ErrApplyTimeout = errors.New("timed out applying change")
+
+	// ErrValueTooLarge is returned when setting a value longer than the
+	// store's MaxValueSize.
+	ErrValueTooLarge = errors.New("value too large")
+
+	// ErrBootstrapped is returned when bootstrapping a node which already has
+	// Raft state, having been bootstrapped or joined a cluster before.
+	ErrBootstrapped = errors.New("node already bootstrapped")
+
+	// ErrInvalidRaftConfig is returned when reloading Raft tuning which is
+	// out of range.
+	ErrInvalidRaftConfig = errors.New("invalid Raft tuning")
+
+	// ErrMaintenance is returned when changing keys while the cluster is in
+	// maintenance mode.
+	ErrMaintenance = errors.New("writes are disabled for maintenance")
+)
+
+var (
+	raftApplyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "raft_apply_errors_total",
+		Help: "Commands which failed to be applied via Raft, by operation",
+	}, []string{"op"})
+	kvKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kv_keys_total",
+		Help: "Number of keys in the store",
+	})
+	kvBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kv_bytes_total",
+		Help: "Total size, in bytes, of the values in the store",
+	})
+	kvWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kv_writes_total",
+		Help: "Changes applied to keys, by key prefix",
+	}, []string{"prefix"})
+)
+
+func init() {
+	metrics.MustRegister(&raftApplyErrors, &kvKeys, &kvBytes, &kvWrites)
+}
+
+// ConsistencyLevel controls how up to date a read must be.
+type ConsistencyLevel int
+
+const (
+	// Stale reads are served from local state, on any node, and so may not
+	// reflect the latest writes.
+	Stale ConsistencyLevel = iota
+
+	// Default reads are served from local state, but only by a node which
+	// believes itself to be the leader. The read may be stale only if that
+	// node has very recently been deposed.
+	Default
+
+	// Strong reads are served by the leader only after a barrier through the
+	// Raft log has confirmed it is still the leader, and that every preceding
+	// write has been applied.
+	Strong
 )
 
+// RaftConfigView is the Raft tuning in effect on a node. Fields are named
+// after those of raft.Config, and durations are formatted as strings such as
+// "1s".
+type RaftConfigView struct {
+	HeartbeatTimeout   string
+	ElectionTimeout    string
+	LeaderLeaseTimeout string
+	CommitTimeout      string
+	SnapshotInterval   string
+	SnapshotThreshold  uint64
+	TrailingLogs       uint64
+}
+
+// RaftReloadable is the Raft tuning which may be changed on a running node,
+// with ReloadRaftConfig. Fields which are nil are left unchanged.
+type RaftReloadable struct {
+	SnapshotInterval  *time.Duration
+	SnapshotThreshold *uint64
+	TrailingLogs      *uint64
+}
+
+// KeyMeta describes a key, without its value.
+type KeyMeta struct {
+	Key     string `json:"key"`
+	Size    int    `json:"size"`    // Length, in bytes, of the value.
+	Version uint64 `json:"version"` // Changed by every write to the key.
+
+	// TTL is the time left before the key expires, formatted as a string
+	// such as "1m30s", or empty if the key has no TTL.
+	TTL string `json:"ttl,omitempty"`
+}
+
+// ServerInfo describes a member of the cluster.
+type ServerInfo struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	Leader   bool   `json:"leader"`
+
+	// HTTPAddr is the HTTP API address the node advertised when joining, if
+	// it did.
+	HTTPAddr string `json:"httpAddr,omitempty"`
+
+	// LastContact is when this node last heard from the leader. It is only
+	// known for this node, and only while it is a follower.
+	LastContact *time.Time `json:"lastContact,omitempty"`
+}
+
 type command struct {
-	Op    string `json:"op,omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
+	Op      string            `json:"op,omitempty"`
+	Key     string            `json:"key,omitempty"`
+	Value   string            `json:"value,omitempty"`
+	Values  map[string]string `json:"values,omitempty"`
+	Keys    []string          `json:"keys,omitempty"`
+	Old     string            `json:"old,omitempty"`
+	Expiry  int64             `json:"expiry,omitempty"`
+	Delta   int64             `json:"delta,omitempty"`
+	Version uint64            `json:"version,omitempty"`
+	Limit   int               `json:"limit,omitempty"` // Longest value an append may produce.
+	Enabled bool              `json:"enabled,omitempty"`
+	Txn     *Txn              `json:"txn,omitempty"`
+
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 // Store is a simple key-value store, where all changes are made via Raft consensus.
 type Store struct {
 	RaftDir  string
 	RaftBind string
+	HTTPAddr string // HTTP API address of this node, advertised to the cluster.
 	inmem    bool
 
-	mu sync.Mutex
-	m  map[string]string // The key-value store for the system.
+	// LeaderWebhook, if set, is a URL to which a LeaderEvent is posted
+	// whenever this node becomes leader.
+	LeaderWebhook string
+	webhook       *webhook
+
+	// ApplyTimeout is how long a change may take to be committed and
+	// applied, before ErrApplyTimeout is returned. Under load, too short a
+	// timeout fails changes which would have succeeded, so it should allow
+	// for the slowest commits expected.
+	ApplyTimeout time.Duration
+
+	// MaxValueSize, if positive, is the longest value, in bytes, which may be
+	// set. Longer values are rejected before reaching the Raft log, where
+	// they would slow replication and bloat snapshots.
+	MaxValueSize int
+
+	// HistoryDepth is how many recent values of each key are retained, so
+	// that a key can be read as of an earlier log index with GetAt. No
+	// history is retained if it is zero. The history of a deleted key is
+	// only retained for the MaxDeletedHistories keys deleted most recently,
+	// so that keys which are set once and deleted, such as those with a TTL,
+	// do not accumulate history without bound.
+	HistoryDepth        int
+	MaxDeletedHistories int
+
+	// WritePrefixDepth is how many "/"-separated segments of a key make up
+	// the prefix by which changes to it are counted, in the kv_writes_total
+	// metric. Changes are not counted if it is zero. Only the first
+	// MaxWritePrefixes prefixes seen are counted separately, so that keys
+	// which are not hierarchical cannot create unbounded series, and changes
+	// under any other prefix are counted as "other".
+	WritePrefixDepth int
+	MaxWritePrefixes int
+	writePrefixes    map[string]struct{} // Prefixes counted, guarded by mu.
 
-	raft *raft.Raft // The consensus mechanism
+	// EncryptionKey, if set, is an AES key, 16, 24 or 32 bytes long, with
+	// which log entries and snapshots are encrypted, using AES-GCM, so that
+	// keys and values are not stored in the clear on disk. Every node in the
+	// cluster must have the same key. Keys held by a BoltBackend are not
+	// encrypted.
+	EncryptionKey []byte
+	aead          cipher.AEAD
+
+	mu     sync.Mutex
+	kv     KVBackend         // The key-value store for the system.
+	keys   int               // Number of keys in kv.
+	size   int64             // Total length, in bytes, of the values in kv.
+	expiry map[string]int64  // Expiry time, in Unix nanoseconds, of keys with a TTL.
+	meta   map[string]string // HTTP API address of each node, by node ID.
+
+	// Every write to a key gives it a new version, taken from a counter
+	// shared by all keys, so that a key deleted and set again does not
+	// return to an earlier version.
+	versions map[string]uint64
+	version  uint64 // The last version given to a key.
+
+	idempotency *idempotencyCache // Results of commands with idempotency keys.
+
+	history    map[string]*keyHistory // Recent values of each key.
+	applyIndex uint64                 // Index of the log entry being applied.
+
+	// deletedHistories are the keys whose history ended in a deletion, in
+	// the order they were deleted, and historyDropped the index of the last
+	// deletion whose history was dropped, since which the history of any
+	// deleted key is known.
+	deletedHistories []string
+	historyDropped   uint64
+
+	// maintenance is whether the cluster is in maintenance mode, in which
+	// keys may be read but not changed.
+	maintenance bool
+
+	watchers map[*watcher]struct{} // Subscribers to changes, guarded by mu.
+
+	raft       *raft.Raft   // The consensus mechanism
+	raftConfig *raft.Config // The configuration raft was started with.
+	reloadMu   sync.Mutex   // Serializes changes to Raft's tuning.
+	localID    string
+	raftAddr   raft.ServerAddress // The Raft address of this node.
+	progress   *progressTransport // Tracks followers' replication.
+
+	// done is closed by Close, stopping the store's background goroutines,
+	// which wg tracks.
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 
 	logger *log.Logger
 }
 
-// New returns a new Store.
+// New returns a new Store, keeping keys in memory.
 func New(inmem bool) *Store {
+	return NewWithBackend(inmem, NewMemBackend())
+}
+
+// NewWithBackend returns a new Store, keeping keys in kv, which must be empty.
+func NewWithBackend(inmem bool, kv KVBackend) *Store {
 	return &Store{
-		m:      make(map[string]string),
-		inmem:  inmem,
-		logger: log.New(os.Stderr, "[store] ", log.LstdFlags),
+		kv:          kv,
+		expiry:      make(map[string]int64),
+		meta:        make(map[string]string),
+		versions:    make(map[string]uint64),
+		idempotency: newIdempotencyCache(),
+		history:     make(map[string]*keyHistory),
+		watchers:    make(map[*watcher]struct{}),
+		done:        make(chan struct{}),
+		inmem:       inmem,
+		logger:      log.New(os.Stderr, "[store] ", log.LstdFlags),
+
+		ApplyTimeout: DefaultApplyTimeout,
+		MaxValueSize: DefaultMaxValueSize,
+
+		WritePrefixDepth: DefaultWritePrefixDepth,
+		MaxWritePrefixes: DefaultMaxWritePrefixes,
+
+		MaxDeletedHistories: DefaultMaxDeletedHistories,
 	}
 }
 
@@ -63,16 +348,28 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 	// Setup Raft configuration.
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(localID)
+	s.raftConfig = config
+	s.localID = localID
+
+	if len(s.EncryptionKey) > 0 {
+		aead, err := newAEAD(s.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("encryption key: %s", err)
+		}
+		s.aead = aead
+	}
 
 	// Setup Raft communication.
 	addr, err := net.ResolveTCPAddr("tcp", s.RaftBind)
 	if err != nil {
 		return err
 	}
-	transport, err := raft.NewTCPTransport(s.RaftBind, addr, 3, 10*time.Second, os.Stderr)
+	tcp, err := raft.NewTCPTransport(s.RaftBind, addr, 3, 10*time.Second, os.Stderr)
 	if err != nil {
 		return err
 	}
+	transport := newProgressTransport(tcp)
+	s.progress = transport
 
 	// Create the snapshot store. This allows the Raft to truncate the log.
 	snapshots, err := raft.NewFileSnapshotStore(s.RaftDir, retainSnapshotCount, os.Stderr)
@@ -101,33 +398,213 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 		return fmt.Errorf("new raft: %s", err)
 	}
 	s.raft = ra
+	s.raftAddr = transport.LocalAddr()
 
 	if enableSingle {
-		configuration := raft.Configuration{
-			Servers: []raft.Server{
-				{
-					ID:      config.LocalID,
-					Address: transport.LocalAddr(),
-				},
-			},
-		}
-		ra.BootstrapCluster(configuration)
+		s.Bootstrap()
 	}
 
+	if s.LeaderWebhook != "" {
+		s.webhook = newWebhook(s.LeaderWebhook, s.logger)
+	}
+
+	s.wg.Add(2)
+	go s.expireKeys()
+	go s.monitorRaft()
+
 	return nil
 }
 
-// Get returns the value for the given key.
+// Close shuts the store down, stopping Raft and waiting for the store's
+// background goroutines to exit. The store cannot be used afterwards.
+func (s *Store) Close() error {
+	err := s.raft.Shutdown().Error()
+	s.closeOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+	return err
+}
+
+// Get returns the value for the given key. ErrKeyNotFound is returned if the
+// key is not present, which distinguishes it from a key set to "".
 func (s *Store) Get(key string) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.m[key], nil
+	v, ok, err := s.kv.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if !ok || s.expired(key, time.Now()) {
+		return "", ErrKeyNotFound
+	}
+	return v, nil
+}
+
+// Exists returns whether the given key is present, and so whether deleting it
+// would remove anything.
+func (s *Store) Exists(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok, err := s.kv.Get(key)
+	if err != nil {
+		return false, err
+	}
+	return ok && !s.expired(key, time.Now()), nil
+}
+
+// Scan returns all key-value pairs whose key starts with prefix. Results are
+// read from local state, so they are only linearizable if read from the leader.
+func (s *Store) Scan(prefix string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	o := make(map[string]string)
+	err := s.kv.Iterate(func(k, v string) bool {
+		if strings.HasPrefix(k, prefix) && !s.expired(k, now) {
+			o[k] = v
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ScanMeta returns, sorted by key, a description of every key starting with
+// prefix. Like Scan, it reads local state, so is only linearizable if read
+// from the leader.
+func (s *Store) ScanMeta(prefix string) ([]KeyMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	o := make([]KeyMeta, 0)
+	err := s.kv.Iterate(func(k, v string) bool {
+		if !strings.HasPrefix(k, prefix) || s.expired(k, now) {
+			return true
+		}
+		m := KeyMeta{Key: k, Size: len(v), Version: s.versions[k]}
+		if e, ok := s.expiry[k]; ok {
+			m.TTL = time.Duration(e - now.UnixNano()).Round(time.Millisecond).String()
+		}
+		o = append(o, m)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i].Key < o[j].Key })
+	return o, nil
+}
+
+// GetMulti returns the values of keys, with a nil value for each key which is
+// not present. The keys are read under a single lock, so the values are
+// consistent with one another. Like Scan, results are read from local state.
+func (s *Store) GetMulti(keys []string) (map[string]*string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	o := make(map[string]*string, len(keys))
+	for _, k := range keys {
+		v, ok, err := s.kv.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !s.expired(k, now) {
+			o[k] = &v
+		} else {
+			o[k] = nil
+		}
+	}
+	return o, nil
+}
+
+// ScanPage returns, in sorted order, up to limit keys which start with prefix
+// and sort after the cursor after. next is the cursor for the following page,
+// or the empty string if there are no more keys. limit must be positive. Like
+// Scan, results are read from local state.
+func (s *Store) ScanPage(prefix, after string, limit int) (keys []string, next string, err error) {
+	keys = make([]string, 0)
+	s.mu.Lock()
+	now := time.Now()
+	err = s.kv.Iterate(func(k, _ string) bool {
+		if strings.HasPrefix(k, prefix) && k > after && !s.expired(k, now) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+	return keys, next, nil
+}
+
+// GetWithLevel returns the value for the given key, read at the given
+// consistency level. ErrNotLeader is returned if the level requires the
+// leader, and this node is not the leader.
+func (s *Store) GetWithLevel(key string, level ConsistencyLevel) (string, error) {
+	return s.GetCtx(context.Background(), key, level)
+}
+
+// GetCtx is like GetWithLevel, but stops waiting for a strong read's barrier
+// once ctx is done, returning ctx.Err().
+func (s *Store) GetCtx(ctx context.Context, key string, level ConsistencyLevel) (string, error) {
+	v, _, err := s.GetWithVersion(ctx, key, level)
+	return v, err
+}
+
+// GetWithVersion is like GetCtx, but also returns the version of the key,
+// for use with SetIfVersion and DeleteIfVersion.
+func (s *Store) GetWithVersion(ctx context.Context, key string, level ConsistencyLevel) (string, uint64, error) {
+	switch level {
+	case Default:
+		if s.raft.State() != raft.Leader {
+			return "", 0, ErrNotLeader
+		}
+	case Strong:
+		if s.raft.State() != raft.Leader {
+			return "", 0, ErrNotLeader
+		}
+		if err := wait(ctx, s.raft.Barrier(raftTimeout)); err != nil {
+			if err == raft.ErrNotLeader {
+				return "", 0, ErrNotLeader
+			}
+			return "", 0, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok, err := s.kv.Get(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if !ok || s.expired(key, time.Now()) {
+		return "", 0, ErrKeyNotFound
+	}
+	return v, s.versions[key], nil
 }
 
 // Set sets the value for the given key.
 func (s *Store) Set(key, value string) error {
+	return s.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx sets the value for the given key, but stops waiting for the change
+// to be applied once ctx is done, returning ctx.Err(). The change may still
+// be applied afterwards.
+func (s *Store) SetCtx(ctx context.Context, key, value string) error {
 	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+		return ErrNotLeader
+	}
+	if err := s.checkValueSize(value); err != nil {
+		return err
 	}
 
 	c := &command{
@@ -135,142 +612,1530 @@ func (s *Store) Set(key, value string) error {
 		Key:   key,
 		Value: value,
 	}
-	b, err := json.Marshal(c)
-	if err != nil {
+	_, err := s.apply(ctx, c)
+	return err
+}
+
+// SetWithTTL sets the value for the given key, and schedules the key for
+// deletion once ttl has elapsed. Expired keys are no longer returned by reads,
+// and are removed from every node by a delete issued by the leader.
+func (s *Store) SetWithTTL(key, value string, ttl time.Duration) error {
+	return s.SetWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetWithTTLCtx is like SetWithTTL, but stops waiting for the change to be
+// applied once ctx is done, returning ctx.Err(). The change may still be
+// applied afterwards.
+func (s *Store) SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if err := s.checkValueSize(value); err != nil {
 		return err
 	}
 
-	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	c := &command{
+		Op:     "set",
+		Key:    key,
+		Value:  value,
+		Expiry: time.Now().Add(ttl).UnixNano(),
+	}
+	_, err := s.apply(ctx, c)
+	return err
+}
+
+// SetMulti sets all the given key-value pairs as a single Raft log entry, so
+// either all of them are applied or none are.
+func (s *Store) SetMulti(kv map[string]string) error {
+	return s.SetMultiCtx(context.Background(), kv)
 }
 
-// Delete deletes the given key.
-func (s *Store) Delete(key string) error {
+// SetMultiCtx is like SetMulti, but stops waiting for the changes to be
+// applied once ctx is done, returning ctx.Err(). They may still be applied
+// afterwards.
+func (s *Store) SetMultiCtx(ctx context.Context, kv map[string]string) error {
 	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+		return ErrNotLeader
+	}
+	for _, v := range kv {
+		if err := s.checkValueSize(v); err != nil {
+			return err
+		}
 	}
 
 	c := &command{
-		Op:  "delete",
-		Key: key,
-	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
+		Op:     "setmulti",
+		Values: kv,
 	}
+	_, err := s.apply(ctx, c)
+	return err
+}
 
-	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+// CompareAndSwap sets key to new, but only if its current value is old. A
+// missing key is treated as having the empty string as its value. The
+// comparison and the swap are performed within a single Raft log entry.
+func (s *Store) CompareAndSwap(key, old, new string) (bool, error) {
+	return s.CompareAndSwapCtx(context.Background(), key, old, new)
 }
 
-// Join joins a node, identified by nodeID and located at addr, to this store.
-// The node must be ready to respond to Raft communications at that address.
-func (s *Store) Join(nodeID, addr string) error {
-	s.logger.Printf("received join request for remote node %s at %s", nodeID, addr)
+// CompareAndSwapCtx is like CompareAndSwap, but stops waiting for the swap to
+// be applied once ctx is done, returning ctx.Err(). The swap may still be
+// applied afterwards.
+func (s *Store) CompareAndSwapCtx(ctx context.Context, key, old, new string) (bool, error) {
+	if s.raft.State() != raft.Leader {
+		return false, ErrNotLeader
+	}
+	if err := s.checkValueSize(new); err != nil {
+		return false, err
+	}
 
-	configFuture := s.raft.GetConfiguration()
-	if err := configFuture.Error(); err != nil {
-		s.logger.Printf("failed to get raft configuration: %v", err)
+	c := &command{
+		Op:    "cas",
+		Key:   key,
+		Old:   old,
+		Value: new,
+	}
+	r, err := s.apply(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	return r.(bool), nil
+}
+
+// SetIfVersion sets the value for the given key, but only if the key is at
+// the given version, with version 0 requiring the key to be absent. The check
+// and the set are performed within a single Raft log entry, and any TTL on
+// the key is cleared. ErrVersionMismatch is returned if the key is at another
+// version.
+func (s *Store) SetIfVersion(ctx context.Context, key, value string, version uint64) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if err := s.checkValueSize(value); err != nil {
 		return err
 	}
 
-	for _, srv := range configFuture.Configuration().Servers {
-		// If a node already exists with either the joining node's ID or address,
-		// that node may need to be removed from the config first.
-		if srv.ID == raft.ServerID(nodeID) || srv.Address == raft.ServerAddress(addr) {
-			// However if *both* the ID and the address are the same, then nothing -- not even
-			// a join operation -- is needed.
-			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(nodeID) {
-				s.logger.Printf("node %s at %s already member of cluster, ignoring join request", nodeID, addr)
-				return nil
-			}
+	c := &command{
+		Op:      "setifversion",
+		Key:     key,
+		Value:   value,
+		Version: version,
+	}
+	_, err := s.apply(ctx, c)
+	return err
+}
 
-			future := s.raft.RemoveServer(srv.ID, 0, 0)
-			if err := future.Error(); err != nil {
-				return fmt.Errorf("error removing existing node %s at %s: %s", nodeID, addr, err)
-			}
-		}
+// DeleteIfVersion deletes the given key, but only if it is at the given
+// version. ErrVersionMismatch is returned if the key is at another version,
+// or is absent.
+func (s *Store) DeleteIfVersion(ctx context.Context, key string, version uint64) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
 	}
 
-	f := s.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
-	if f.Error() != nil {
-		return f.Error()
+	c := &command{
+		Op:      "deleteifversion",
+		Key:     key,
+		Version: version,
 	}
-	s.logger.Printf("node %s at %s joined successfully", nodeID, addr)
-	return nil
+	_, err := s.apply(ctx, c)
+	return err
 }
 
-func (s *Store) Status() string {
-	return s.raft.State().String()
+// Increment atomically adds delta to the integer value stored at key, and
+// returns the new value. A missing key is treated as holding zero, and
+// ErrNotInteger is returned if the existing value is not an integer.
+func (s *Store) Increment(key string, delta int64) (int64, error) {
+	return s.IncrementCtx(context.Background(), key, delta)
 }
 
-type fsm Store
-
-// Apply applies a Raft log entry to the key-value store.
-func (f *fsm) Apply(l *raft.Log) interface{} {
-	var c command
-	if err := json.Unmarshal(l.Data, &c); err != nil {
-		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
+// IncrementCtx is like Increment, but stops waiting for the increment to be
+// applied once ctx is done, returning ctx.Err(). The increment may still be
+// applied afterwards.
+func (s *Store) IncrementCtx(ctx context.Context, key string, delta int64) (int64, error) {
+	if s.raft.State() != raft.Leader {
+		return 0, ErrNotLeader
 	}
 
-	switch c.Op {
-	case "set":
-		return f.applySet(c.Key, c.Value)
-	case "delete":
-		return f.applyDelete(c.Key)
+	c := &command{
+		Op:    "incr",
+		Key:   key,
+		Delta: delta,
+	}
+	r, err := s.apply(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	switch r := r.(type) {
+	case int64:
+		return r, nil
 	default:
-		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
+		return 0, fmt.Errorf("unexpected increment response: %v", r)
 	}
 }
 
-// Snapshot returns a snapshot of the key-value store.
-func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	// Clone the map.
-	o := make(map[string]string)
-	for k, v := range f.m {
-		o[k] = v
-	}
-	return &fsmSnapshot{store: o}, nil
+// Append adds chunk to the end of the value stored at key, so that a value
+// too large to send at once can be uploaded in parts. A missing key is
+// treated as holding the empty string. Each append is a separate entry in the
+// Raft log, but the assembled value is still limited to MaxValueSize, and
+// ErrValueTooLarge is returned by the append which would exceed it.
+func (s *Store) Append(key, chunk string) error {
+	return s.AppendCtx(context.Background(), key, chunk)
 }
 
-// Restore stores the key-value store to a previous state.
-func (f *fsm) Restore(rc io.ReadCloser) error {
-	o := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
+// AppendCtx is like Append, but stops waiting for the append to be applied
+// once ctx is done, returning ctx.Err(). The append may still be applied
+// afterwards.
+func (s *Store) AppendCtx(ctx context.Context, key, chunk string) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	if err := s.checkValueSize(chunk); err != nil {
 		return err
 	}
 
-	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
-	f.m = o
-	return nil
+	c := &command{
+		Op:    "append",
+		Key:   key,
+		Value: chunk,
+		Limit: s.MaxValueSize,
+	}
+	_, err := s.apply(ctx, c)
+	return err
 }
 
-func (f *fsm) applySet(key, value string) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.m[key] = value
-	return nil
+// SetMaintenance turns maintenance mode on or off, via distributed consensus,
+// so that it applies on every node. While it is on, every change to keys
+// fails with ErrMaintenance, but keys may still be read.
+func (s *Store) SetMaintenance(enabled bool) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	c := &command{
+		Op:      "maintenance",
+		Enabled: enabled,
+	}
+	_, err := s.apply(context.Background(), c)
+	return err
 }
 
-func (f *fsm) applyDelete(key string) interface{} {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	delete(f.m, key)
-	return nil
+// Maintenance returns whether the cluster is in maintenance mode.
+func (s *Store) Maintenance() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maintenance
+}
+
+// Delete deletes the given key.
+func (s *Store) Delete(key string) error {
+	return s.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx deletes the given key, but stops waiting for the deletion to be
+// applied once ctx is done, returning ctx.Err(). The deletion may still be
+// applied afterwards.
+func (s *Store) DeleteCtx(ctx context.Context, key string) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	c := &command{
+		Op:  "delete",
+		Key: key,
+	}
+	_, err := s.apply(ctx, c)
+	return err
+}
+
+// DeleteMulti deletes all the given keys as a single Raft log entry, and
+// returns how many were present. Keys which are not present are ignored.
+func (s *Store) DeleteMulti(keys []string) (int, error) {
+	return s.DeleteMultiCtx(context.Background(), keys)
+}
+
+// DeleteMultiCtx is like DeleteMulti, but stops waiting for the deletions to
+// be applied once ctx is done, returning ctx.Err(). They may still be applied
+// afterwards.
+func (s *Store) DeleteMultiCtx(ctx context.Context, keys []string) (int, error) {
+	if s.raft.State() != raft.Leader {
+		return 0, ErrNotLeader
+	}
+
+	c := &command{
+		Op:   "deletemulti",
+		Keys: keys,
+	}
+	r, err := s.apply(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return r.(int), nil
+}
+
+// DeletePrefix deletes every key starting with prefix, as a single Raft log
+// entry, and returns how many keys were deleted. An empty prefix deletes
+// every key.
+func (s *Store) DeletePrefix(prefix string) (int, error) {
+	return s.DeletePrefixCtx(context.Background(), prefix)
+}
+
+// DeletePrefixCtx is like DeletePrefix, but stops waiting for the deletions to
+// be applied once ctx is done, returning ctx.Err(). They may still be applied
+// afterwards.
+func (s *Store) DeletePrefixCtx(ctx context.Context, prefix string) (int, error) {
+	if s.raft.State() != raft.Leader {
+		return 0, ErrNotLeader
+	}
+
+	c := &command{
+		Op:  "deleteprefix",
+		Key: prefix,
+	}
+	r, err := s.apply(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return r.(int), nil
+}
+
+// Flush deletes every key, as a single Raft log entry, so that every node
+// ends up empty, and returns how many keys were deleted. Unlike deleting the
+// empty prefix, it is not a change a client restricted to some keys can make.
+func (s *Store) Flush() (int, error) {
+	if s.raft.State() != raft.Leader {
+		return 0, ErrNotLeader
+	}
+
+	r, err := s.apply(context.Background(), &command{Op: "flush"})
+	if err != nil {
+		return 0, err
+	}
+	return r.(int), nil
+}
+
+// checkValueSize returns ErrValueTooLarge if value is longer than
+// s.MaxValueSize.
+func (s *Store) checkValueSize(value string) error {
+	if s.MaxValueSize > 0 && len(value) > s.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// apply applies c via Raft, and returns the FSM's response once the command has
+// been applied, ctx.Err() if ctx is done first, or ErrApplyTimeout if
+// s.ApplyTimeout elapses first. A response which is an error, such as
+// ErrMaintenance, is returned as the error. c carries ctx's idempotency key,
+// if any.
+// Failures, other than ctx being done, are counted in raftApplyErrors.
+func (s *Store) apply(ctx context.Context, c *command) (interface{}, error) {
+	c.IdempotencyKey = IdempotencyKey(ctx)
+	b, err := json.Marshal(c)
+	if err == nil {
+		b, err = seal(s.aead, b)
+	}
+	if err != nil {
+		raftApplyErrors.WithLabelValues(c.Op).Inc()
+		return nil, err
+	}
+
+	actx, cancel := context.WithTimeout(ctx, s.ApplyTimeout)
+	defer cancel()
+	f := s.raft.Apply(b, s.ApplyTimeout)
+	if err := wait(actx, f); err != nil {
+		if ctx.Err() != nil && err == ctx.Err() {
+			return nil, err
+		}
+		if err == context.DeadlineExceeded || err == raft.ErrEnqueueTimeout {
+			err = ErrApplyTimeout
+		}
+		raftApplyErrors.WithLabelValues(c.Op).Inc()
+		return nil, err
+	}
+	if err, ok := f.Response().(error); ok {
+		return nil, err
+	}
+	return f.Response(), nil
+}
+
+// wait waits for f to complete, or for ctx to be done, whichever is first.
+// Raft offers no way to abandon an operation, so it may still complete.
+func wait(ctx context.Context, f raft.Future) error {
+	if ctx.Done() == nil {
+		return f.Error()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Error()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Barrier waits, for at most timeout, until every change committed before it
+// was called has been applied to this node's store. Only the leader may issue
+// a barrier, so ErrNotLeader is returned on other nodes, and ErrApplyTimeout
+// if the barrier is not complete in time.
+func (s *Store) Barrier(timeout time.Duration) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	switch err := wait(ctx, s.raft.Barrier(timeout)); err {
+	case raft.ErrNotLeader, raft.ErrLeadershipLost:
+		return ErrNotLeader
+	case context.DeadlineExceeded, raft.ErrEnqueueTimeout:
+		return ErrApplyTimeout
+	default:
+		return err
+	}
+}
+
+// Join joins a node, identified by nodeID and located at addr, to this store.
+// The node must be ready to respond to Raft communications at that address.
+// If httpAddr is set, it is recorded as the node's HTTP API address so that
+// requests may be sent to the node should it become leader. Unless voter is
+// set, the node joins as a non-voter, which receives the log but neither
+// votes nor counts towards quorum, so that it can catch up before promotion.
+func (s *Store) Join(nodeID, addr, httpAddr string, voter bool) error {
+	s.logger.Printf("received join request for remote node %s at %s", nodeID, addr)
+
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		s.logger.Printf("failed to get raft configuration: %v", err)
+		return err
+	}
+
+	for _, srv := range configFuture.Configuration().Servers {
+		// If a node already exists with either the joining node's ID or address,
+		// that node may need to be removed from the config first.
+		if srv.ID == raft.ServerID(nodeID) || srv.Address == raft.ServerAddress(addr) {
+			// However if *both* the ID and the address are the same, then nothing -- not even
+			// a join operation -- is needed.
+			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(nodeID) {
+				s.logger.Printf("node %s at %s already member of cluster, ignoring join request", nodeID, addr)
+				return s.setMeta(nodeID, httpAddr)
+			}
+
+			future := s.raft.RemoveServer(srv.ID, 0, 0)
+			if err := future.Error(); err != nil {
+				return fmt.Errorf("error removing existing node %s at %s: %s", nodeID, addr, err)
+			}
+		}
+	}
+
+	var f raft.IndexFuture
+	if voter {
+		f = s.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	} else {
+		f = s.raft.AddNonvoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
+	}
+	if f.Error() != nil {
+		return f.Error()
+	}
+	s.logger.Printf("node %s at %s joined successfully (voter: %t)", nodeID, addr, voter)
+	return s.setMeta(nodeID, httpAddr)
+}
+
+// Promote makes the node identified by nodeID, which must have joined as a
+// non-voter, a voter. It is up to the caller to check the node has caught up
+// with the log first, since once promoted it counts towards quorum.
+func (s *Store) Promote(nodeID string) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID != raft.ServerID(nodeID) {
+			continue
+		}
+		if srv.Suffrage != raft.Nonvoter {
+			break
+		}
+		f := s.raft.AddVoter(srv.ID, srv.Address, 0, 0)
+		if err := f.Error(); err != nil {
+			return fmt.Errorf("error promoting node %s: %s", nodeID, err)
+		}
+		s.logger.Printf("node %s promoted to voter", nodeID)
+		return nil
+	}
+	return ErrNotNonvoter
+}
+
+// NodeHTTPAddr returns the HTTP API address of the node identified by nodeID,
+// or the empty string if it is not known.
+func (s *Store) NodeHTTPAddr(nodeID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meta[nodeID]
+}
+
+// Remove removes the node identified by nodeID from the cluster. If this node,
+// as leader, removes itself, it steps down once the configuration without it
+// is committed, after which the remaining nodes elect a new leader.
+func (s *Store) Remove(nodeID string) error {
+	s.logger.Printf("received remove request for node %s", nodeID)
+
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		s.logger.Printf("failed to get raft configuration: %v", err)
+		return err
+	}
+
+	found := false
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(nodeID) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrNodeNotFound
+	}
+
+	// Forget the node's HTTP address first, as a leader removing itself can
+	// no longer apply commands afterwards.
+	if _, err := s.apply(context.Background(), &command{Op: "removemeta", Key: nodeID}); err != nil {
+		return err
+	}
+
+	f := s.raft.RemoveServer(raft.ServerID(nodeID), 0, 0)
+	if err := f.Error(); err != nil {
+		return fmt.Errorf("error removing node %s: %s", nodeID, err)
+	}
+	s.logger.Printf("node %s removed successfully", nodeID)
+	return nil
+}
+
+// TransferLeadership makes this node, which must be the leader, hand
+// leadership to another member of the cluster, so that it can be restarted
+// without an election timeout. If target is set, leadership is handed to the
+// node with that ID, otherwise to whichever node is most up to date. It
+// returns once another node is leader, or the transfer has failed.
+func (s *Store) TransferLeadership(target string) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+
+	var f raft.Future
+	if target == "" {
+		s.logger.Printf("transferring leadership")
+		f = s.raft.LeadershipTransfer()
+	} else {
+		configFuture := s.raft.GetConfiguration()
+		if err := configFuture.Error(); err != nil {
+			return err
+		}
+		var addr raft.ServerAddress
+		for _, srv := range configFuture.Configuration().Servers {
+			if srv.ID == raft.ServerID(target) {
+				addr = srv.Address
+				break
+			}
+		}
+		if addr == "" {
+			return ErrNodeNotFound
+		}
+		s.logger.Printf("transferring leadership to node %s", target)
+		f = s.raft.LeadershipTransferToServer(raft.ServerID(target), addr)
+	}
+
+	if err := f.Error(); err == raft.ErrNotLeader {
+		return ErrNotLeader
+	} else if err != nil {
+		return fmt.Errorf("error transferring leadership: %s", err)
+	}
+
+	// The transfer completes once this node steps down, which is before
+	// another node has won the election.
+	deadline := time.Now().Add(raftTimeout)
+	for {
+		if s.raft.Leader() != "" && s.raft.State() != raft.Leader {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for a new leader")
+		}
+		time.Sleep(leaderPollInterval)
+	}
+}
+
+// setMeta records the HTTP API address of the given node. The leader's own
+// address is recorded too, if not already, as the first node of a cluster
+// never joins and so would otherwise be missing.
+func (s *Store) setMeta(nodeID, httpAddr string) error {
+	s.mu.Lock()
+	pending := make(map[string]string)
+	if httpAddr != "" && s.meta[nodeID] != httpAddr {
+		pending[nodeID] = httpAddr
+	}
+	if s.HTTPAddr != "" && s.meta[s.localID] != s.HTTPAddr {
+		pending[s.localID] = s.HTTPAddr
+	}
+	s.mu.Unlock()
+
+	for id, a := range pending {
+		if _, err := s.apply(context.Background(), &command{Op: "setmeta", Key: id, Value: a}); err != nil {
+			return fmt.Errorf("error recording HTTP address of node %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) Status() string {
+	return s.raft.State().String()
+}
+
+// backupEntry is a key, as written by Backup, one per line.
+type backupEntry struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Expiry int64  `json:"expiry,omitempty"`
+}
+
+// Backup writes every key in the store to w, as newline-delimited JSON. The
+// keys are copied under the lock, but encoded only once it is released, so
+// that writes are not held up by a slow reader.
+func (s *Store) Backup(w io.Writer) error {
+	s.mu.Lock()
+	now := time.Now()
+	entries := make([]backupEntry, 0, s.keys)
+	err := s.kv.Iterate(func(k, v string) bool {
+		if !s.expired(k, now) {
+			entries = append(entries, backupEntry{Key: k, Value: v, Expiry: s.expiry[k]})
+		}
+		return true
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for i := range entries {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore sets every key read from r, in the format written by Backup, via
+// Raft so that the keys are replicated. ErrNotEmpty is returned if the store
+// already has keys, unless force is set, in which case the backup is merged
+// into them. Keys are applied in batches as they are read, so a failed
+// restore may have been partially applied.
+func (s *Store) Restore(r io.Reader, force bool) error {
+	if s.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	s.mu.Lock()
+	n := s.keys
+	s.mu.Unlock()
+	if n != 0 && !force {
+		return ErrNotEmpty
+	}
+
+	batch := make(map[string]string)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := s.apply(context.Background(), &command{Op: "setmulti", Values: batch}); err != nil {
+			return err
+		}
+		batch = make(map[string]string)
+		return nil
+	}
+
+	dec := json.NewDecoder(r)
+	now := time.Now().UnixNano()
+	for {
+		var e backupEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid backup: %s", err)
+		}
+
+		// Keys with a TTL keep their expiry, which setmulti cannot carry.
+		if e.Expiry != 0 {
+			if e.Expiry <= now {
+				continue
+			}
+			if _, err := s.apply(context.Background(), &command{Op: "set", Key: e.Key, Value: e.Value, Expiry: e.Expiry}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		batch[e.Key] = e.Value
+		if len(batch) >= restoreBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// Types of Event.
+const (
+	EventSet    = "set"
+	EventDelete = "delete"
+
+	// EventReset means changes were missed, either because the watcher fell
+	// behind or because the store was restored from a snapshot, so any state
+	// built from earlier events must be rebuilt.
+	EventReset = "reset"
+)
+
+// Event describes a change to a key.
+type Event struct {
+	Type  string `json:"-"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+type watcher struct {
+	prefix string
+	ch     chan Event
+}
+
+// Watch returns a channel receiving an Event whenever a key starting with
+// prefix is changed on this node, and a function which must be called once
+// the caller stops watching. Events are buffered, and a watcher which falls
+// behind has its backlog dropped and replaced by an EventReset.
+func (s *Store) Watch(prefix string) (<-chan Event, func()) {
+	w := &watcher{prefix: prefix, ch: make(chan Event, watchBufferSize)}
+	s.mu.Lock()
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.watchers, w)
+			s.mu.Unlock()
+		})
+	}
+}
+
+// publish sends e to every watcher it concerns, without blocking. s.mu must
+// be held.
+func (s *Store) publish(e Event) {
+	for w := range s.watchers {
+		if e.Type != EventReset && !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+			continue
+		default:
+		}
+
+		// The watcher has fallen behind, so drop its backlog, which leaves
+		// room for the reset.
+		for len(w.ch) > 0 {
+			select {
+			case <-w.ch:
+			default:
+			}
+		}
+		select {
+		case w.ch <- Event{Type: EventReset}:
+		default:
+		}
+	}
+}
+
+// AppliedIndex returns the index of the last Raft log entry applied to this
+// node's store.
+func (s *Store) AppliedIndex() uint64 {
+	return s.raft.AppliedIndex()
+}
+
+// RaftConfig returns the Raft tuning in effect on this node, including any
+// changes made since it started with ReloadRaftConfig.
+func (s *Store) RaftConfig() RaftConfigView {
+	c := s.raftConfig
+	rc := s.raft.ReloadableConfig()
+	return RaftConfigView{
+		HeartbeatTimeout:   c.HeartbeatTimeout.String(),
+		ElectionTimeout:    c.ElectionTimeout.String(),
+		LeaderLeaseTimeout: c.LeaderLeaseTimeout.String(),
+		CommitTimeout:      c.CommitTimeout.String(),
+		SnapshotInterval:   rc.SnapshotInterval.String(),
+		SnapshotThreshold:  rc.SnapshotThreshold,
+		TrailingLogs:       rc.TrailingLogs,
+	}
+}
+
+// ReloadRaftConfig changes the snapshot interval, snapshot threshold or
+// trailing logs of this node's Raft, without restarting it. Tuning is local to
+// each node, so any node may be retuned, and each must be retuned for the
+// change to apply to the whole cluster. ErrInvalidRaftConfig is returned,
+// and nothing changed, if any value is out of range.
+func (s *Store) ReloadRaftConfig(cfg RaftReloadable) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	rc := s.raft.ReloadableConfig()
+	if cfg.SnapshotInterval != nil {
+		if *cfg.SnapshotInterval < 5*time.Millisecond {
+			return fmt.Errorf("%w: snapshot interval must be at least 5ms", ErrInvalidRaftConfig)
+		}
+		rc.SnapshotInterval = *cfg.SnapshotInterval
+	}
+	if cfg.SnapshotThreshold != nil {
+		if *cfg.SnapshotThreshold == 0 {
+			return fmt.Errorf("%w: snapshot threshold must be positive", ErrInvalidRaftConfig)
+		}
+		rc.SnapshotThreshold = *cfg.SnapshotThreshold
+	}
+	if cfg.TrailingLogs != nil {
+		rc.TrailingLogs = *cfg.TrailingLogs
+	}
+	if err := s.raft.ReloadConfig(rc); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRaftConfig, err)
+	}
+	return nil
+}
+
+// Snapshot makes Raft snapshot the store now, rather than waiting until the
+// log has grown enough. Snapshots are local to each node, so any node may
+// snapshot.
+func (s *Store) Snapshot() error {
+	return s.raft.Snapshot().Error()
+}
+
+// Bootstrap makes this node a single-node cluster, of which it will become
+// leader, so that others can join it. ErrBootstrapped is returned if the node
+// already has Raft state, since bootstrapping it again could split it from
+// the cluster it belongs to.
+func (s *Store) Bootstrap() error {
+	configuration := raft.Configuration{
+		Servers: []raft.Server{
+			{
+				ID:      raft.ServerID(s.localID),
+				Address: s.raftAddr,
+			},
+		},
+	}
+	err := s.raft.BootstrapCluster(configuration).Error()
+	if err == raft.ErrCantBootstrap {
+		return ErrBootstrapped
+	}
+	return err
+}
+
+// Servers returns the members of the cluster, according to this node's view
+// of the Raft configuration.
+func (s *Store) Servers() ([]ServerInfo, error) {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+
+	leader := s.raft.Leader()
+	var servers []ServerInfo
+	for _, srv := range configFuture.Configuration().Servers {
+		info := ServerInfo{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: strings.ToLower(srv.Suffrage.String()),
+			Leader:   srv.Address == leader,
+			HTTPAddr: s.NodeHTTPAddr(string(srv.ID)),
+		}
+		if srv.ID == raft.ServerID(s.localID) && s.raft.State() == raft.Follower {
+			if lc := s.raft.LastContact(); !lc.IsZero() {
+				info.LastContact = &lc
+			}
+		}
+		servers = append(servers, info)
+	}
+	return servers, nil
+}
+
+// IsLeader returns whether this node is the leader.
+func (s *Store) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// LeaderHTTPAddr returns the HTTP API address of the current leader, or the
+// empty string if there is no known leader or its address was never recorded.
+func (s *Store) LeaderHTTPAddr() (string, error) {
+	if s.IsLeader() {
+		return s.HTTPAddr, nil
+	}
+
+	leader := s.raft.Leader()
+	if leader == "" {
+		return "", nil
+	}
+
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return "", err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.Address == leader {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.meta[string(srv.ID)], nil
+		}
+	}
+	return "", nil
+}
+
+// LeaderAddr returns the Raft address of the current leader, or the empty
+// string if there is no known leader.
+func (s *Store) LeaderAddr() (string, error) {
+	return string(s.raft.Leader()), nil
+}
+
+// Ready returns whether the store is fit to serve reads. That is the case once
+// a leader is known and this node has applied every log entry it knows to be
+// committed, including any snapshot it was sent on joining.
+func (s *Store) Ready() bool {
+	if s.raft.Leader() == "" {
+		return false
+	}
+	commitIndex, err := strconv.ParseUint(s.raft.Stats()["commit_index"], 10, 64)
+	if err != nil {
+		return false
+	}
+	return s.raft.AppliedIndex() >= commitIndex
+}
+
+// expired returns whether key has a TTL which has passed at now. It must be
+// called with the lock held.
+func (s *Store) expired(key string, now time.Time) bool {
+	e, ok := s.expiry[key]
+	return ok && e <= now.UnixNano()
+}
+
+// monitorRaft keeps the Raft metrics up to date, until Raft is shut down. They
+// are refreshed as soon as leadership changes, and periodically otherwise, so
+// that index progress and elections are also reflected. Becoming leader is
+// also announced to the leader webhook, if there is one.
+func (s *Store) monitorRaft() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case leader := <-s.raft.LeaderCh():
+			if leader && s.webhook != nil {
+				s.notifyLeader()
+			}
+		case <-ticker.C:
+		case <-s.done:
+		}
+		state := s.raft.State()
+		recordRaftMetrics(state, s.raft.Stats())
+		if state == raft.Shutdown {
+			if s.webhook != nil {
+				s.webhook.close()
+			}
+			return
+		}
+	}
+}
+
+// notifyLeader queues a LeaderEvent, announcing this node as leader, for the
+// leader webhook. Only the new leader announces a change, so each change is
+// announced once, by whichever node won the election.
+func (s *Store) notifyLeader() {
+	term, _ := strconv.ParseUint(s.raft.Stats()["term"], 10, 64)
+	s.webhook.notify(LeaderEvent{Event: "leader_changed", Leader: s.localID, Term: term})
+}
+
+// recordRaftMetrics sets the Raft metrics from the node's state and stats, as
+// returned by raft.Stats.
+func recordRaftMetrics(state raft.RaftState, stats map[string]string) {
+	for _, st := range []raft.RaftState{raft.Follower, raft.Candidate, raft.Leader, raft.Shutdown} {
+		v := 0.0
+		if st == state {
+			v = 1
+		}
+		metrics.RaftState.WithLabelValues(strings.ToLower(st.String())).Set(v)
+	}
+
+	for name, g := range map[string]prometheus.Gauge{
+		"last_log_index": metrics.RaftLastLogIndex,
+		"commit_index":   metrics.RaftCommitIndex,
+		"applied_index":  metrics.RaftAppliedIndex,
+	} {
+		if n, err := strconv.ParseUint(stats[name], 10, 64); err == nil {
+			g.Set(float64(n))
+		}
+	}
+}
+
+// expireKeys periodically deletes expired keys. Only the leader issues the
+// deletes, but every node runs the scan so that whichever node becomes leader
+// resumes expiring keys without further coordination. It returns once the
+// store is closed.
+func (s *Store) expireKeys() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(expiryScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.raft.State() != raft.Leader {
+			continue
+		}
+
+		s.mu.Lock()
+		expired := make(map[string]int64)
+		now := time.Now()
+		for k, e := range s.expiry {
+			if s.expired(k, now) {
+				expired[k] = e
+			}
+		}
+		s.mu.Unlock()
+
+		for k, e := range expired {
+			// The expiry is included so that the delete is skipped if the key
+			// was set again in the meantime.
+			if _, err := s.apply(context.Background(), &command{Op: "expire", Key: k, Expiry: e}); err != nil {
+				s.logger.Printf("failed to expire key %s: %s", k, err)
+			}
+		}
+	}
+}
+
+type fsm Store
+
+// Apply applies a Raft log entry to the key-value store. A command carrying
+// an idempotency key seen before is not applied again, but returns the
+// result of the first. Commands refused with an error are not remembered, so
+// that they can be retried once the cause is gone.
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	b, err := open(f.aead, l.Data)
+	if err != nil {
+		panic(fmt.Sprintf("failed to decrypt command: %s", err.Error()))
+	}
+	var c command
+	if err := json.Unmarshal(b, &c); err != nil {
+		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
+	}
+
+	f.mu.Lock()
+	f.applyIndex = l.Index
+	f.mu.Unlock()
+
+	id := idempotencyID(&c)
+	if id != "" {
+		f.mu.Lock()
+		r, ok := f.idempotency.get(id)
+		f.mu.Unlock()
+		if ok {
+			return r
+		}
+	}
+
+	r := f.dispatch(&c)
+	if _, ok := r.(error); ok {
+		raftApplyErrors.WithLabelValues(c.Op).Inc()
+	} else if id != "" {
+		f.mu.Lock()
+		f.idempotency.record(id, c.Op, r)
+		f.mu.Unlock()
+	}
+	return r
+}
+
+// maintenanceOps are the ops which change keys at a client's request, and so
+// are refused in maintenance mode. Keys still expire.
+var maintenanceOps = map[string]bool{
+	"set":             true,
+	"delete":          true,
+	"deleteprefix":    true,
+	"deletemulti":     true,
+	"flush":           true,
+	"setmulti":        true,
+	"cas":             true,
+	"setifversion":    true,
+	"deleteifversion": true,
+	"incr":            true,
+	"append":          true,
+	"txn":             true,
+}
+
+// dispatch applies c to the FSM, returning the response for Apply.
+func (f *fsm) dispatch(c *command) interface{} {
+	if maintenanceOps[c.Op] {
+		f.mu.Lock()
+		maintenance := f.maintenance
+		f.mu.Unlock()
+		if maintenance {
+			return ErrMaintenance
+		}
+	}
+
+	switch c.Op {
+	case "set":
+		return f.applySet(c.Key, c.Value, c.Expiry)
+	case "delete":
+		return f.applyDelete(c.Key)
+	case "deleteprefix":
+		return f.applyDeletePrefix(c.Key)
+	case "deletemulti":
+		return f.applyDeleteMulti(c.Keys)
+	case "flush":
+		return f.applyFlush()
+	case "setmulti":
+		return f.applySetMulti(c.Values)
+	case "cas":
+		return f.applyCompareAndSwap(c.Key, c.Old, c.Value)
+	case "setifversion":
+		return f.applySetIfVersion(c.Key, c.Value, c.Version)
+	case "deleteifversion":
+		return f.applyDeleteIfVersion(c.Key, c.Version)
+	case "expire":
+		return f.applyExpire(c.Key, c.Expiry)
+	case "incr":
+		return f.applyIncrement(c.Key, c.Delta)
+	case "append":
+		return f.applyAppend(c.Key, c.Value, c.Limit)
+	case "maintenance":
+		return f.applyMaintenance(c.Enabled)
+	case "txn":
+		return f.applyTxn(c.Txn)
+	case "setmeta":
+		return f.applySetMeta(c.Key, c.Value)
+	case "removemeta":
+		return f.applyRemoveMeta(c.Key)
+	default:
+		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
+	}
+}
+
+// Snapshot returns a snapshot of the key-value store.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Clone the keys and maps.
+	o := make(map[string]string, f.keys)
+	if err := f.kv.Iterate(func(k, v string) bool {
+		o[k] = v
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	e := make(map[string]int64)
+	for k, v := range f.expiry {
+		e[k] = v
+	}
+	m := make(map[string]string)
+	for k, v := range f.meta {
+		m[k] = v
+	}
+	vs := make(map[string]uint64, len(f.versions))
+	for k, v := range f.versions {
+		vs[k] = v
+	}
+	return &fsmSnapshot{
+		Store:       o,
+		Expiry:      e,
+		Meta:        m,
+		Versions:    vs,
+		Version:     f.version,
+		Idempotency: f.idempotency.results(),
+		Maintenance: f.maintenance,
+		aead:        f.aead,
+	}, nil
+}
+
+// Restore stores the key-value store to a previous state.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if b, err = open(f.aead, b); err != nil {
+		return err
+	}
+	var snap fsmSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+	if snap.Store == nil {
+		snap.Store = make(map[string]string)
+	}
+	if snap.Expiry == nil {
+		snap.Expiry = make(map[string]int64)
+	}
+	if snap.Meta == nil {
+		snap.Meta = make(map[string]string)
+	}
+	if snap.Versions == nil {
+		snap.Versions = make(map[string]uint64)
+	}
+	idempotency, err := restoreIdempotencyCache(snap.Idempotency)
+	if err != nil {
+		return err
+	}
+
+	// Snapshots taken before keys were versioned give every key a version,
+	// in key order, so that every node agrees on them.
+	var unversioned []string
+	for k := range snap.Store {
+		if _, ok := snap.Versions[k]; !ok {
+			unversioned = append(unversioned, k)
+		}
+	}
+	sort.Strings(unversioned)
+	for _, k := range unversioned {
+		snap.Version++
+		snap.Versions[k] = snap.Version
+	}
+
+	// Raft does not call Restore concurrently with Apply, but reads are
+	// served throughout, so the state is replaced under the lock.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var old []string
+	if err := f.kv.Iterate(func(k, _ string) bool {
+		old = append(old, k)
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, k := range old {
+		if err := f.kv.Delete(k); err != nil {
+			return err
+		}
+	}
+	f.size = 0
+	for k, v := range snap.Store {
+		if err := f.kv.Set(k, v); err != nil {
+			return err
+		}
+		f.size += int64(len(v))
+	}
+	f.keys = len(snap.Store)
+	f.expiry = snap.Expiry
+	f.meta = snap.Meta
+	f.versions, f.version = snap.Versions, snap.Version
+	f.idempotency = idempotency
+	f.maintenance = snap.Maintenance
+	f.history = make(map[string]*keyHistory)
+	f.deletedHistories = nil
+	f.recordSize()
+
+	(*Store)(f).publish(Event{Type: EventReset})
+	return nil
+}
+
+func (f *fsm) applySet(key, value string, expiry int64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.put(key, value)
+	if expiry != 0 {
+		f.expiry[key] = expiry
+	} else {
+		delete(f.expiry, key)
+	}
+	return nil
+}
+
+func (f *fsm) applySetMulti(kv map[string]string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Apply in key order so every node performs the same sequence of writes.
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f.put(k, kv[k])
+		delete(f.expiry, k)
+	}
+	return nil
+}
+
+func (f *fsm) applyCompareAndSwap(key, old, new string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if v, _ := f.get(key); v != old {
+		return false
+	}
+	f.put(key, new)
+	delete(f.expiry, key)
+	return true
+}
+
+// applySetIfVersion returns ErrVersionMismatch, rather than setting key, if
+// key is not at version.
+func (f *fsm) applySetIfVersion(key, value string, version uint64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.versions[key] != version {
+		return ErrVersionMismatch
+	}
+	f.put(key, value)
+	delete(f.expiry, key)
+	return nil
+}
+
+// applyDeleteIfVersion returns ErrVersionMismatch, rather than deleting key,
+// if key is absent or not at version.
+func (f *fsm) applyDeleteIfVersion(key string, version uint64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if v, ok := f.versions[key]; !ok || v != version {
+		return ErrVersionMismatch
+	}
+	f.remove(key)
+	delete(f.expiry, key)
+	return nil
+}
+
+// applyIncrement returns the new value, or ErrNotInteger if the existing value
+// could not be parsed. A key's TTL, if any, is left unchanged.
+func (f *fsm) applyIncrement(key string, delta int64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	if v, ok := f.get(key); ok {
+		var err error
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return ErrNotInteger
+		}
+	}
+	n += delta
+	f.put(key, strconv.FormatInt(n, 10))
+	return n
+}
+
+func (f *fsm) applyAppend(key, chunk string, limit int) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, _ := f.get(key)
+	if limit > 0 && len(v)+len(chunk) > limit {
+		return ErrValueTooLarge
+	}
+	f.put(key, v+chunk)
+	return nil
+}
+
+func (f *fsm) applyMaintenance(enabled bool) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maintenance = enabled
+	return nil
+}
+
+func (f *fsm) applySetMeta(nodeID, httpAddr string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.meta[nodeID] = httpAddr
+	return nil
+}
+
+func (f *fsm) applyRemoveMeta(nodeID string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.meta, nodeID)
+	return nil
+}
+
+// get returns the value of key, and whether it is present. Like put and
+// remove, it panics if the backend fails, since a node which cannot apply a
+// log entry would otherwise diverge from the rest of the cluster. f.mu must be
+// held.
+func (f *fsm) get(key string) (string, bool) {
+	v, ok, err := f.kv.Get(key)
+	if err != nil {
+		panic(fmt.Sprintf("failed to get key from backend: %s", err))
+	}
+	return v, ok
+}
+
+// put sets key to value, keeping the size metrics up to date and notifying
+// watchers. f.mu must be held.
+func (f *fsm) put(key, value string) {
+	prev, ok := f.get(key)
+	if err := f.kv.Set(key, value); err != nil {
+		panic(fmt.Sprintf("failed to set key in backend: %s", err))
+	}
+	if !ok {
+		f.keys++
+	}
+	f.size += int64(len(value) - len(prev))
+	f.version++
+	f.versions[key] = f.version
+	f.recordHistory(key, value, false, ok)
+	f.recordSize()
+	f.recordWrite(key)
+	(*Store)(f).publish(Event{Type: EventSet, Key: key, Value: value})
+}
+
+// remove deletes key, if present, keeping the size metrics up to date and
+// notifying watchers. f.mu must be held.
+func (f *fsm) remove(key string) {
+	prev, ok := f.get(key)
+	if !ok {
+		return
+	}
+	if err := f.kv.Delete(key); err != nil {
+		panic(fmt.Sprintf("failed to delete key from backend: %s", err))
+	}
+	f.keys--
+	f.size -= int64(len(prev))
+	delete(f.versions, key)
+	f.recordHistory(key, "", true, true)
+	f.recordSize()
+	f.recordWrite(key)
+	(*Store)(f).publish(Event{Type: EventDelete, Key: key})
+}
+
+func (f *fsm) recordSize() {
+	kvKeys.Set(float64(f.keys))
+	kvBytes.Set(float64(f.size))
+}
+
+// recordWrite counts a change to key under its prefix. f.mu must be held.
+func (f *fsm) recordWrite(key string) {
+	if f.WritePrefixDepth <= 0 {
+		return
+	}
+	prefix := writePrefix(key, f.WritePrefixDepth)
+	if _, ok := f.writePrefixes[prefix]; !ok {
+		if len(f.writePrefixes) >= f.MaxWritePrefixes {
+			prefix = "other"
+		} else {
+			if f.writePrefixes == nil {
+				f.writePrefixes = make(map[string]struct{})
+			}
+			f.writePrefixes[prefix] = struct{}{}
+		}
+	}
+	kvWrites.WithLabelValues(prefix).Inc()
+}
+
+// writePrefix returns key up to and including its depth-th "/", or its last
+// if it has fewer, so that "users/42/name" has the prefix "users/" at depth 1.
+// A key without a "/" has the empty prefix.
+func writePrefix(key string, depth int) string {
+	end := 0
+	for i := 0; i < depth; i++ {
+		j := strings.IndexByte(key[end:], '/')
+		if j < 0 {
+			break
+		}
+		end += j + 1
+	}
+	return key[:end]
+}
+
+func (f *fsm) applyDelete(key string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.remove(key)
+	delete(f.expiry, key)
+	return nil
+}
+
+// applyDeletePrefix returns the number of keys deleted, including any which
+// had expired but not yet been removed.
+func (f *fsm) applyDeletePrefix(prefix string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	if err := f.kv.Iterate(func(k, _ string) bool {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+		return true
+	}); err != nil {
+		panic(fmt.Sprintf("failed to iterate backend: %s", err))
+	}
+	for _, k := range keys {
+		f.remove(k)
+		delete(f.expiry, k)
+	}
+	return len(keys)
+}
+
+// applyFlush deletes every key, returning how many were deleted.
+func (f *fsm) applyFlush() interface{} {
+	return f.applyDeletePrefix("")
+}
+
+func (f *fsm) applyDeleteMulti(keys []string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, k := range keys {
+		if _, ok := f.get(k); ok {
+			f.remove(k)
+			n++
+		}
+		delete(f.expiry, k)
+	}
+	return n
+}
+
+// applyExpire deletes key, but only if its expiry has not changed since the
+// expire command was issued.
+func (f *fsm) applyExpire(key string, expiry int64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.expiry[key]; !ok || e != expiry {
+		return nil
+	}
+	f.remove(key)
+	delete(f.expiry, key)
+	return nil
 }
 
 type fsmSnapshot struct {
-	store map[string]string
+	Store  map[string]string `json:"store"`
+	Expiry map[string]int64  `json:"expiry,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
+
+	Versions map[string]uint64 `json:"versions,omitempty"`
+	Version  uint64            `json:"version,omitempty"`
+
+	Idempotency []*idempotentResult `json:"idempotency,omitempty"`
+
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	aead cipher.AEAD // Encrypts the snapshot, if set.
 }
 
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
 		// Encode data.
-		b, err := json.Marshal(f.store)
+		b, err := json.Marshal(f)
+		if err == nil {
+			b, err = seal(f.aead, b)
+		}
 		if err != nil {
 			return err
 		}
@@ -1,10 +1,24 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/otoolep/hraftd/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // Test_StoreOpen tests that the store can be opened.
@@ -22,6 +36,62 @@ func Test_StoreOpen(t *testing.T) {
 	if err := s.Open(false, "node0"); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
+	defer s.Close()
+}
+
+// Test_StoreClose tests that closing a store shuts Raft down, and stops the
+// store's background goroutines.
+func Test_StoreClose(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("failed to close store: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for background goroutines to exit")
+	}
+	if s.raft.State() != raft.Shutdown {
+		t.Fatalf("raft not shut down, state is %s", s.raft.State())
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close store twice: %s", err)
+	}
+}
+
+// Test_StoreFollowerRejectsLeaderReads tests that a node which is not the
+// leader only serves stale reads.
+func Test_StoreFollowerRejectsLeaderReads(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(false, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	for _, level := range []ConsistencyLevel{Default, Strong} {
+		if _, err := s.GetWithLevel("foo", level); err != ErrNotLeader {
+			t.Fatalf("wrong error for level %d read on follower: %v", level, err)
+		}
+	}
+	if _, err := s.GetWithLevel("foo", Stale); err != ErrKeyNotFound {
+		t.Fatalf("wrong error for stale read on follower: %v", err)
+	}
 }
 
 // Test_StoreOpenSingleNode tests that a command can be applied to the log
@@ -39,6 +109,7 @@ func Test_StoreOpenSingleNode(t *testing.T) {
 	if err := s.Open(true, "node0"); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
+	defer s.Close()
 
 	// Simple way to ensure there is a leader.
 	time.Sleep(3 * time.Second)
@@ -64,8 +135,8 @@ func Test_StoreOpenSingleNode(t *testing.T) {
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
 	value, err = s.Get("foo")
-	if err != nil {
-		t.Fatalf("failed to get key: %s", err.Error())
+	if err != ErrKeyNotFound {
+		t.Fatalf("wrong error getting deleted key: %v", err)
 	}
 	if value != "" {
 		t.Fatalf("key has wrong value: %s", value)
@@ -88,10 +159,21 @@ func Test_StoreInMemOpenSingleNode(t *testing.T) {
 	if err := s.Open(true, "node0"); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
+	defer s.Close()
 
 	// Simple way to ensure there is a leader.
 	time.Sleep(3 * time.Second)
 
+	if addr, err := s.LeaderAddr(); err != nil || addr == "" {
+		t.Fatalf("no leader address reported: %q, %v", addr, err)
+	}
+	if !s.Ready() {
+		t.Fatalf("store not ready after becoming leader")
+	}
+	if _, err := s.GetWithLevel("foo", Strong); err != ErrKeyNotFound {
+		t.Fatalf("wrong error for strong read on leader: %v", err)
+	}
+
 	if err := s.Set("foo", "bar"); err != nil {
 		t.Fatalf("failed to set key: %s", err.Error())
 	}
@@ -113,10 +195,1539 @@ func Test_StoreInMemOpenSingleNode(t *testing.T) {
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
 	value, err = s.Get("foo")
-	if err != nil {
-		t.Fatalf("failed to get key: %s", err.Error())
+	if err != ErrKeyNotFound {
+		t.Fatalf("wrong error getting deleted key: %v", err)
 	}
 	if value != "" {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 }
+
+// Test_FSMApplySetMulti tests that a multi-key command sets every key.
+func Test_FSMApplySetMulti(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	applyCommand(t, f, &command{Op: "setmulti", Values: map[string]string{"a": "1", "b": "2"}})
+
+	for k, exp := range map[string]string{"a": "1", "b": "2"} {
+		if v, _ := s.Get(k); v != exp {
+			t.Fatalf("key %s has wrong value: %s (expected %s)", k, v, exp)
+		}
+	}
+}
+
+// Test_FSMApplyCompareAndSwap tests that a swap only happens on a matching value.
+func Test_FSMApplyCompareAndSwap(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	// A missing key compares equal to the empty string.
+	if swapped := applyCommand(t, f, &command{Op: "cas", Key: "foo", Old: "", Value: "bar"}); swapped != true {
+		t.Fatalf("swap of missing key failed")
+	}
+	if v, _ := s.Get("foo"); v != "bar" {
+		t.Fatalf("key has wrong value: %s", v)
+	}
+
+	if swapped := applyCommand(t, f, &command{Op: "cas", Key: "foo", Old: "baz", Value: "qux"}); swapped != false {
+		t.Fatalf("swap with stale old value succeeded")
+	}
+	if v, _ := s.Get("foo"); v != "bar" {
+		t.Fatalf("key has wrong value: %s", v)
+	}
+}
+
+// Test_StoreGetMissingKey tests that missing and empty keys are distinguished.
+func Test_StoreGetMissingKey(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	if _, err := s.Get("foo"); err != ErrKeyNotFound {
+		t.Fatalf("wrong error getting missing key: %v", err)
+	}
+
+	applyCommand(t, f, &command{Op: "set", Key: "foo", Value: ""})
+	if _, err := s.Get("foo"); err != nil {
+		t.Fatalf("failed to get empty key: %s", err)
+	}
+}
+
+// Test_StoreScan tests that a scan only returns keys with the given prefix.
+func Test_StoreScan(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	for i := 0; i < 100; i++ {
+		prefix := "user/"
+		if i%2 == 0 {
+			prefix = "group/"
+		}
+		applyCommand(t, f, &command{Op: "set", Key: fmt.Sprintf("%s%d", prefix, i), Value: "v"})
+	}
+
+	for _, prefix := range []string{"user/", "group/"} {
+		m, err := s.Scan(prefix)
+		if err != nil {
+			t.Fatalf("failed to scan prefix %s: %s", prefix, err)
+		}
+		if len(m) != 50 {
+			t.Fatalf("wrong number of keys for prefix %s: %d (expected 50)", prefix, len(m))
+		}
+	}
+}
+
+// Test_StoreGetMulti tests that absent and expired keys are read as nil.
+func Test_StoreGetMulti(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	past := time.Now().Add(-time.Second).UnixNano()
+	applyCommand(t, f, &command{Op: "set", Key: "a", Value: "1"})
+	applyCommand(t, f, &command{Op: "set", Key: "b", Value: "2", Expiry: past})
+
+	m, err := s.GetMulti([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("failed to get keys: %s", err)
+	}
+	if len(m) != 3 || m["a"] == nil || *m["a"] != "1" || m["b"] != nil || m["c"] != nil {
+		t.Fatalf("wrong values read: %v", m)
+	}
+}
+
+// Test_StoreScanMeta tests that keys are described, in order, by the size
+// of their values, their versions and their TTLs.
+func Test_StoreScanMeta(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	expiry := time.Now().Add(time.Hour).UnixNano()
+	applyCommand(t, f, &command{Op: "set", Key: "a/2", Value: "hello"})
+	applyCommand(t, f, &command{Op: "set", Key: "a/1", Value: ""})
+	applyCommand(t, f, &command{Op: "set", Key: "a/3", Value: strings.Repeat("x", 1000), Expiry: expiry})
+	applyCommand(t, f, &command{Op: "set", Key: "b", Value: "other"})
+
+	meta, err := s.ScanMeta("a/")
+	if err != nil {
+		t.Fatalf("failed to scan metadata: %s", err)
+	}
+	if len(meta) != 3 {
+		t.Fatalf("wrong number of keys described: %v", meta)
+	}
+	for i, exp := range []struct {
+		key  string
+		size int
+	}{{"a/1", 0}, {"a/2", 5}, {"a/3", 1000}} {
+		if meta[i].Key != exp.key || meta[i].Size != exp.size {
+			t.Fatalf("wrong metadata for key %d: %+v (expected %s of size %d)", i, meta[i], exp.key, exp.size)
+		}
+		if meta[i].Version != s.versions[exp.key] {
+			t.Fatalf("wrong version for key %s: %d", exp.key, meta[i].Version)
+		}
+	}
+	if meta[0].TTL != "" {
+		t.Fatalf("TTL reported for key without one: %s", meta[0].TTL)
+	}
+	if ttl, err := time.ParseDuration(meta[2].TTL); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("wrong TTL reported: %s", meta[2].TTL)
+	}
+}
+
+// Test_FSMIdempotency tests that replaying an increment with the same
+// idempotency key returns the first result, rather than incrementing again,
+// including once restored from a snapshot.
+func Test_FSMIdempotency(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	incr := &command{Op: "incr", Key: "n", Delta: 5, IdempotencyKey: "abc"}
+	for i := 0; i < 2; i++ {
+		if r := applyCommand(t, f, incr); r != int64(5) {
+			t.Fatalf("wrong result of increment %d: %v", i, r)
+		}
+	}
+	if v, _ := s.Get("n"); v != "5" {
+		t.Fatalf("increment applied more than once: %s", v)
+	}
+
+	// The same key is independent for other keys and operations.
+	if r := applyCommand(t, f, &command{Op: "incr", Key: "m", Delta: 1, IdempotencyKey: "abc"}); r != int64(1) {
+		t.Fatalf("wrong result of increment of other key: %v", r)
+	}
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %s", err)
+	}
+	s2 := New(true)
+	f2 := (*fsm)(s2)
+	if err := f2.Restore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+	if r := applyCommand(t, f2, incr); r != int64(5) {
+		t.Fatalf("wrong result of increment after restore: %v", r)
+	}
+	if v, _ := s2.Get("n"); v != "5" {
+		t.Fatalf("increment applied again after restore: %s", v)
+	}
+}
+
+// Test_FSMIdempotencyRefused tests that a command refused with an error is
+// not remembered, so that it is applied when retried with the same
+// idempotency key once the cause is gone, including after restoring a
+// snapshot which remembered the refusal.
+func Test_FSMIdempotencyRefused(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	set := &command{Op: "set", Key: "foo", Value: "bar", IdempotencyKey: "abc"}
+	applyCommand(t, f, &command{Op: "maintenance", Enabled: true})
+	if r := applyCommand(t, f, set); r != ErrMaintenance {
+		t.Fatalf("wrong result of set in maintenance mode: %v", r)
+	}
+	applyCommand(t, f, &command{Op: "maintenance", Enabled: false})
+	if r := applyCommand(t, f, set); r != nil {
+		t.Fatalf("wrong result of retried set: %v", r)
+	}
+	if v, _ := s.Get("foo"); v != "bar" {
+		t.Fatalf("retried set not applied: %q", v)
+	}
+
+	snap := fsmSnapshot{Idempotency: []*idempotentResult{
+		{ID: idempotencyID(set), Op: "set", Error: ErrMaintenance.Error()},
+	}}
+	b, err := json.Marshal(&snap)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %s", err)
+	}
+	s2 := New(true)
+	f2 := (*fsm)(s2)
+	if err := f2.Restore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+	if r := applyCommand(t, f2, set); r != nil {
+		t.Fatalf("wrong result of set after restore: %v", r)
+	}
+	if v, _ := s2.Get("foo"); v != "bar" {
+		t.Fatalf("set refused before snapshot not applied after restore: %q", v)
+	}
+}
+
+// Test_IdempotencyCacheBounded tests that the least recently used results
+// are forgotten once the cache is full.
+func Test_IdempotencyCacheBounded(t *testing.T) {
+	c := newIdempotencyCache()
+	c.record("first", "set", nil)
+	c.record("second", "set", nil)
+	c.get("first")
+	for i := 0; i < idempotencyCacheSize-1; i++ {
+		c.record(fmt.Sprintf("id%d", i), "set", nil)
+	}
+	if _, ok := c.get("second"); ok {
+		t.Fatalf("least recently used result not forgotten")
+	}
+	if _, ok := c.get("first"); !ok {
+		t.Fatalf("recently used result forgotten")
+	}
+}
+
+// Test_StoreMaxValueSize tests that a value of the maximum size may be set,
+// but not one a byte longer.
+func Test_StoreMaxValueSize(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.MaxValueSize = 16
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.Set("foo", strings.Repeat("x", 16)); err != nil {
+		t.Fatalf("failed to set value of maximum size: %s", err)
+	}
+	if err := s.Set("foo", strings.Repeat("x", 17)); err != ErrValueTooLarge {
+		t.Fatalf("wrong error setting oversized value: %v", err)
+	}
+	if err := s.SetMulti(map[string]string{"a": "", "b": strings.Repeat("x", 17)}); err != ErrValueTooLarge {
+		t.Fatalf("wrong error setting oversized values: %v", err)
+	}
+	if v, _ := s.Get("foo"); len(v) != 16 {
+		t.Fatalf("oversized value set")
+	}
+}
+
+// Test_StoreMaintenance tests that every change to keys fails with
+// ErrMaintenance while the store is in maintenance mode.
+func Test_StoreMaintenance(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+	if err := s.SetMaintenance(true); err != nil {
+		t.Fatalf("failed to enable maintenance mode: %s", err)
+	}
+	if err := s.Set("foo", "baz"); err != ErrMaintenance {
+		t.Fatalf("wrong error setting key: %v", err)
+	}
+	if err := s.SetMulti(map[string]string{"a": "1"}); err != ErrMaintenance {
+		t.Fatalf("wrong error setting keys: %v", err)
+	}
+	if err := s.Delete("foo"); err != ErrMaintenance {
+		t.Fatalf("wrong error deleting key: %v", err)
+	}
+	if _, err := s.DeletePrefix("f"); err != ErrMaintenance {
+		t.Fatalf("wrong error deleting prefix: %v", err)
+	}
+	if _, err := s.Flush(); err != ErrMaintenance {
+		t.Fatalf("wrong error flushing keys: %v", err)
+	}
+	if _, err := s.CompareAndSwap("foo", "bar", "baz"); err != ErrMaintenance {
+		t.Fatalf("wrong error swapping key: %v", err)
+	}
+	if v, _ := s.Get("foo"); v != "bar" {
+		t.Fatalf("key changed in maintenance mode: %q", v)
+	}
+
+	if err := s.SetMaintenance(false); err != nil {
+		t.Fatalf("failed to disable maintenance mode: %s", err)
+	}
+	if err := s.Set("foo", "baz"); err != nil {
+		t.Fatalf("failed to set key after maintenance: %s", err)
+	}
+}
+
+// Test_StoreReloadRaftConfig tests that Raft tuning can be changed on a
+// running node, and that values out of range are refused.
+func Test_StoreReloadRaftConfig(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	threshold, interval := uint64(1000), time.Minute
+	if err := s.ReloadRaftConfig(RaftReloadable{SnapshotThreshold: &threshold, SnapshotInterval: &interval}); err != nil {
+		t.Fatalf("failed to reload Raft config: %s", err)
+	}
+	c := s.RaftConfig()
+	if c.SnapshotThreshold != 1000 || c.SnapshotInterval != "1m0s" || c.TrailingLogs != raft.DefaultConfig().TrailingLogs {
+		t.Fatalf("wrong Raft config after reload: %+v", c)
+	}
+
+	interval = time.Millisecond
+	if err := s.ReloadRaftConfig(RaftReloadable{SnapshotInterval: &interval}); !errors.Is(err, ErrInvalidRaftConfig) {
+		t.Fatalf("wrong error reloading invalid Raft config: %v", err)
+	}
+	if c := s.RaftConfig(); c.SnapshotInterval != "1m0s" {
+		t.Fatalf("Raft config changed by invalid reload: %+v", c)
+	}
+}
+
+// Test_StoreBootstrap tests that a node opened without bootstrapping can be
+// bootstrapped later, but only once.
+func Test_StoreBootstrap(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(false, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	if err := s.Bootstrap(); err != nil {
+		t.Fatalf("failed to bootstrap store: %s", err)
+	}
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key on bootstrapped store: %s", err)
+	}
+	if err := s.Barrier(time.Second); err != nil {
+		t.Fatalf("failed to issue barrier: %s", err)
+	}
+	if err := s.Bootstrap(); err != ErrBootstrapped {
+		t.Fatalf("wrong error bootstrapping store again: %v", err)
+	}
+}
+
+// Test_StoreExists tests that Exists reports present keys, and not expired or
+// absent ones.
+func Test_StoreExists(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	past := time.Now().Add(-time.Second).UnixNano()
+	applyCommand(t, f, &command{Op: "set", Key: "a", Value: ""})
+	applyCommand(t, f, &command{Op: "set", Key: "b", Value: "2", Expiry: past})
+
+	for k, exp := range map[string]bool{"a": true, "b": false, "c": false} {
+		ok, err := s.Exists(k)
+		if err != nil {
+			t.Fatalf("failed to check key %s: %s", k, err)
+		}
+		if ok != exp {
+			t.Fatalf("wrong existence reported for key %s: %v (expected %v)", k, ok, exp)
+		}
+	}
+}
+
+// Test_FSMExpiry tests that expired keys are hidden and removed only by a
+// matching expire command.
+func Test_FSMExpiry(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	past := time.Now().Add(-time.Second).UnixNano()
+	applyCommand(t, f, &command{Op: "set", Key: "foo", Value: "bar", Expiry: past})
+	if _, err := s.Get("foo"); err != ErrKeyNotFound {
+		t.Fatalf("wrong error getting expired key: %v", err)
+	}
+
+	// An expire for a different expiry, as if the key had been set again, is ignored.
+	applyCommand(t, f, &command{Op: "expire", Key: "foo", Expiry: past + 1})
+	if _, ok, _ := s.kv.Get("foo"); !ok {
+		t.Fatalf("key removed by stale expire command")
+	}
+
+	applyCommand(t, f, &command{Op: "expire", Key: "foo", Expiry: past})
+	if _, ok, _ := s.kv.Get("foo"); ok {
+		t.Fatalf("key not removed by expire command")
+	}
+
+	// Setting a key without a TTL clears any existing expiry.
+	applyCommand(t, f, &command{Op: "set", Key: "baz", Value: "qux", Expiry: past})
+	applyCommand(t, f, &command{Op: "set", Key: "baz", Value: "qux"})
+	if _, err := s.Get("baz"); err != nil {
+		t.Fatalf("failed to get key after TTL cleared: %s", err)
+	}
+}
+
+// Test_StoreInMemSetWithTTL tests that the leader deletes a key once its TTL passes.
+func Test_StoreInMemSetWithTTL(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s.SetWithTTL("foo", "bar", time.Second); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	// Wait for the expiry scan to issue the delete.
+	time.Sleep(1500*time.Millisecond + expiryScanInterval)
+	s.mu.Lock()
+	_, ok, _ := s.kv.Get("foo")
+	s.mu.Unlock()
+	if ok {
+		t.Fatalf("expired key still present")
+	}
+}
+
+// Test_StoreInMemConcurrentIncrement tests that concurrent increments all apply.
+func Test_StoreInMemConcurrentIncrement(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := s.Increment("counter", 2); err != nil {
+					t.Errorf("failed to increment key: %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	n, err := s.Increment("counter", 0)
+	if err != nil {
+		t.Fatalf("failed to increment key: %s", err)
+	}
+	if n != 200 {
+		t.Fatalf("counter has wrong value: %d (expected 200)", n)
+	}
+}
+
+// Test_FSMApplyIncrementNotInteger tests that a non-integer value is not incremented.
+func Test_FSMApplyIncrementNotInteger(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	applyCommand(t, f, &command{Op: "set", Key: "foo", Value: "bar"})
+	if r := applyCommand(t, f, &command{Op: "incr", Key: "foo", Delta: 1}); r != ErrNotInteger {
+		t.Fatalf("wrong response incrementing non-integer: %v", r)
+	}
+	if v, _ := s.Get("foo"); v != "bar" {
+		t.Fatalf("key has wrong value: %s", v)
+	}
+}
+
+// Test_FSMApplyDeletePrefix tests that only keys under the prefix are deleted.
+func Test_FSMApplyDeletePrefix(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	applyCommand(t, f, &command{Op: "setmulti", Values: map[string]string{"tmp/a": "1", "tmp/b": "2", "tmpx": "3"}})
+	applyCommand(t, f, &command{Op: "set", Key: "tmp/c", Value: "4", Expiry: time.Now().Add(time.Hour).UnixNano()})
+	if r := applyCommand(t, f, &command{Op: "deleteprefix", Key: "tmp/"}); r != 3 {
+		t.Fatalf("wrong number of keys deleted: %v", r)
+	}
+	if v, err := s.Get("tmpx"); err != nil || v != "3" {
+		t.Fatalf("unrelated key deleted")
+	}
+	if _, ok := s.expiry["tmp/c"]; ok {
+		t.Fatalf("expiry of deleted key kept")
+	}
+}
+
+// Test_FSMApplyDeleteMulti tests that only the listed keys are deleted, and
+// only those present are counted.
+func Test_FSMApplyDeleteMulti(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	applyCommand(t, f, &command{Op: "setmulti", Values: map[string]string{"a": "1", "b": "2", "c": "3"}})
+	if r := applyCommand(t, f, &command{Op: "deletemulti", Keys: []string{"a", "b", "missing"}}); r != 2 {
+		t.Fatalf("wrong number of keys deleted: %v", r)
+	}
+	if _, err := s.Get("a"); err != ErrKeyNotFound {
+		t.Fatalf("listed key not deleted")
+	}
+	if v, err := s.Get("c"); err != nil || v != "3" {
+		t.Fatalf("unlisted key deleted")
+	}
+}
+
+// Test_FSMApplyFlush tests that a flush, applied on every node, leaves each
+// of them empty.
+func Test_FSMApplyFlush(t *testing.T) {
+	nodes := []*Store{New(true), New(true)}
+	for _, s := range nodes {
+		f := (*fsm)(s)
+		applyCommand(t, f, &command{Op: "setmulti", Values: map[string]string{"a": "1", "b/c": "2"}})
+		applyCommand(t, f, &command{Op: "set", Key: "ttl", Value: "3", Expiry: time.Now().Add(time.Hour).UnixNano()})
+		if r := applyCommand(t, f, &command{Op: "flush"}); r != 3 {
+			t.Fatalf("wrong number of keys flushed: %v", r)
+		}
+		m, err := s.Scan("")
+		if err != nil {
+			t.Fatalf("failed to scan: %s", err)
+		}
+		if len(m) != 0 || len(s.expiry) != 0 {
+			t.Fatalf("keys remain after flush: %v, expiring %v", m, s.expiry)
+		}
+	}
+}
+
+// Test_StoreScanPage tests that keys are paged through in sorted order.
+func Test_StoreScanPage(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	applyCommand(t, f, &command{Op: "setmulti", Values: map[string]string{"k3": "", "k1": "", "k2": "", "x": ""}})
+
+	tests := []struct {
+		after string
+		limit int
+		keys  string
+		next  string
+	}{
+		{"", 2, "[k1 k2]", "k2"},
+		{"k2", 2, "[k3]", ""},
+		{"", 3, "[k1 k2 k3]", ""},
+		{"k3", 3, "[]", ""},
+	}
+	for _, tt := range tests {
+		keys, next, err := s.ScanPage("k", tt.after, tt.limit)
+		if err != nil {
+			t.Fatalf("failed to scan page: %s", err)
+		}
+		if fmt.Sprint(keys) != tt.keys || next != tt.next {
+			t.Fatalf("wrong page after %q: %v, %q", tt.after, keys, next)
+		}
+	}
+}
+
+// Test_StoreWatch tests that watchers receive changes under their prefix, and
+// are reset once they fall behind.
+func Test_StoreWatch(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	events, cancel := s.Watch("config/")
+
+	applyCommand(t, f, &command{Op: "set", Key: "other", Value: "1"})
+	applyCommand(t, f, &command{Op: "set", Key: "config/a", Value: "2"})
+	applyCommand(t, f, &command{Op: "delete", Key: "config/a"})
+	applyCommand(t, f, &command{Op: "delete", Key: "config/missing"})
+	for _, exp := range []Event{
+		{Type: EventSet, Key: "config/a", Value: "2"},
+		{Type: EventDelete, Key: "config/a"},
+	} {
+		select {
+		case e := <-events:
+			if e != exp {
+				t.Fatalf("wrong event received: %+v (expected %+v)", e, exp)
+			}
+		default:
+			t.Fatalf("no event received, expected %+v", exp)
+		}
+	}
+	if len(events) != 0 {
+		t.Fatalf("unexpected event received: %+v", <-events)
+	}
+
+	for i := 0; i <= watchBufferSize; i++ {
+		applyCommand(t, f, &command{Op: "set", Key: "config/b", Value: fmt.Sprint(i)})
+	}
+	if e := <-events; e.Type != EventReset || len(events) != 0 {
+		t.Fatalf("watcher not reset after falling behind: %+v", e)
+	}
+
+	cancel()
+	applyCommand(t, f, &command{Op: "set", Key: "config/c", Value: "3"})
+	if len(events) != 0 {
+		t.Fatalf("event received after watch cancelled")
+	}
+}
+
+// Test_FSMSizeMetrics tests that the key count and size gauges track sets and
+// deletes.
+func Test_FSMSizeMetrics(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	applyCommand(t, f, &command{Op: "set", Key: "a", Value: "1"})
+	applyCommand(t, f, &command{Op: "setmulti", Values: map[string]string{"b": "22", "c": "333"}})
+	applyCommand(t, f, &command{Op: "set", Key: "a", Value: "4444"})
+	if v := testutil.ToFloat64(kvKeys); v != 3 {
+		t.Fatalf("key count is %v (expected 3)", v)
+	}
+	if v := testutil.ToFloat64(kvBytes); v != 9 {
+		t.Fatalf("size is %v (expected 9)", v)
+	}
+
+	applyCommand(t, f, &command{Op: "delete", Key: "b"})
+	if v := testutil.ToFloat64(kvKeys); v != 2 {
+		t.Fatalf("key count is %v (expected 2)", v)
+	}
+	if v := testutil.ToFloat64(kvBytes); v != 7 {
+		t.Fatalf("size is %v (expected 7)", v)
+	}
+}
+
+// Test_FSMWriteMetrics tests that changes are counted by key prefix, up to a
+// limit on the number of prefixes, beyond which they are counted as "other".
+func Test_FSMWriteMetrics(t *testing.T) {
+	s := New(true)
+	s.MaxWritePrefixes = 2
+	f := (*fsm)(s)
+
+	written := func(prefix string) float64 {
+		return testutil.ToFloat64(kvWrites.WithLabelValues(prefix))
+	}
+	users, orders, other := written("users/"), written("orders/"), written("other")
+
+	applyCommand(t, f, &command{Op: "set", Key: "users/1/name", Value: "a"})
+	applyCommand(t, f, &command{Op: "setmulti", Values: map[string]string{"users/2": "b", "orders/1": "c"}})
+	applyCommand(t, f, &command{Op: "delete", Key: "users/1/name"})
+	applyCommand(t, f, &command{Op: "set", Key: "invoices/1", Value: "d"})
+	if v := written("users/") - users; v != 3 {
+		t.Fatalf("wrong count of writes under users/: %v (expected 3)", v)
+	}
+	if v := written("orders/") - orders; v != 1 {
+		t.Fatalf("wrong count of writes under orders/: %v (expected 1)", v)
+	}
+	if v := written("other") - other; v != 1 {
+		t.Fatalf("wrong count of writes over prefix limit: %v (expected 1)", v)
+	}
+}
+
+func Test_WritePrefix(t *testing.T) {
+	tests := []struct {
+		key    string
+		depth  int
+		prefix string
+	}{
+		{"users/42/name", 1, "users/"},
+		{"users/42/name", 2, "users/42/"},
+		{"users/42/name", 3, "users/42/"},
+		{"users", 1, ""},
+	}
+	for _, tt := range tests {
+		if p := writePrefix(tt.key, tt.depth); p != tt.prefix {
+			t.Fatalf("wrong prefix of %q at depth %d: %q (expected %q)", tt.key, tt.depth, p, tt.prefix)
+		}
+	}
+}
+
+// Test_ApplyErrorsCounted tests that commands which fail to be applied, either
+// by Raft or by the FSM, are counted.
+func Test_ApplyErrorsCounted(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(false, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	incr := testutil.ToFloat64(raftApplyErrors.WithLabelValues("incr"))
+	f := (*fsm)(s)
+	applyCommand(t, f, &command{Op: "set", Key: "foo", Value: "bar"})
+	applyCommand(t, f, &command{Op: "incr", Key: "foo", Delta: 1})
+	if v := testutil.ToFloat64(raftApplyErrors.WithLabelValues("incr")); v != incr+1 {
+		t.Fatalf("incr apply errors is %v (expected %v)", v, incr+1)
+	}
+
+	set := testutil.ToFloat64(raftApplyErrors.WithLabelValues("set"))
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+	if _, err := s.apply(context.Background(), &command{Op: "set", Key: "foo", Value: "baz"}); err != raft.ErrRaftShutdown {
+		t.Fatalf("wrong error applying to shut down raft: %v", err)
+	}
+	if v := testutil.ToFloat64(raftApplyErrors.WithLabelValues("set")); v != set+1 {
+		t.Fatalf("set apply errors is %v (expected %v)", v, set+1)
+	}
+}
+
+// Test_StoreBackupRestore tests that a backup of one store can be restored
+// into another.
+func Test_StoreBackupRestore(t *testing.T) {
+	stores := make([]*Store, 2)
+	for i := range stores {
+		s := New(true)
+		tmpDir, _ := ioutil.TempDir("", "store_test")
+		defer os.RemoveAll(tmpDir)
+
+		s.RaftBind = "127.0.0.1:0"
+		s.RaftDir = tmpDir
+		if err := s.Open(true, "node0"); err != nil {
+			t.Fatalf("failed to open store: %s", err)
+		}
+		defer s.Close()
+		stores[i] = s
+	}
+	src, dst := stores[0], stores[1]
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	kv := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		kv[fmt.Sprintf("key%d", i)] = fmt.Sprintf("value%d", i)
+	}
+	if err := src.SetMulti(kv); err != nil {
+		t.Fatalf("failed to set keys: %s", err)
+	}
+	if err := src.SetWithTTL("ttl", "v", time.Hour); err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Backup(&buf); err != nil {
+		t.Fatalf("failed to back up store: %s", err)
+	}
+	if err := dst.Restore(bytes.NewReader(buf.Bytes()), false); err != nil {
+		t.Fatalf("failed to restore store: %s", err)
+	}
+
+	got, _ := dst.Scan("")
+	want, _ := src.Scan("")
+	if len(got) != 1001 || len(got) != len(want) {
+		t.Fatalf("wrong number of keys restored: %d", len(got))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("key %s restored as %q (expected %q)", k, got[k], v)
+		}
+	}
+	src.mu.Lock()
+	e := src.expiry["ttl"]
+	src.mu.Unlock()
+	dst.mu.Lock()
+	restored := dst.expiry["ttl"]
+	dst.mu.Unlock()
+	if restored != e {
+		t.Fatalf("expiry not restored")
+	}
+
+	if err := dst.Restore(bytes.NewReader(buf.Bytes()), false); err != ErrNotEmpty {
+		t.Fatalf("wrong error restoring into non-empty store: %v", err)
+	}
+	if err := dst.Restore(bytes.NewReader(buf.Bytes()), true); err != nil {
+		t.Fatalf("failed to force restore: %s", err)
+	}
+}
+
+// Test_FSMSnapshotRestore tests that keys, expiries and node metadata survive
+// a snapshot and restore.
+func Test_FSMSnapshotRestore(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	expiry := time.Now().Add(time.Hour).UnixNano()
+	applyCommand(t, f, &command{Op: "set", Key: "foo", Value: "bar", Expiry: expiry})
+	applyCommand(t, f, &command{Op: "setmeta", Key: "node1", Value: "127.0.0.1:11001"})
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %s", err)
+	}
+
+	s2 := New(true)
+	if err := (*fsm)(s2).Restore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+	if v, _ := s2.Get("foo"); v != "bar" {
+		t.Fatalf("key has wrong value after restore: %s", v)
+	}
+	if s2.expiry["foo"] != expiry {
+		t.Fatalf("key has wrong expiry after restore: %d", s2.expiry["foo"])
+	}
+	if s2.meta["node1"] != "127.0.0.1:11001" {
+		t.Fatalf("node has wrong HTTP address after restore: %s", s2.meta["node1"])
+	}
+	if s2.versions["foo"] != s.versions["foo"] || s2.version != s.version {
+		t.Fatalf("wrong versions after restore: %v, %d", s2.versions, s2.version)
+	}
+}
+
+// Test_FSMRestoreWhileReading tests that the state can be read while a
+// snapshot is being restored. It is only meaningful with -race.
+func Test_FSMRestoreWhileReading(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	for i := 0; i < 100; i++ {
+		applyCommand(t, f, &command{Op: "set", Key: fmt.Sprintf("key%d", i), Value: "v"})
+	}
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %s", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.Get("key1")
+			s.Scan("key")
+			s.ScanMeta("key")
+			s.Maintenance()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := f.Restore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+			t.Fatalf("failed to restore: %s", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if v, err := s.Get("key99"); err != nil || v != "v" {
+		t.Fatalf("wrong value after restore: %q, %v", v, err)
+	}
+}
+
+// Test_StoreEncryption tests that, with an encryption key, neither the Raft
+// log nor snapshots on disk hold values in the clear, and that snapshots are
+// decrypted on restore.
+func Test_StoreEncryption(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	s := New(false)
+	s.EncryptionKey = key
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	const secret = "top-secret-value"
+	if err := s.Set("foo", secret); err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+	if v, err := s.Get("foo"); err != nil || v != secret {
+		t.Fatalf("wrong value read back: %q, %v", v, err)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+
+	snaps, err := filepath.Glob(filepath.Join(tmpDir, "snapshots", "*", "state.bin"))
+	if err != nil || len(snaps) == 0 {
+		t.Fatalf("no snapshot written: %v", err)
+	}
+	snap, err := ioutil.ReadFile(snaps[0])
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %s", err)
+	}
+	if bytes.Contains(snap, []byte(secret)) {
+		t.Fatalf("snapshot holds value in the clear")
+	}
+	log, err := ioutil.ReadFile(filepath.Join(tmpDir, "raft.db"))
+	if err != nil {
+		t.Fatalf("failed to read Raft log: %s", err)
+	}
+	if bytes.Contains(log, []byte(secret)) {
+		t.Fatalf("Raft log holds value in the clear")
+	}
+
+	// The snapshot can only be restored with the key.
+	if err := (*fsm)(New(true)).Restore(ioutil.NopCloser(bytes.NewReader(snap))); err != ErrNoEncryptionKey {
+		t.Fatalf("wrong error restoring without key: %v", err)
+	}
+	s2 := New(true)
+	if s2.aead, err = newAEAD(key); err != nil {
+		t.Fatalf("failed to create cipher: %s", err)
+	}
+	if err := (*fsm)(s2).Restore(ioutil.NopCloser(bytes.NewReader(snap))); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+	if v, err := s2.Get("foo"); err != nil || v != secret {
+		t.Fatalf("wrong value after restore: %q, %v", v, err)
+	}
+}
+
+// Test_FSMHistory tests that a key can be read as of each of its retained
+// versions, and that older versions are reported as pruned.
+func Test_FSMHistory(t *testing.T) {
+	s := New(true)
+	s.HistoryDepth = 3
+	f := (*fsm)(s)
+	apply := func(index uint64, c *command) {
+		b, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		f.Apply(&raft.Log{Index: index, Data: b})
+	}
+	apply(10, &command{Op: "set", Key: "foo", Value: "a"})
+	apply(20, &command{Op: "set", Key: "foo", Value: "b"})
+	apply(30, &command{Op: "set", Key: "foo", Value: "c"})
+
+	for _, tt := range []struct {
+		index uint64
+		value string
+		err   error
+	}{
+		{5, "", ErrKeyNotFound},
+		{10, "a", nil},
+		{15, "a", nil},
+		{20, "b", nil},
+		{30, "c", nil},
+		{35, "c", nil},
+	} {
+		if v, err := s.GetAt("foo", tt.index); v != tt.value || err != tt.err {
+			t.Fatalf("wrong result at index %d: %q, %v (expected %q, %v)", tt.index, v, err, tt.value, tt.err)
+		}
+	}
+
+	apply(40, &command{Op: "delete", Key: "foo"})
+	if _, err := s.GetAt("foo", 45); err != ErrKeyNotFound {
+		t.Fatalf("wrong error reading deleted key: %v", err)
+	}
+	if _, err := s.GetAt("foo", 15); err != ErrHistoryPruned {
+		t.Fatalf("wrong error reading pruned version: %v", err)
+	}
+	if v, err := s.GetAt("foo", 25); v != "b" || err != nil {
+		t.Fatalf("wrong result reading retained version: %q, %v", v, err)
+	}
+}
+
+// Test_FSMHistoryDeleted tests that the history of only the most recently
+// deleted keys is retained, and that reads as of before the deletion of a key
+// whose history was dropped report it as pruned.
+func Test_FSMHistoryDeleted(t *testing.T) {
+	s := New(true)
+	s.HistoryDepth = 3
+	s.MaxDeletedHistories = 2
+	f := (*fsm)(s)
+	apply := func(index uint64, c *command) {
+		b, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		f.Apply(&raft.Log{Index: index, Data: b})
+	}
+	for i, k := range []string{"a", "b", "c", "d"} {
+		apply(uint64(10*i+1), &command{Op: "set", Key: k, Value: "x"})
+	}
+	apply(50, &command{Op: "delete", Key: "a"})
+	apply(51, &command{Op: "delete", Key: "b"})
+	apply(52, &command{Op: "set", Key: "a", Value: "y"})
+	apply(53, &command{Op: "delete", Key: "c"})
+	apply(54, &command{Op: "delete", Key: "d"})
+
+	if n := len(s.history); n != 3 {
+		t.Fatalf("wrong number of keys with history: %d", n)
+	}
+	for _, tt := range []struct {
+		key   string
+		index uint64
+		value string
+		err   error
+	}{
+		{"a", 45, "x", nil},
+		{"a", 52, "y", nil},
+		{"b", 45, "", ErrHistoryPruned},
+		{"b", 60, "", ErrKeyNotFound},
+		{"c", 45, "x", nil},
+		{"d", 60, "", ErrKeyNotFound},
+		{"e", 45, "", ErrHistoryPruned},
+		{"e", 60, "", ErrKeyNotFound},
+	} {
+		if v, err := s.GetAt(tt.key, tt.index); v != tt.value || err != tt.err {
+			t.Fatalf("wrong result for %s at index %d: %q, %v (expected %q, %v)", tt.key, tt.index, v, err, tt.value, tt.err)
+		}
+	}
+}
+
+// Test_FSMHistoryRestore tests that history can be read while a snapshot is
+// being restored, and that restoring drops the history of every key, including
+// deleted ones.
+func Test_FSMHistoryRestore(t *testing.T) {
+	s := New(true)
+	s.HistoryDepth = 3
+	f := (*fsm)(s)
+	apply := func(index uint64, c *command) {
+		b, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err)
+		}
+		f.Apply(&raft.Log{Index: index, Data: b})
+	}
+	apply(10, &command{Op: "set", Key: "foo", Value: "a"})
+	apply(20, &command{Op: "set", Key: "bar", Value: "a"})
+	apply(30, &command{Op: "delete", Key: "bar"})
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %s", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.GetAt("foo", 15)
+			s.GetAt("bar", 25)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := f.Restore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+			t.Fatalf("failed to restore: %s", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if len(s.history) != 0 || len(s.deletedHistories) != 0 {
+		t.Fatalf("history retained after restore: %v, %v", s.history, s.deletedHistories)
+	}
+	if _, err := s.GetAt("foo", 15); err != ErrHistoryPruned {
+		t.Fatalf("wrong error reading history from before restore: %v", err)
+	}
+}
+
+// Test_FSMTxn tests that a transaction applies its success ops if its
+// comparisons hold, and its failure ops otherwise.
+func Test_FSMTxn(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	applyCommand(t, f, &command{Op: "set", Key: "a", Value: "1"})
+	applyCommand(t, f, &command{Op: "set", Key: "b", Value: "x"})
+
+	txn := &Txn{
+		Compares: []Compare{{Key: "a", Value: "1"}, {Key: "missing", Value: ""}},
+		Success:  []TxnOp{{Op: "put", Key: "c", Value: "3"}, {Op: "delete", Key: "b"}},
+		Failure:  []TxnOp{{Op: "put", Key: "failed", Value: "yes"}},
+	}
+	if r := applyCommand(t, f, &command{Op: "txn", Txn: txn}); r != true {
+		t.Fatalf("transaction did not succeed: %v", r)
+	}
+	if v, _ := s.Get("c"); v != "3" {
+		t.Fatalf("success op not applied")
+	}
+	if _, err := s.Get("b"); err != ErrKeyNotFound {
+		t.Fatalf("success delete not applied")
+	}
+
+	txn.Compares = []Compare{{Key: "a", Value: "2"}}
+	if r := applyCommand(t, f, &command{Op: "txn", Txn: txn}); r != false {
+		t.Fatalf("transaction succeeded despite failed comparison: %v", r)
+	}
+	if v, _ := s.Get("failed"); v != "yes" {
+		t.Fatalf("failure op not applied")
+	}
+}
+
+// Test_FSMMaintenance tests that keys cannot be changed in maintenance mode,
+// that the mode survives a snapshot, and that turning it off allows changes
+// again.
+func Test_FSMMaintenance(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	applyCommand(t, f, &command{Op: "set", Key: "foo", Value: "a"})
+	applyCommand(t, f, &command{Op: "maintenance", Enabled: true})
+	if !s.Maintenance() {
+		t.Fatalf("maintenance mode not on")
+	}
+	for _, c := range []*command{
+		{Op: "set", Key: "foo", Value: "b"},
+		{Op: "delete", Key: "foo"},
+		{Op: "incr", Key: "n", Delta: 1},
+	} {
+		if r := applyCommand(t, f, c); r != ErrMaintenance {
+			t.Fatalf("wrong result applying %s in maintenance mode: %v", c.Op, r)
+		}
+	}
+	if v, _ := s.Get("foo"); v != "a" {
+		t.Fatalf("key changed in maintenance mode: %s", v)
+	}
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %s", err)
+	}
+	s2 := New(true)
+	if err := (*fsm)(s2).Restore(ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+	if !s2.Maintenance() {
+		t.Fatalf("maintenance mode not restored")
+	}
+
+	applyCommand(t, f, &command{Op: "maintenance", Enabled: false})
+	if r := applyCommand(t, f, &command{Op: "set", Key: "foo", Value: "b"}); r != nil {
+		t.Fatalf("failed to set key after maintenance: %v", r)
+	}
+}
+
+// Test_FSMAppend tests that appends assemble a value from chunks, up to the
+// limit carried by the command.
+func Test_FSMAppend(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	for _, chunk := range []string{"abc", "def", "gh"} {
+		if r := applyCommand(t, f, &command{Op: "append", Key: "foo", Value: chunk, Limit: 8}); r != nil {
+			t.Fatalf("failed to append %s: %v", chunk, r)
+		}
+	}
+	if v, _ := s.Get("foo"); v != "abcdefgh" {
+		t.Fatalf("wrong value after appends: %s", v)
+	}
+	if r := applyCommand(t, f, &command{Op: "append", Key: "foo", Value: "i", Limit: 8}); r != ErrValueTooLarge {
+		t.Fatalf("wrong result appending past limit: %v", r)
+	}
+	if v, _ := s.Get("foo"); v != "abcdefgh" {
+		t.Fatalf("value changed by refused append: %s", v)
+	}
+}
+
+// Test_FSMVersions tests that every write gives a key a new version, even
+// once deleted and set again, and that conditional writes check it.
+func Test_FSMVersions(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	applyCommand(t, f, &command{Op: "set", Key: "foo", Value: "a"})
+	v1 := s.versions["foo"]
+	if v1 == 0 {
+		t.Fatalf("key not given a version")
+	}
+
+	if r := applyCommand(t, f, &command{Op: "setifversion", Key: "foo", Value: "b", Version: v1 + 1}); r != ErrVersionMismatch {
+		t.Fatalf("wrong response for set at wrong version: %v", r)
+	}
+	if r := applyCommand(t, f, &command{Op: "setifversion", Key: "foo", Value: "b", Version: v1}); r != nil {
+		t.Fatalf("wrong response for set at current version: %v", r)
+	}
+	if v, _ := s.Get("foo"); v != "b" {
+		t.Fatalf("wrong value after conditional set: %s", v)
+	}
+	if s.versions["foo"] <= v1 {
+		t.Fatalf("version not advanced by write: %d", s.versions["foo"])
+	}
+
+	applyCommand(t, f, &command{Op: "delete", Key: "foo"})
+	applyCommand(t, f, &command{Op: "set", Key: "foo", Value: "a"})
+	if s.versions["foo"] == v1 {
+		t.Fatalf("key returned to earlier version after delete")
+	}
+
+	if r := applyCommand(t, f, &command{Op: "deleteifversion", Key: "foo", Version: v1}); r != ErrVersionMismatch {
+		t.Fatalf("wrong response for delete at wrong version: %v", r)
+	}
+	if r := applyCommand(t, f, &command{Op: "deleteifversion", Key: "foo", Version: s.versions["foo"]}); r != nil {
+		t.Fatalf("wrong response for delete at current version: %v", r)
+	}
+	if _, err := s.Get("foo"); err != ErrKeyNotFound {
+		t.Fatalf("key not deleted by conditional delete")
+	}
+	if r := applyCommand(t, f, &command{Op: "setifversion", Key: "foo", Value: "c"}); r != nil {
+		t.Fatalf("wrong response for set requiring absent key: %v", r)
+	}
+}
+
+// Test_StoreJoinRemove tests that a node can join, and then be removed from, a cluster.
+func Test_StoreJoinRemove(t *testing.T) {
+	s0 := New(true)
+	tmpDir0, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = freeAddr(t)
+	s0.RaftDir = tmpDir0
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s0.Close()
+
+	s1 := New(true)
+	tmpDir1, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = freeAddr(t)
+	s1.RaftDir = tmpDir1
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s1.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s0.Join("node1", s1.RaftBind, "", true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	if n := numServers(t, s0); n != 2 {
+		t.Fatalf("wrong number of servers after join: %d (expected 2)", n)
+	}
+	servers, err := s0.Servers()
+	if err != nil {
+		t.Fatalf("failed to get servers: %s", err)
+	}
+	for _, srv := range servers {
+		if srv.Suffrage != "voter" || srv.Leader != (srv.ID == "node0") {
+			t.Fatalf("wrong server info for %s: %+v", srv.ID, srv)
+		}
+	}
+
+	if err := s0.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	followers, err := s0.Replication()
+	if err != nil {
+		t.Fatalf("failed to get replication: %s", err)
+	}
+	if len(followers) != 1 || followers[0].ID != "node1" || followers[0].Lag != 0 || followers[0].LastContact == nil {
+		t.Fatalf("wrong replication reported: %+v", followers)
+	}
+	if _, err := s1.Replication(); err != ErrNotLeader {
+		t.Fatalf("wrong error getting replication from follower: %v", err)
+	}
+
+	if err := s0.Remove("node2"); err != ErrNodeNotFound {
+		t.Fatalf("wrong error removing unknown node: %v", err)
+	}
+	if err := s0.Remove("node1"); err != nil {
+		t.Fatalf("failed to remove node: %s", err)
+	}
+	if n := numServers(t, s0); n != 1 {
+		t.Fatalf("wrong number of servers after remove: %d (expected 1)", n)
+	}
+}
+
+// Test_StorePromote tests that a node which joined as a non-voter can be
+// promoted to a voter.
+func Test_StorePromote(t *testing.T) {
+	s0 := New(true)
+	tmpDir0, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = freeAddr(t)
+	s0.RaftDir = tmpDir0
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s0.Close()
+
+	s1 := New(true)
+	tmpDir1, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = freeAddr(t)
+	s1.RaftDir = tmpDir1
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s1.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s0.Join("node1", s1.RaftBind, "127.0.0.1:11001", false); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	suffrage := func() string {
+		servers, err := s0.Servers()
+		if err != nil {
+			t.Fatalf("failed to get servers: %s", err)
+		}
+		for _, srv := range servers {
+			if srv.ID == "node1" {
+				return srv.Suffrage
+			}
+		}
+		return ""
+	}
+	if sf := suffrage(); sf != "nonvoter" {
+		t.Fatalf("wrong suffrage after non-voter join: %s", sf)
+	}
+	if addr := s0.NodeHTTPAddr("node1"); addr != "127.0.0.1:11001" {
+		t.Fatalf("wrong HTTP address for node: %s", addr)
+	}
+	servers, err := s0.Servers()
+	if err != nil {
+		t.Fatalf("failed to get servers: %s", err)
+	}
+	for _, srv := range servers {
+		if srv.ID == "node1" && srv.HTTPAddr != "127.0.0.1:11001" {
+			t.Fatalf("wrong HTTP address for server: %s", srv.HTTPAddr)
+		}
+	}
+
+	if err := s0.Promote("node1"); err != nil {
+		t.Fatalf("failed to promote node: %s", err)
+	}
+	if sf := suffrage(); sf != "voter" {
+		t.Fatalf("wrong suffrage after promotion: %s", sf)
+	}
+	for _, id := range []string{"node0", "node1", "node2"} {
+		if err := s0.Promote(id); err != ErrNotNonvoter {
+			t.Fatalf("wrong error promoting %s: %v", id, err)
+		}
+	}
+}
+
+// Test_StoreTransferLeadership tests that the leader can hand leadership to
+// a given node.
+func Test_StoreTransferLeadership(t *testing.T) {
+	s0 := New(true)
+	tmpDir0, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = freeAddr(t)
+	s0.RaftDir = tmpDir0
+	if err := s0.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s0.Close()
+
+	s1 := New(true)
+	tmpDir1, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = freeAddr(t)
+	s1.RaftDir = tmpDir1
+	if err := s1.Open(false, "node1"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s1.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if err := s0.Join("node1", s1.RaftBind, "", true); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	// Give node1 time to catch up with the log.
+	time.Sleep(time.Second)
+
+	if err := s1.TransferLeadership(""); err != ErrNotLeader {
+		t.Fatalf("wrong error transferring leadership from follower: %v", err)
+	}
+	if err := s0.TransferLeadership("node2"); err != ErrNodeNotFound {
+		t.Fatalf("wrong error transferring leadership to unknown node: %v", err)
+	}
+	if err := s0.TransferLeadership("node1"); err != nil {
+		t.Fatalf("failed to transfer leadership: %s", err)
+	}
+	if !s1.IsLeader() {
+		t.Fatalf("leadership not transferred to node1")
+	}
+}
+
+// Test_RaftMetrics tests that the Raft metrics reflect the node's state.
+func Test_RaftMetrics(t *testing.T) {
+	recordRaftMetrics(raft.Follower, map[string]string{})
+	recordRaftMetrics(raft.Leader, map[string]string{
+		"last_log_index": "7",
+		"commit_index":   "6",
+		"applied_index":  "5",
+	})
+
+	if v := testutil.ToFloat64(metrics.RaftState.WithLabelValues("leader")); v != 1 {
+		t.Fatalf("leader state gauge is %v (expected 1)", v)
+	}
+	if v := testutil.ToFloat64(metrics.RaftState.WithLabelValues("follower")); v != 0 {
+		t.Fatalf("follower state gauge is %v (expected 0)", v)
+	}
+	if v := testutil.ToFloat64(metrics.RaftLastLogIndex); v != 7 {
+		t.Fatalf("last log index gauge is %v (expected 7)", v)
+	}
+	if v := testutil.ToFloat64(metrics.RaftCommitIndex); v != 6 {
+		t.Fatalf("commit index gauge is %v (expected 6)", v)
+	}
+	if v := testutil.ToFloat64(metrics.RaftAppliedIndex); v != 5 {
+		t.Fatalf("applied index gauge is %v (expected 5)", v)
+	}
+}
+
+// Test_RaftMetricsBridge tests that Raft's internal metrics are exposed to
+// Prometheus once bridged.
+func Test_RaftMetricsBridge(t *testing.T) {
+	if err := metrics.RegisterRaftMetrics(); err != nil {
+		t.Fatalf("failed to register Raft metrics: %s", err)
+	}
+
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+	time.Sleep(3 * time.Second)
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	for _, f := range families {
+		if f.GetName() == "raft_apply" {
+			return
+		}
+	}
+	t.Fatalf("raft_apply not exposed")
+}
+
+// freeAddr returns a local address which is free to listen on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find free address: %s", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// numServers returns the number of servers in the store's Raft configuration.
+func numServers(t *testing.T, s *Store) int {
+	f := s.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		t.Fatalf("failed to get raft configuration: %s", err)
+	}
+	return len(f.Configuration().Servers)
+}
+
+// applyCommand applies the given command directly to the FSM, bypassing Raft.
+func applyCommand(t *testing.T, f *fsm, c *command) interface{} {
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err)
+	}
+	return f.Apply(&raft.Log{Data: b})
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+// ErrInvalidTxn is returned for a transaction containing an unknown op.
+var ErrInvalidTxn = errors.New("invalid transaction op")
+
+// Compare is a condition of a transaction, that Key holds Value. A missing
+// key is treated as having the empty string as its value.
+type Compare struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// TxnOp is a change made by a transaction: a "put" of Value to Key, or a
+// "delete" of Key.
+type TxnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Txn is a transaction. If every one of Compares holds, the Success ops are
+// applied, and otherwise the Failure ops, all within a single Raft log entry.
+type Txn struct {
+	Compares []Compare `json:"compare,omitempty"`
+	Success  []TxnOp   `json:"success,omitempty"`
+	Failure  []TxnOp   `json:"failure,omitempty"`
+}
+
+// Keys returns every key txn compares or changes.
+func (t Txn) Keys() []string {
+	var keys []string
+	for _, c := range t.Compares {
+		keys = append(keys, c.Key)
+	}
+	for _, ops := range [][]TxnOp{t.Success, t.Failure} {
+		for _, op := range ops {
+			keys = append(keys, op.Key)
+		}
+	}
+	return keys
+}
+
+// Txn applies txn atomically, returning whether its comparisons held, and so
+// whether its Success or its Failure ops were applied.
+func (s *Store) Txn(ctx context.Context, txn Txn) (bool, error) {
+	if s.raft.State() != raft.Leader {
+		return false, ErrNotLeader
+	}
+	for _, ops := range [][]TxnOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			switch op.Op {
+			case "put":
+				if err := s.checkValueSize(op.Value); err != nil {
+					return false, err
+				}
+			case "delete":
+			default:
+				return false, ErrInvalidTxn
+			}
+		}
+	}
+
+	c := &command{
+		Op:  "txn",
+		Txn: &txn,
+	}
+	r, err := s.apply(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	switch r := r.(type) {
+	case bool:
+		return r, nil
+	default:
+		return false, fmt.Errorf("unexpected transaction response: %v", r)
+	}
+}
+
+func (f *fsm) applyTxn(txn *Txn) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	succeeded := true
+	for _, c := range txn.Compares {
+		if v, _ := f.get(c.Key); v != c.Value {
+			succeeded = false
+			break
+		}
+	}
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case "put":
+			f.put(op.Key, op.Value)
+			delete(f.expiry, op.Key)
+		case "delete":
+			f.remove(op.Key)
+			delete(f.expiry, op.Key)
+		}
+	}
+	return succeeded
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookQueueSize = 16
+	webhookAttempts  = 5
+	webhookBackoff   = 100 * time.Millisecond
+	webhookTimeout   = 5 * time.Second
+)
+
+// LeaderEvent is posted, as JSON, to the leader webhook by a node which has
+// become leader.
+type LeaderEvent struct {
+	Event  string `json:"event"`
+	Leader string `json:"leader"`
+	Term   uint64 `json:"term"`
+}
+
+// webhook posts events to a URL from its own goroutine, so that a slow or
+// failing receiver cannot hold up Raft. Events are queued, up to a limit past
+// which new events are dropped, and each is retried, with exponential backoff,
+// a limited number of times.
+type webhook struct {
+	url     string
+	client  *http.Client
+	queue   chan LeaderEvent
+	done    chan struct{}
+	backoff time.Duration
+	logger  *log.Logger
+}
+
+// newWebhook returns a webhook posting to url, which runs until closed.
+func newWebhook(url string, logger *log.Logger) *webhook {
+	w := &webhook{
+		url:     url,
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan LeaderEvent, webhookQueueSize),
+		done:    make(chan struct{}),
+		backoff: webhookBackoff,
+		logger:  logger,
+	}
+	go w.run()
+	return w
+}
+
+// notify queues e to be posted, without blocking.
+func (w *webhook) notify(e LeaderEvent) {
+	select {
+	case w.queue <- e:
+	default:
+		w.logger.Printf("webhook queue full, dropping %s event", e.Event)
+	}
+}
+
+// close stops the webhook. Queued events are dropped.
+func (w *webhook) close() {
+	close(w.done)
+}
+
+func (w *webhook) run() {
+	for {
+		select {
+		case e := <-w.queue:
+			w.post(e)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// post posts e, retrying until it is accepted, the attempts are used up, or
+// the webhook is closed.
+func (w *webhook) post(e LeaderEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		w.logger.Printf("failed to encode %s event: %s", e.Event, err)
+		return
+	}
+
+	backoff := w.backoff
+	for i := 1; ; i++ {
+		err := w.postOnce(b)
+		if err == nil {
+			return
+		}
+		if i == webhookAttempts {
+			w.logger.Printf("failed to post %s event to webhook after %d attempts: %s", e.Event, i, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-w.done:
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhook) postOnce(b []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test_WebhookRetry tests that an event is retried until the webhook accepts
+// it, and is posted as JSON.
+func Test_WebhookRetry(t *testing.T) {
+	events := make(chan string, 1)
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		events <- string(b)
+	}))
+	defer ts.Close()
+
+	w := newWebhook(ts.URL, log.New(ioutil.Discard, "", 0))
+	defer w.close()
+	w.backoff = time.Millisecond
+	w.notify(LeaderEvent{Event: "leader_changed", Leader: "node2", Term: 7})
+
+	select {
+	case e := <-events:
+		if exp := `{"event":"leader_changed","leader":"node2","term":7}`; e != exp {
+			t.Fatalf("wrong event posted: %s (expected %s)", e, exp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+}
+
+// Test_StoreLeaderWebhook tests that a node announces becoming leader to the
+// leader webhook.
+func Test_StoreLeaderWebhook(t *testing.T) {
+	events := make(chan LeaderEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e LeaderEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("failed to decode event: %s", err)
+		}
+		events <- e
+	}))
+	defer ts.Close()
+
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.LeaderWebhook = ts.URL
+	if err := s.Open(true, "node0"); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	select {
+	case e := <-events:
+		if e.Event != "leader_changed" || e.Leader != "node0" || e.Term == 0 {
+			t.Fatalf("wrong event posted: %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+}
@@ -0,0 +1,16 @@
+// Package version describes the build of hraftd. Version and Commit are set at
+// build time, for example:
+//
+//	go build -ldflags "-X github.com/otoolep/hraftd/version.Version=v1.0.0 -X github.com/otoolep/hraftd/version.Commit=$(git rev-parse HEAD)"
+package version
+
+import "github.com/hashicorp/raft"
+
+// Version is the release of hraftd this binary was built from.
+var Version = "dev"
+
+// Commit is the source commit this binary was built from.
+var Commit = "unknown"
+
+// RaftProtocol is the Raft protocol version spoken by this binary.
+const RaftProtocol = raft.ProtocolVersionMax